@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+type ApiKey struct {
+	// Id of the api key, can be used to revoke it.
+	Id uuid.UUID `json:"id"`
+	// Name of the api key, used to identify it.
+	Name string `json:"name" example:"scanner"`
+	// When was this key created?
+	CreatedDate time.Time `json:"createdDate"`
+	// Last time this key was exchanged for a jwt.
+	LastUsed time.Time `json:"lastUsed"`
+	// Claims the jwt created from this key will have.
+	Claims jwt.MapClaims `json:"claims"`
+}
+
+type ApiKeyWToken struct {
+	ApiKey
+	// The token of the api key. It's only returned on creation and should be used like a session token.
+	Token string `json:"token"`
+}
+
+type ApiKeyDto struct {
+	// Name of the api key, used to identify it.
+	Name string `json:"name" validate:"required,alphanum" example:"scanner"`
+	// Claims the jwt created from this key will have.
+	Claims jwt.MapClaims `json:"claims" validate:"required"`
+}
+
+func MapApiKey(key *dbc.Apikey) ApiKey {
+	return ApiKey{
+		Id:          key.Id,
+		Name:        key.Name,
+		CreatedDate: key.CreatedDate,
+		LastUsed:    key.LastUsed,
+		Claims:      key.Claims,
+	}
+}
+
+// @Summary      List api keys
+// @Description  List all api keys of this instance.
+// @Tags         apikeys
+// @Produce      json
+// @Security     Jwt[apikey.read]
+// @Success      200  {object}  []ApiKey
+// @Failure      403  {object}  problem.Problem "Missing apikey.read permission"
+// @Router /apikeys [get]
+func (h *Handler) ListApiKeys(c echo.Context) error {
+	err := CheckPermissions(c, []string{"apikey.read"})
+	if err != nil {
+		return err
+	}
+
+	keys, err := h.db.ListApiKeys(context.Background())
+	if err != nil {
+		return err
+	}
+
+	ret := make([]ApiKey, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, MapApiKey(&key))
+	}
+	return c.JSON(200, ret)
+}
+
+// @Summary      Create api key
+// @Description  Create a new api key. Calling /jwt with it will return a jwt with the given claims.
+// @Tags         apikeys
+// @Accept       json
+// @Produce      json
+// @Security     Jwt[apikey.create]
+// @Param        key  body  ApiKeyDto  false  "Api key informations"
+// @Success      201  {object}  ApiKeyWToken
+// @Failure      400  {object}  problem.Problem "Invalid create body"
+// @Failure      403  {object}  problem.Problem "Missing apikey.create permission"
+// @Failure      409  {object}  problem.Problem "An api key with the same name already exists"
+// @Router /apikeys [post]
+func (h *Handler) CreateApiKey(c echo.Context) error {
+	err := CheckPermissions(c, []string{"apikey.create"})
+	if err != nil {
+		return err
+	}
+
+	var req ApiKeyDto
+	err = c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	var creator *uuid.UUID
+	if uid, err := GetCurrentUserId(c); err == nil {
+		creator = &uid
+	}
+
+	token = fmt.Sprintf("%s-%s", req.Name, token)
+	key, err := h.db.CreateApiKey(context.Background(), dbc.CreateApiKeyParams{
+		Name: req.Name,
+		// only the hash is stored, this is the only time the key is available.
+		Token:  HashToken(token),
+		Claims: req.Claims,
+		UserId: creator,
+	})
+	if ErrIs(err, pgerrcode.UniqueViolation) {
+		return echo.NewHTTPError(409, "An api key with the same name already exists.")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(201, ApiKeyWToken{
+		ApiKey: MapApiKey(&key),
+		Token:  token,
+	})
+}
+
+// @Summary      Delete api key
+// @Description  Revoke an api key. Jwts already created from it stay valid until they expire.
+// @Tags         apikeys
+// @Produce      json
+// @Security     Jwt[apikey.create]
+// @Param        id   path      string  true  "Id of the api key to delete" Format(uuid)
+// @Success      200  {object}  ApiKey
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "Missing apikey.create permission"
+// @Failure      404  {object}  problem.Problem "No api key with the given id"
+// @Router /apikeys/{id} [delete]
+func (h *Handler) DeleteApiKey(c echo.Context) error {
+	err := CheckPermissions(c, []string{"apikey.create"})
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	key, err := h.db.DeleteApiKey(context.Background(), id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No api key found with given id")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(200, MapApiKey(&key))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestApiKey(t *testing.T) {
+	s := NewTestServer(t, nil)
+	// the first user is an admin.
+	s.Register("admin-user")
+
+	var key ApiKeyWToken
+	s.Request(http.MethodPost, "/apikeys", map[string]any{
+		"name":   "scanner",
+		"claims": map[string]any{"permissions": []string{"overall.write"}},
+	}).Expect(t, http.StatusCreated).Json(t, &key)
+	if key.Token == "" {
+		t.Fatal("the token should be returned on creation")
+	}
+
+	// only the hash of the key is stored.
+	stored, err := s.h.db.GetApiKey(context.Background(), HashToken(key.Token))
+	if err != nil || stored.Token == key.Token {
+		t.Fatalf("the api key should be stored hashed: %v", err)
+	}
+	var keys []ApiKeyWToken
+	s.Request(http.MethodGet, "/apikeys", nil).Expect(t, http.StatusOK).Json(t, &keys)
+	if len(keys) != 1 || keys[0].Token != "" {
+		t.Fatalf("the token should only be returned on creation: %+v", keys)
+	}
+
+	s.UseSession(key.Token)
+	claims := DecodeJwt(t, s.Auth[len("Bearer "):])
+	if perms, _ := claims["permissions"].([]any); len(perms) != 1 || perms[0] != "overall.write" {
+		t.Fatalf("invalid api key claims: %v", claims)
+	}
+
+	s.Auth = "Bearer " + HashToken(key.Token)
+	s.Request(http.MethodGet, "/jwt", nil).Expect(t, http.StatusForbidden)
+}
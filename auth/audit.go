@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	AuditLogin               = "login"
+	AuditLogout              = "logout"
+	AuditRegister            = "register"
+	AuditPasswordChange      = "password.change"
+	AuditPasswordReset       = "password.reset"
+	AuditUserEdit            = "user.edit"
+	AuditClaimsEdit          = "user.claims"
+	AuditRolesEdit           = "user.roles"
+	AuditUserDelete          = "user.delete"
+	AuditUserApprove         = "user.approve"
+	AuditLockoutClear        = "lockout.clear"
+	AuditOidcLink            = "oidc.link"
+	AuditOidcUnlink          = "oidc.unlink"
+	AuditOtpEnable           = "otp.enable"
+	AuditOtpDisable          = "otp.disable"
+	AuditKeysRotate          = "keys.rotate"
+	AuditProfileSwitch       = "profile.switch"
+	AuditDeviceApprove       = "device.approve"
+	AuditDeviceDeny          = "device.deny"
+	AuditQuickConnectApprove = "quickconnect.approve"
+	AuditImpersonate         = "user.impersonate"
+	AuditImpersonationUse    = "impersonation.use"
+	AuditUserExport          = "user.export"
+)
+
+type AuditEvent struct {
+	Action  string
+	Outcome string
+	// User that did the action, defaults to the user of the jwt.
+	Actor *uuid.UUID
+	// User affected by the action.
+	Target  *uuid.UUID
+	Details map[string]any
+}
+
+type AuditLog struct {
+	// Id of this log entry.
+	Id uuid.UUID `json:"id"`
+	// When did this happen.
+	Date time.Time `json:"date"`
+	// What happened.
+	Action string `json:"action" example:"login"`
+	// If the action succeeded or not.
+	Outcome string `json:"outcome" enums:"success,failure"`
+	// Id of the user that did this action, null if unknown (failed login of an inexistant account for example).
+	ActorId *uuid.UUID `json:"actorId"`
+	// Id of the user affected by this action.
+	TargetId *uuid.UUID `json:"targetId"`
+	// Ip that made the request.
+	Ip *string `json:"ip"`
+	// User-Agent of the request.
+	UserAgent *string `json:"userAgent"`
+	// Additional informations about the action (the oidc provider used, why the action failed...).
+	Details map[string]any `json:"details"`
+}
+
+type auditCursor struct {
+	Date time.Time `json:"date"`
+	Pk   int64     `json:"pk"`
+}
+
+func MapAuditLog(log *dbc.AuditLog) AuditLog {
+	details := make(map[string]any)
+	_ = json.Unmarshal(log.Details, &details)
+	return AuditLog{
+		Id:        log.Id,
+		Date:      log.Date,
+		Action:    log.Action,
+		Outcome:   log.Outcome,
+		ActorId:   log.ActorId,
+		TargetId:  log.TargetId,
+		Ip:        log.Ip,
+		UserAgent: log.UserAgent,
+		Details:   details,
+	}
+}
+
+// Write an entry in the audit log. Errors are only logged, they should not fail the request.
+func (h *Handler) audit(c echo.Context, event AuditEvent) {
+	if event.Details == nil {
+		event.Details = make(map[string]any)
+	}
+	if event.Actor == nil {
+		if _, logged := c.Get("user").(*jwt.Token); logged {
+			if uid, err := GetCurrentUserId(c); err == nil {
+				event.Actor = &uid
+			}
+			// actions done while impersonating are attributed to the admin.
+			if admin, _ := GetImpersonatorId(c); admin != nil {
+				event.Details["impersonating"] = event.Actor
+				event.Actor = admin
+			}
+		}
+	}
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		c.Logger().Error(err)
+		return
+	}
+
+	ip := c.RealIP()
+	var ua *string
+	if agent := c.Request().UserAgent(); agent != "" {
+		ua = &agent
+	}
+	err = h.db.CreateAuditLog(context.Background(), dbc.CreateAuditLogParams{
+		Action:    event.Action,
+		Outcome:   event.Outcome,
+		ActorId:   event.Actor,
+		TargetId:  event.Target,
+		Ip:        &ip,
+		UserAgent: ua,
+		Details:   details,
+	})
+	if err != nil {
+		c.Logger().Error("could not write audit log: ", err)
+	}
+}
+
+func (h *Handler) auditLoginFailure(c echo.Context, target *uuid.UUID, login string, reason string) {
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditFailure,
+		Target:  target,
+		Details: map[string]any{"method": "password", "login": login, "reason": reason},
+	})
+}
+
+// Delete audit logs older than the configured retention.
+func (h *Handler) CleanupAuditLogs(ctx context.Context) (int64, error) {
+	if h.config.AuditRetention <= 0 {
+		return 0, nil
+	}
+	return h.db.CleanupAuditLogs(ctx, time.Now().UTC().Add(-h.config.AuditRetention))
+}
+
+// @Summary      List audit logs
+// @Description  List authentication events (logins, logouts, password changes...), newest first.
+// @Tags         audit
+// @Produce      json
+// @Security     Jwt[audit.read]
+// @Param        limit    query  int     false  "Number of items per page (max 250)" default(20)
+// @Param        after    query  string  false  "Cursor of the page, use the `next` link of the previous page"
+// @Param        action   query  string  false  "Only list logs of this action" example(login)
+// @Param        outcome  query  string  false  "Only list logs with this outcome" Enums(success, failure)
+// @Param        actor    query  string  false  "Only list logs of actions made by this user" Format(uuid)
+// @Param        target   query  string  false  "Only list logs of actions affecting this user" Format(uuid)
+// @Param        ip       query  string  false  "Only list logs of actions made from this ip"
+// @Param        since    query  string  false  "Only list logs after this date" Format(date-time)
+// @Param        until    query  string  false  "Only list logs before this date" Format(date-time)
+// @Success      200  {object}  Page[AuditLog]
+// @Failure      400  {object}  problem.Problem "Invalid parameter"
+// @Failure      403  {object}  problem.Problem "Missing audit.read permission"
+// @Router /audit [get]
+func (h *Handler) ListAuditLogs(c echo.Context) error {
+	err := CheckPermissions(c, []string{"audit.read"})
+	if err != nil {
+		return err
+	}
+
+	limit, err := GetPageLimit(c)
+	if err != nil {
+		return err
+	}
+	params := dbc.ListAuditLogsParams{Lim: limit}
+	if action := c.QueryParam("action"); action != "" {
+		params.Action = &action
+	}
+	if outcome := c.QueryParam("outcome"); outcome != "" {
+		if outcome != AuditSuccess && outcome != AuditFailure {
+			return echo.NewHTTPError(400, "Invalid `outcome` parameter, expected success or failure")
+		}
+		params.Outcome = &outcome
+	}
+	if actor := c.QueryParam("actor"); actor != "" {
+		uid, err := uuid.Parse(actor)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `actor` parameter, uuid was expected")
+		}
+		params.ActorId = &uid
+	}
+	if target := c.QueryParam("target"); target != "" {
+		uid, err := uuid.Parse(target)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `target` parameter, uuid was expected")
+		}
+		params.TargetId = &uid
+	}
+	if ip := c.QueryParam("ip"); ip != "" {
+		params.Ip = &ip
+	}
+	if since := c.QueryParam("since"); since != "" {
+		date, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `since` parameter, expected a RFC3339 date")
+		}
+		params.Since = &date
+	}
+	if until := c.QueryParam("until"); until != "" {
+		date, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `until` parameter, expected a RFC3339 date")
+		}
+		params.Until = &date
+	}
+	if after := c.QueryParam("after"); after != "" {
+		var cursor auditCursor
+		err = DecodeCursor(after, &cursor)
+		if err != nil {
+			return err
+		}
+		params.AfterDate = &cursor.Date
+		params.AfterPk = &cursor.Pk
+	}
+
+	logs, err := h.db.ListAuditLogs(context.Background(), params)
+	if err != nil {
+		return err
+	}
+	ret := make([]AuditLog, 0, len(logs))
+	for _, log := range logs {
+		ret = append(ret, MapAuditLog(&log))
+	}
+	page, err := NewPage(c, logs, limit, func(log *dbc.AuditLog) (string, error) {
+		return EncodeCursor(auditCursor{Date: log.Date, Pk: log.Pk})
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, Page[AuditLog]{
+		Items: ret,
+		This:  page.This,
+		Next:  page.Next,
+	})
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const CliUsage = `Usage: keibi <command> [arguments]
+
+Without a command, keibi starts the http server.
+
+Commands:
+  user create -username <name> -email <email> [-password-stdin] [-roles <roles>] [-claims <json>]
+  user list
+  user delete <user>
+  user approve <user>
+  password reset [-password-stdin] <user>
+  claims set <user> <json>
+  claims merge <user> <json>
+  roles set <user> <roles>
+  sessions revoke <user>
+  keys rotate [-grace <duration>]
+
+<user> is either the id, the username or the email of a user.
+<roles> is a comma separated list of roles.
+With -password-stdin, the password is read from stdin (prompted without echo on a terminal).
+Otherwise, a random one is generated and printed.
+`
+
+// Admin commands running directly against the database, usable without any jwt (to bootstrap or recover an instance).
+type Cli struct {
+	db     *dbc.Queries
+	config *Configuration
+	// Events are only queued, a running server sends them.
+	webhooks *Webhooks
+}
+
+// Run the command given in args, returning the exit code of the process.
+func RunCli(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, CliUsage)
+		return 2
+	}
+
+	type command = func(*Cli, context.Context, []string) error
+	commands := map[string]command{
+		"user create":     (*Cli).CreateUser,
+		"user list":       (*Cli).ListUsers,
+		"user delete":     (*Cli).DeleteUser,
+		"user approve":    (*Cli).ApproveUser,
+		"password reset":  (*Cli).ResetPassword,
+		"claims set":      (*Cli).SetClaims,
+		"claims merge":    (*Cli).MergeClaims,
+		"roles set":       (*Cli).SetRoles,
+		"sessions revoke": (*Cli).RevokeSessions,
+		"keys rotate":     (*Cli).RotateKeys,
+	}
+	run, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", strings.Join(args, " "), CliUsage)
+		return 2
+	}
+
+	conf, err := LoadConfiguration()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not load configuration:", err)
+		return 1
+	}
+	db, err := OpenDatabase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open database:", err)
+		return 1
+	}
+	defer db.Close()
+
+	queries := dbc.New(db)
+	cli := &Cli{db: queries, config: conf, webhooks: NewWebhooks(queries, conf.Webhooks)}
+	err = run(cli, context.Background(), args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func (cli *Cli) emit(ctx context.Context, event string, data any) {
+	err := cli.webhooks.Emit(ctx, event, data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not queue webhook:", err)
+	}
+}
+
+func (cli *Cli) emitSessions(ctx context.Context, userId uuid.UUID, sessions []dbc.Session) {
+	for _, session := range sessions {
+		cli.emit(ctx, WebhookSessionDeleted, WebhookSession{
+			Session: MapSession(&session),
+			UserId:  userId,
+		})
+	}
+}
+
+func (cli *Cli) audit(ctx context.Context, action string, target *uuid.UUID, details map[string]any) {
+	if details == nil {
+		details = make(map[string]any)
+	}
+	details["source"] = "cli"
+	raw, _ := json.Marshal(details)
+	err := cli.db.CreateAuditLog(ctx, dbc.CreateAuditLogParams{
+		Action:   action,
+		Outcome:  AuditSuccess,
+		TargetId: target,
+		Details:  raw,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write audit log:", err)
+	}
+}
+
+// Find a user by id, username or email.
+func (cli *Cli) findUser(ctx context.Context, login string) (dbc.User, error) {
+	var user dbc.User
+	var err error
+	if id, perr := uuid.Parse(login); perr == nil {
+		var rows []dbc.GetUserRow
+		rows, err = cli.db.GetUser(ctx, id)
+		if err == nil && len(rows) == 0 {
+			err = pgx.ErrNoRows
+		} else if err == nil {
+			user = rows[0].User
+		}
+	} else {
+		user, err = cli.db.GetUserByLogin(ctx, login)
+	}
+	if err == pgx.ErrNoRows {
+		return user, fmt.Errorf("no user found with the id, username or email %q", login)
+	}
+	return user, err
+}
+
+// Parse flags of a subcommand, positional arguments must come after the flags.
+func parseArgs(flags *flag.FlagSet, args []string, positional ...string) ([]string, error) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: keibi %s [flags] %s\n", flags.Name(), strings.Join(positional, " "))
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != len(positional) {
+		flags.Usage()
+		return nil, flag.ErrHelp
+	}
+	return flags.Args(), nil
+}
+
+func parseClaims(value string) (jwt.MapClaims, error) {
+	ret := make(jwt.MapClaims)
+	err := json.Unmarshal([]byte(value), &ret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims, expected a json object: %w", err)
+	}
+	return ret, nil
+}
+
+// Read the password from stdin or generate a random one.
+// Passwords are never given as arguments since those end up in the shell history & the process list.
+func passwordOrGenerate(fromStdin bool) (string, bool, error) {
+	if !fromStdin {
+		ret, err := GenerateCode()
+		return ret, true, err
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	read := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	pass, tty, err := withoutEcho(int(os.Stdin.Fd()), func() (string, error) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		defer fmt.Fprintln(os.Stderr)
+		return read()
+	})
+	if !tty {
+		pass, err = read()
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("could not read the password: %w", err)
+	}
+	if pass == "" {
+		return "", false, errors.New("empty password")
+	}
+	return pass, false, nil
+}
+
+func (cli *Cli) updateUser(ctx context.Context, user *dbc.User) (dbc.User, error) {
+	return cli.db.UpdateUser(ctx, dbc.UpdateUserParams{
+		Id:       user.Id,
+		Username: user.Username,
+		Email:    user.Email,
+		Password: user.Password,
+		Claims:   user.Claims,
+		Roles:    user.Roles,
+	})
+}
+
+func (cli *Cli) CreateUser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	username := flags.String("username", "", "Username of the new user")
+	email := flags.String("email", "", "Email of the new user")
+	password := flags.Bool("password-stdin", false, "Read the password of the new user from stdin (generated otherwise)")
+	roles := flags.String("roles", "", "Comma separated list of roles (defaults to KEIBI_DEFAULT_ROLES)")
+	claims := flags.String("claims", "", "Custom claims as a json object (defaults to KEIBI_DEFAULT_CLAIMS)")
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+	if *username == "" || *email == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if strings.Contains(*username, "@") {
+		return errors.New("username can't contain @ signs")
+	}
+
+	params := dbc.CreateUserParams{
+		Username: *username,
+		Email:    *email,
+		Claims:   cli.config.DefaultClaims,
+		// users created by an operator are trusted.
+		EmailVerified:  true,
+		Roles:          cli.config.DefaultRoles,
+		FirstUserRoles: cli.config.FirstUserRoles,
+	}
+	if *roles != "" {
+		params.Roles = SplitList(*roles)
+		params.FirstUserRoles = params.Roles
+		if err := cli.config.ValidateRoles(params.Roles); err != nil {
+			return err
+		}
+	}
+	if *claims != "" {
+		parsed, err := parseClaims(*claims)
+		if err != nil {
+			return err
+		}
+		params.Claims = parsed
+	}
+	pass, generated, err := passwordOrGenerate(*password)
+	if err != nil {
+		return err
+	}
+	hash, err := argon2id.CreateHash(pass, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+	params.Password = &hash
+
+	user, err := CreateUser(ctx, cli.db, params)
+	if ErrIs(err, pgerrcode.UniqueViolation) {
+		return errors.New("email or username already taken")
+	} else if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditRegister, &user.Id, map[string]any{"method": "password"})
+	cli.emit(ctx, WebhookUserCreated, MapDbUser(&user))
+
+	fmt.Printf("Created user %s (%s) with roles %s\n", user.Username, user.Id, strings.Join(user.Roles, ", "))
+	if generated {
+		fmt.Printf("Password: %s\n", pass)
+	}
+	return nil
+}
+
+func (cli *Cli) ListUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user list", flag.ContinueOnError)
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tROLES\tPENDING\tLAST SEEN")
+	params := dbc.ListUsersParams{
+		Sort: "createdDate",
+		Lim:  MaxPageSize,
+	}
+	for {
+		users, err := cli.db.ListUsers(ctx, params)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\t%t\t%s\n",
+				user.Id,
+				user.Username,
+				user.Email,
+				strings.Join(user.Roles, ","),
+				user.Pending,
+				user.LastSeen.Format("2006-01-02 15:04"),
+			)
+		}
+		if len(users) < MaxPageSize {
+			break
+		}
+		last := users[len(users)-1]
+		params.AfterId = &last.Id
+		params.AfterDate = &last.CreatedDate
+	}
+	return w.Flush()
+}
+
+func (cli *Cli) DeleteUser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	pos, err := parseArgs(flags, args, "<user>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+
+	sessions, err := cli.db.DeleteAllUserSessions(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	_, err = cli.db.DeleteUser(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditUserDelete, &user.Id, map[string]any{"username": user.Username})
+	cli.emitSessions(ctx, user.Id, sessions)
+	cli.emit(ctx, WebhookUserDeleted, MapDbUser(&user))
+	fmt.Printf("Deleted user %s (%s)\n", user.Username, user.Id)
+	return nil
+}
+
+func (cli *Cli) ApproveUser(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user approve", flag.ContinueOnError)
+	pos, err := parseArgs(flags, args, "<user>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+
+	approved, err := cli.db.ApproveUser(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditUserApprove, &user.Id, nil)
+	cli.emit(ctx, WebhookUserUpdated, MapDbUser(&approved))
+	fmt.Printf("Approved user %s (%s)\n", user.Username, user.Id)
+	return nil
+}
+
+func (cli *Cli) ResetPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("password reset", flag.ContinueOnError)
+	password := flags.Bool("password-stdin", false, "Read the new password from stdin (generated otherwise)")
+	pos, err := parseArgs(flags, args, "<user>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+
+	pass, generated, err := passwordOrGenerate(*password)
+	if err != nil {
+		return err
+	}
+	hash, err := argon2id.CreateHash(pass, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+	_, err = cli.db.SetUserPassword(ctx, dbc.SetUserPasswordParams{
+		Pk:       user.Pk,
+		Password: &hash,
+	})
+	if err != nil {
+		return err
+	}
+	// same as a password reset via mail, every session is closed.
+	sessions, err := cli.db.DeleteAllUserSessions(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	cli.emitSessions(ctx, user.Id, sessions)
+	err = cli.db.ClearLoginAttempts(ctx, dbc.ClearLoginAttemptsParams{
+		Kind:   AccountAttempts,
+		Target: user.Id.String(),
+	})
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditPasswordReset, &user.Id, nil)
+
+	fmt.Printf("Password of %s (%s) reset, all its sessions were closed\n", user.Username, user.Id)
+	if generated {
+		fmt.Printf("Password: %s\n", pass)
+	}
+	return nil
+}
+
+func (cli *Cli) editClaims(ctx context.Context, name string, args []string, merge bool) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	pos, err := parseArgs(flags, args, "<user>", "<json>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	claims, err := parseClaims(pos[1])
+	if err != nil {
+		return err
+	}
+
+	if merge {
+		user.Claims = maps.Clone(user.Claims)
+		if user.Claims == nil {
+			user.Claims = make(jwt.MapClaims)
+		}
+		maps.Copy(user.Claims, claims)
+	} else {
+		user.Claims = claims
+	}
+	updated, err := cli.updateUser(ctx, &user)
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditClaimsEdit, &user.Id, map[string]any{"claims": updated.Claims})
+	cli.emit(ctx, WebhookUserUpdated, MapDbUser(&updated))
+
+	out, err := json.Marshal(updated.Claims)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Claims of %s (%s): %s\n", updated.Username, updated.Id, out)
+	return nil
+}
+
+func (cli *Cli) SetClaims(ctx context.Context, args []string) error {
+	return cli.editClaims(ctx, "claims set", args, false)
+}
+
+func (cli *Cli) MergeClaims(ctx context.Context, args []string) error {
+	return cli.editClaims(ctx, "claims merge", args, true)
+}
+
+func (cli *Cli) SetRoles(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("roles set", flag.ContinueOnError)
+	pos, err := parseArgs(flags, args, "<user>", "<roles>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	roles := SplitList(pos[1])
+	if err = cli.config.ValidateRoles(roles); err != nil {
+		return err
+	}
+
+	old := user.Roles
+	user.Roles = roles
+	updated, err := cli.updateUser(ctx, &user)
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditRolesEdit, &user.Id, map[string]any{"old": old, "new": updated.Roles})
+	cli.emit(ctx, WebhookUserUpdated, MapDbUser(&updated))
+	fmt.Printf("Roles of %s (%s): %s\n", updated.Username, updated.Id, strings.Join(updated.Roles, ", "))
+	return nil
+}
+
+func (cli *Cli) RevokeSessions(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	pos, err := parseArgs(flags, args, "<user>")
+	if err != nil {
+		return err
+	}
+	user, err := cli.findUser(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+
+	sessions, err := cli.db.DeleteAllUserSessions(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	cli.emitSessions(ctx, user.Id, sessions)
+	cli.audit(ctx, AuditLogout, &user.Id, map[string]any{"sessions": "all"})
+	fmt.Printf("Revoked all sessions of %s (%s)\n", user.Username, user.Id)
+	return nil
+}
+
+func (cli *Cli) RotateKeys(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	grace := flags.Duration(
+		"grace",
+		cli.config.KeyRotationGrace,
+		"How long jwts signed with the previous key stay valid (0 to revoke them immediately)",
+	)
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	keys, err := LoadKeys(ctx, cli.db, cli.config.JwtAlgorithm)
+	if err != nil {
+		return err
+	}
+	prev := keys.Current()
+	key, err := keys.Rotate(ctx, *grace)
+	if err != nil {
+		return err
+	}
+	cli.audit(ctx, AuditKeysRotate, nil, map[string]any{"previous": prev.Id, "current": key.Id})
+	fmt.Printf("Rotated jwt signing key %s -> %s, running instances will use it within a minute\n", prev.Id, key.Id)
+	return nil
+}
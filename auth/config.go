@@ -1,83 +1,293 @@
 package main
 
 import (
-	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/zoriya/kyoo/keibi/dbc"
 )
 
 type Configuration struct {
 	Prefix          string
-	JwtPrivateKey   *rsa.PrivateKey
-	JwtPublicKey    *rsa.PublicKey
+	PublicUrl       string
 	Issuer          string
 	DefaultClaims   jwt.MapClaims
 	ExpirationDelay time.Duration
+	Oidc            map[string]OidcProviderConfig
+	// Url of a keibi instance used for oidc providers not configured locally.
+	FederatedUrl string
+	// Tenants allowed to use this instance's oidc providers (`*` to allow every tenants).
+	AllowedTenants []string
+	// Origins, other than PUBLIC_URL, oidc logins can redirect to.
+	AllowedRedirects []string
+	LogoDir          string
+	// Prevent users from logging in with a password until they verify their email.
+	RequireVerifiedEmail bool
+	// How long jwts signed with a previous key stay valid after a key rotation.
+	KeyRotationGrace time.Duration
+	// How long jwts created by the forward auth endpoint are cached (0 to disable the cache).
+	ForwardAuthCacheTtl time.Duration
+	// Failed logins allowed for an account before it gets locked.
+	LoginMaxAttempts int
+	// Failed logins allowed for an ip before it gets locked.
+	LoginMaxIpAttempts int
+	// Duration of the first lockout, doubled after each subsequent failure.
+	LoginLockoutDelay time.Duration
+	// Return the same error for unknown accounts and invalid passwords.
+	GenericLoginErrors bool
+	// Permissions of each role.
+	Roles map[string][]string
+	// Roles given to new users.
+	DefaultRoles []string
+	// Roles given to the first user of the instance.
+	FirstUserRoles []string
+	// How long audit logs are kept (0 to keep them forever).
+	AuditRetention time.Duration
+	// Lifetime of jwts created via /jwt.
+	JwtExpiration time.Duration
+	// Algorithm used to sign jwts: RS256, ES256 or EdDSA.
+	JwtAlgorithm string
+	// Allowed values of the `aud` claim, the first one is used by default.
+	JwtAudiences []string
+	// Extra claims of jwts, mapping a claim name to a user field (see JwtClaimFields).
+	JwtClaims map[string]string
+	// How often expired sessions, codes and logs are deleted.
+	JanitorInterval time.Duration
+	// Who can create an account: open, invite, approval or closed.
+	RegistrationMode string
+	// Urls notified of user & session events.
+	Webhooks map[string]WebhookConfig
+	// Page where users enter the code displayed by devices using the device flow.
+	DeviceVerificationUrl string
+	// Lifetime of jwts created to impersonate a user.
+	ImpersonationDuration time.Duration
+	// Ldap server used to login users without a local password, nil if disabled.
+	Ldap *LdapConfig
 }
 
 var DefaultConfig = Configuration{
-	Issuer:          "kyoo",
-	DefaultClaims:   make(jwt.MapClaims),
-	ExpirationDelay: 30 * 24 * time.Hour,
+	Issuer:                "kyoo",
+	LogoDir:               "logos",
+	DefaultClaims:         make(jwt.MapClaims),
+	ExpirationDelay:       30 * 24 * time.Hour,
+	KeyRotationGrace:      24 * time.Hour,
+	ForwardAuthCacheTtl:   30 * time.Second,
+	LoginMaxAttempts:      5,
+	LoginMaxIpAttempts:    20,
+	LoginLockoutDelay:     time.Minute,
+	DefaultRoles:          []string{"user"},
+	FirstUserRoles:        []string{"admin"},
+	AuditRetention:        90 * 24 * time.Hour,
+	JwtExpiration:         time.Hour,
+	JwtAlgorithm:          "RS256",
+	JanitorInterval:       time.Hour,
+	RegistrationMode:      RegistrationOpen,
+	ImpersonationDuration: 15 * time.Minute,
 }
 
-const (
-	JwtPrivateKey = "jwt_private_key"
-)
+func LoadConfiguration() (*Configuration, error) {
+	ret := DefaultConfig
+	var err error
 
-func LoadConfiguration(db *dbc.Queries) (*Configuration, error) {
-	ctx := context.Background()
-	confs, err := db.LoadConfig(ctx)
-	if err != nil {
-		return nil, err
+	ret.Prefix = os.Getenv("KEIBI_PREFIX")
+	ret.Issuer = GetenvOr("KEIBI_ISSUER", ret.Issuer)
+	ret.PublicUrl = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	ret.Oidc = LoadOidcProviders()
+	ret.FederatedUrl = strings.TrimSuffix(os.Getenv("KEIBI_FEDERATED_URL"), "/")
+	if tenants := os.Getenv("KEIBI_ALLOWED_TENANTS"); tenants != "" {
+		ret.AllowedTenants = SplitList(tenants)
 	}
+	ret.AllowedRedirects = SplitList(os.Getenv("KEIBI_ALLOWED_REDIRECTS"))
+	if (len(ret.Oidc) > 0 || ret.FederatedUrl != "") && ret.PublicUrl == "" {
+		return nil, fmt.Errorf("PUBLIC_URL must be set to use oidc providers")
+	}
+	ret.LogoDir = GetenvOr("KEIBI_LOGO_DIR", ret.LogoDir)
+	ret.RequireVerifiedEmail = os.Getenv("KEIBI_REQUIRE_VERIFIED_EMAIL") == "true"
 
-	ret := DefaultConfig
+	if claims := os.Getenv("KEIBI_DEFAULT_CLAIMS"); claims != "" {
+		ret.DefaultClaims = make(jwt.MapClaims)
+		err = json.Unmarshal([]byte(claims), &ret.DefaultClaims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_DEFAULT_CLAIMS, expected a json object: %w", err)
+		}
+	}
+	ret.Roles = LoadRoles()
+	if roles, ok := os.LookupEnv("KEIBI_DEFAULT_ROLES"); ok {
+		ret.DefaultRoles = SplitList(roles)
+	}
+	if roles, ok := os.LookupEnv("KEIBI_FIRST_USER_ROLES"); ok {
+		ret.FirstUserRoles = SplitList(roles)
+	}
+	if err = ret.ValidateRoles(ret.DefaultRoles); err != nil {
+		return nil, fmt.Errorf("invalid KEIBI_DEFAULT_ROLES: %w", err)
+	}
+	if err = ret.ValidateRoles(ret.FirstUserRoles); err != nil {
+		return nil, fmt.Errorf("invalid KEIBI_FIRST_USER_ROLES: %w", err)
+	}
 
-	for _, conf := range confs {
-		switch conf.Key {
-		case JwtPrivateKey:
-			block, _ := pem.Decode([]byte(conf.Value))
-			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-			if err != nil {
-				return nil, err
+	if grace := os.Getenv("KEIBI_KEY_ROTATION_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_KEY_ROTATION_GRACE: %w", err)
+		}
+		ret.KeyRotationGrace = d
+	}
+	if ttl := os.Getenv("KEIBI_FORWARD_AUTH_CACHE"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_FORWARD_AUTH_CACHE: %w", err)
+		}
+		ret.ForwardAuthCacheTtl = d
+	}
+	if attempts := os.Getenv("KEIBI_LOGIN_MAX_ATTEMPTS"); attempts != "" {
+		ret.LoginMaxAttempts, err = strconv.Atoi(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_LOGIN_MAX_ATTEMPTS: %w", err)
+		}
+	}
+	if attempts := os.Getenv("KEIBI_LOGIN_MAX_IP_ATTEMPTS"); attempts != "" {
+		ret.LoginMaxIpAttempts, err = strconv.Atoi(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_LOGIN_MAX_IP_ATTEMPTS: %w", err)
+		}
+	}
+	if delay := os.Getenv("KEIBI_LOGIN_LOCKOUT"); delay != "" {
+		ret.LoginLockoutDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_LOGIN_LOCKOUT: %w", err)
+		}
+	}
+	ret.GenericLoginErrors = os.Getenv("KEIBI_GENERIC_LOGIN_ERRORS") == "true"
+	if delay := os.Getenv("KEIBI_SESSION_EXPIRATION"); delay != "" {
+		ret.ExpirationDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_SESSION_EXPIRATION: %w", err)
+		}
+	}
+	if exp := os.Getenv("KEIBI_JWT_EXPIRATION"); exp != "" {
+		ret.JwtExpiration, err = time.ParseDuration(exp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_JWT_EXPIRATION: %w", err)
+		}
+	}
+	ret.JwtAlgorithm = GetenvOr("KEIBI_JWT_ALGORITHM", ret.JwtAlgorithm)
+	if !slices.Contains(JwtAlgorithms, ret.JwtAlgorithm) {
+		return nil, fmt.Errorf("invalid KEIBI_JWT_ALGORITHM, expected one of %s: %s", strings.Join(JwtAlgorithms, ", "), ret.JwtAlgorithm)
+	}
+	ret.JwtAudiences = SplitList(os.Getenv("KEIBI_JWT_AUDIENCES"))
+	if claims := os.Getenv("KEIBI_JWT_CLAIMS"); claims != "" {
+		err = json.Unmarshal([]byte(claims), &ret.JwtClaims)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_JWT_CLAIMS, expected a json object: %w", err)
+		}
+		for claim, field := range ret.JwtClaims {
+			if slices.Contains(ReservedClaims, claim) {
+				return nil, fmt.Errorf("invalid KEIBI_JWT_CLAIMS, the %s claim is reserved", claim)
+			}
+			if _, ok := JwtClaimFields[field]; !ok {
+				return nil, fmt.Errorf("invalid KEIBI_JWT_CLAIMS, unknown user field: %s", field)
 			}
-			ret.JwtPrivateKey = key
-			ret.JwtPublicKey = &key.PublicKey
 		}
 	}
-
-	ret.Prefix = os.Getenv("KEIBI_PREFIX")
-
-	if ret.JwtPrivateKey == nil {
-		ret.JwtPrivateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	if interval := os.Getenv("KEIBI_JANITOR_INTERVAL"); interval != "" {
+		ret.JanitorInterval, err = time.ParseDuration(interval)
+		if err != nil || ret.JanitorInterval <= 0 {
+			return nil, fmt.Errorf("invalid KEIBI_JANITOR_INTERVAL, expected a positive duration: %s", interval)
+		}
+	}
+	if retention := os.Getenv("KEIBI_AUDIT_RETENTION"); retention != "" {
+		ret.AuditRetention, err = time.ParseDuration(retention)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid KEIBI_AUDIT_RETENTION: %w", err)
+		}
+	}
+	if duration := os.Getenv("KEIBI_IMPERSONATION_DURATION"); duration != "" {
+		ret.ImpersonationDuration, err = time.ParseDuration(duration)
+		if err != nil || ret.ImpersonationDuration <= 0 {
+			return nil, fmt.Errorf("invalid KEIBI_IMPERSONATION_DURATION, expected a positive duration: %s", duration)
 		}
-		ret.JwtPublicKey = &ret.JwtPrivateKey.PublicKey
+	}
+	ret.RegistrationMode = GetenvOr("KEIBI_REGISTRATION", ret.RegistrationMode)
+	if !slices.Contains(
+		[]string{RegistrationOpen, RegistrationInvite, RegistrationApproval, RegistrationClosed},
+		ret.RegistrationMode,
+	) {
+		return nil, fmt.Errorf("invalid KEIBI_REGISTRATION, expected open, invite, approval or closed: %s", ret.RegistrationMode)
+	}
+	ret.DeviceVerificationUrl = GetenvOr("KEIBI_DEVICE_VERIFICATION_URL", ret.PublicUrl+"/device")
+	ret.Webhooks, err = LoadWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	ret.Ldap, err = LoadLdapConfig(&ret)
+	if err != nil {
+		return nil, err
+	}
 
-		pemd := pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(ret.JwtPrivateKey),
-			},
-		)
+	return &ret, nil
+}
 
-		_, err := db.SaveConfig(ctx, dbc.SaveConfigParams{
-			Key:   JwtPrivateKey,
-			Value: string(pemd),
-		})
-		if err != nil {
-			return nil, err
+func LoadOidcProviders() map[string]OidcProviderConfig {
+	ret := make(map[string]OidcProviderConfig)
+
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, "OIDC_") || value == "" {
+			continue
 		}
+		sep := strings.LastIndex(key, "_")
+		if sep <= len("OIDC_") {
+			fmt.Printf("Invalid oidc config value: %s\n", key)
+			continue
+		}
+		id := strings.ToLower(key[len("OIDC_"):sep])
+		prop := strings.ToLower(key[sep+1:])
+
+		prov, ok := ret[id]
+		if !ok {
+			prov = NewOidcProviderConfig(id)
+		}
+		switch prop {
+		case "name":
+			prov.Name = value
+		case "logo":
+			prov.Logo = value
+		case "clientid":
+			prov.ClientId = value
+		case "secret":
+			prov.Secret = value
+		case "authorization":
+			prov.AuthorizationUrl = value
+		case "token":
+			prov.TokenUrl = value
+		case "profile", "userinfo":
+			prov.ProfileUrl = value
+		case "scope":
+			prov.Scope = value
+		case "authmethod", "clientauthmethod", "method":
+			switch AuthMethod(value) {
+			case ClientSecretBasic, ClientSecretPost:
+				prov.AuthMethod = AuthMethod(value)
+			default:
+				fmt.Printf("Invalid oidc auth method for %s: %s. Ignoring.\n", id, value)
+			}
+		default:
+			fmt.Printf("Invalid oidc config value: %s\n", key)
+			continue
+		}
+		ret[id] = prov
 	}
 
-	return &ret, nil
+	for id, prov := range ret {
+		if !prov.Enabled() {
+			fmt.Printf("Oidc provider %s is missing required settings, disabling it.\n", id)
+			delete(ret, id)
+		}
+	}
+	return ret
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	DeviceGrantType      = "urn:ietf:params:oauth:grant-type:device_code"
+	DeviceRequestTimeout = 10 * time.Minute
+	DevicePollInterval   = 5
+	DeviceUserCodeLength = 8
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+	// Consonants only (as recommended by rfc 8628) to prevent words & typos.
+	DeviceUserCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+type DeviceCode struct {
+	// Code used by the device to poll /device/token, keep it secret.
+	DeviceCode string `json:"device_code"`
+	// Code to display to the user.
+	UserCode string `json:"user_code" example:"WDJB-MJHT"`
+	// Page where the user should enter the code.
+	VerificationUri string `json:"verification_uri" example:"https://kyoo.zoriya.dev/device"`
+	// Same as `verification_uri` but with the code already filled (can be displayed as a qr code).
+	VerificationUriComplete string `json:"verification_uri_complete" example:"https://kyoo.zoriya.dev/device?code=WDJB-MJHT"`
+	// Number of seconds before the codes expire.
+	ExpiresIn int `json:"expires_in" example:"600"`
+	// Minimum number of seconds to wait between two polls.
+	Interval int `json:"interval" example:"5"`
+}
+
+type DeviceTokenDto struct {
+	// Must be `urn:ietf:params:oauth:grant-type:device_code`.
+	GrantType string `json:"grant_type" form:"grant_type" validate:"required"`
+	// The `device_code` returned by /device/code.
+	DeviceCode string `json:"device_code" form:"device_code" validate:"required"`
+}
+
+type DeviceError struct {
+	// One of `authorization_pending`, `slow_down`, `access_denied`, `expired_token`, `invalid_grant` or `unsupported_grant_type`.
+	Error string `json:"error" example:"authorization_pending"`
+	// Human readable explanation of the error.
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type DeviceRequest struct {
+	// Code displayed on the device.
+	UserCode string `json:"userCode" example:"WDJB-MJHT"`
+	// Device that wants to login.
+	Device *string `json:"device" example:"Android TV"`
+	// When did the device ask for a code.
+	CreatedDate time.Time `json:"createdDate"`
+	// After this date, the code can't be approved anymore.
+	ExpireDate time.Time `json:"expireDate"`
+}
+
+func MapDeviceRequest(req *dbc.DeviceRequest) DeviceRequest {
+	return DeviceRequest{
+		UserCode:    FormatUserCode(req.UserCode),
+		Device:      req.Device,
+		CreatedDate: req.CreatedDate,
+		ExpireDate:  req.ExpireAt,
+	}
+}
+
+func GenerateUserCode() (string, error) {
+	var ret strings.Builder
+	size := big.NewInt(int64(len(DeviceUserCodeCharset)))
+	for range DeviceUserCodeLength {
+		i, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		ret.WriteByte(DeviceUserCodeCharset[i.Int64()])
+	}
+	return ret.String(), nil
+}
+
+// Display a user code as XXXX-XXXX.
+func FormatUserCode(code string) string {
+	if len(code) != DeviceUserCodeLength {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// Users might type the code in lowercase or without the dash.
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func deviceError(c echo.Context, status int, code string, description string) error {
+	return c.JSON(status, DeviceError{Error: code, ErrorDescription: description})
+}
+
+// @Summary      Request device code
+// @Description  Start the device authorization flow (rfc 8628), used by devices where typing a password is hard (TVs for example).
+// @Description  Display the `user_code` and the `verification_uri` then poll /device/token until the user approves the request.
+// @Tags         device
+// @Produce      json
+// @Param        device  query   string  false  "Name of the device, used as the name of the created session"
+// @Success      200  {object}  DeviceCode
+// @Router /device/code [post]
+func (h *Handler) RequestDeviceCode(c echo.Context) error {
+	code, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	userCode, err := GenerateUserCode()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.CreateDeviceRequest(context.Background(), dbc.CreateDeviceRequestParams{
+		DeviceCode:   HashToken(code),
+		UserCode:     userCode,
+		Device:       getDevice(c),
+		PollInterval: DevicePollInterval,
+		ExpireAt:     time.Now().UTC().Add(DeviceRequestTimeout),
+	})
+	if err != nil {
+		return err
+	}
+
+	formatted := FormatUserCode(userCode)
+	return c.JSON(http.StatusOK, DeviceCode{
+		DeviceCode:              code,
+		UserCode:                formatted,
+		VerificationUri:         h.config.DeviceVerificationUrl,
+		VerificationUriComplete: fmt.Sprintf("%s?code=%s", h.config.DeviceVerificationUrl, url.QueryEscape(formatted)),
+		ExpiresIn:               int(DeviceRequestTimeout.Seconds()),
+		Interval:                DevicePollInterval,
+	})
+}
+
+// @Summary      Poll device token
+// @Description  Poll the status of a device code. Once the user approves it, a session is created and returned.
+// @Description  Errors follow rfc 8628: `authorization_pending` and `slow_down` mean you should poll again later (after `interval` seconds, increased by 5 after a `slow_down`).
+// @Tags         device
+// @Accept       json,x-www-form-urlencoded
+// @Produce      json
+// @Param        body  body  DeviceTokenDto  false  "Device code"
+// @Success      201  {object}  dbc.Session
+// @Failure      400  {object}  DeviceError
+// @Router /device/token [post]
+func (h *Handler) PollDeviceToken(c echo.Context) error {
+	var req DeviceTokenDto
+	err := c.Bind(&req)
+	if err != nil || c.Validate(&req) != nil {
+		return deviceError(c, http.StatusBadRequest, "invalid_request", "Missing grant_type or device_code.")
+	}
+	if req.GrantType != DeviceGrantType {
+		return deviceError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+
+	ctx := context.Background()
+	row, err := h.db.GetDeviceRequest(ctx, HashToken(req.DeviceCode))
+	if err == pgx.ErrNoRows {
+		return deviceError(c, http.StatusBadRequest, "invalid_grant", "Unknown device code.")
+	} else if err != nil {
+		return err
+	}
+	request := row.DeviceRequest
+	now := time.Now().UTC()
+
+	if request.ExpireAt.Before(now) {
+		_, _ = h.db.DeleteDeviceRequest(ctx, request.Pk)
+		return deviceError(c, http.StatusBadRequest, "expired_token", "")
+	}
+
+	switch request.Status {
+	case DeviceStatusDenied:
+		_, _ = h.db.DeleteDeviceRequest(ctx, request.Pk)
+		return deviceError(c, http.StatusBadRequest, "access_denied", "")
+	case DeviceStatusPending:
+		interval := request.PollInterval
+		// allow a second of jitter between polls.
+		tooFast := request.LastPoll != nil &&
+			request.LastPoll.Add(time.Duration(interval-1)*time.Second).After(now)
+		if tooFast {
+			interval += DevicePollInterval
+		}
+		err = h.db.PollDeviceRequest(ctx, dbc.PollDeviceRequestParams{
+			Pk:           request.Pk,
+			PollInterval: interval,
+		})
+		if err != nil {
+			return err
+		}
+		if tooFast {
+			return deviceError(c, http.StatusBadRequest, "slow_down", "")
+		}
+		return deviceError(c, http.StatusBadRequest, "authorization_pending", "")
+	}
+
+	// the request is approved, it can only be exchanged once.
+	deleted, err := h.db.DeleteDeviceRequest(ctx, request.Pk)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 || row.UserId == nil {
+		return deviceError(c, http.StatusBadRequest, "invalid_grant", "Device code already used.")
+	}
+	user, err := h.getUser(ctx, *row.UserId)
+	if err == pgx.ErrNoRows {
+		return deviceError(c, http.StatusBadRequest, "invalid_grant", "The user was deleted.")
+	} else if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &user.Id,
+		Target:  &user.Id,
+		Details: map[string]any{"method": "device", "device": request.Device},
+	})
+	return h.createDeviceSession(c, &user, request.Device)
+}
+
+// @Summary      Get device request
+// @Description  Get informations about a pending device request, to display them before approving it.
+// @Tags         device
+// @Produce      json
+// @Security     Jwt
+// @Param        code  path  string  true  "The code displayed on the device" example(WDJB-MJHT)
+// @Success      200  {object}  DeviceRequest
+// @Failure      404  {object}  problem.Problem "Invalid or expired code"
+// @Router /device/{code} [get]
+func (h *Handler) GetDeviceRequest(c echo.Context) error {
+	request, err := h.db.GetDeviceRequestByUserCode(context.Background(), NormalizeUserCode(c.Param("code")))
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired code.")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, MapDeviceRequest(&request))
+}
+
+// @Summary      Approve device
+// @Description  Approve a device request, the device will receive a session for your account on its next poll.
+// @Description  This can't be done while a profile is active.
+// @Tags         device
+// @Produce      json
+// @Security     Jwt
+// @Param        code  path  string  true  "The code displayed on the device" example(WDJB-MJHT)
+// @Success      200  {object}  DeviceRequest
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "Invalid or expired code"
+// @Router /device/{code}/approve [post]
+func (h *Handler) ApproveDevice(c echo.Context) error {
+	return h.resolveDevice(c, DeviceStatusApproved)
+}
+
+// @Summary      Deny device
+// @Description  Deny a device request, the device will receive an `access_denied` error on its next poll.
+// @Tags         device
+// @Produce      json
+// @Security     Jwt
+// @Param        code  path  string  true  "The code displayed on the device" example(WDJB-MJHT)
+// @Success      200  {object}  DeviceRequest
+// @Failure      404  {object}  problem.Problem "Invalid or expired code"
+// @Router /device/{code}/deny [post]
+func (h *Handler) DenyDevice(c echo.Context) error {
+	return h.resolveDevice(c, DeviceStatusDenied)
+}
+
+func (h *Handler) resolveDevice(c echo.Context, status string) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if status == DeviceStatusApproved {
+		// the new session would have access to the whole account.
+		if err = RequireAccountSession(c); err != nil {
+			return err
+		}
+	}
+
+	request, err := h.db.ResolveDeviceRequest(context.Background(), dbc.ResolveDeviceRequestParams{
+		UserCode: NormalizeUserCode(c.Param("code")),
+		Status:   status,
+		UserId:   uid,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired code.")
+	} else if err != nil {
+		return err
+	}
+	action := AuditDeviceApprove
+	if status == DeviceStatusDenied {
+		action = AuditDeviceDeny
+	}
+	h.audit(c, AuditEvent{
+		Action:  action,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"device": request.Device},
+	})
+	return c.JSON(http.StatusOK, MapDeviceRequest(&request))
+}
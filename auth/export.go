@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+type Export struct {
+	// When was this export created.
+	ExportDate time.Time `json:"exportDate"`
+	// The account, with its claims, roles and linked oidc providers (without their tokens).
+	User User `json:"user"`
+	// Profiles of the account.
+	Profiles []Profile `json:"profiles"`
+	// Active sessions, with their devices.
+	Sessions []Session `json:"sessions"`
+	// Audit log entries done by or affecting this account (newest first).
+	// The ip, user agent and id of other users acting on this account are removed.
+	AuditLogs []AuditLog `json:"auditLogs"`
+	// Two factor authentication status, the secret and recovery codes themselves are not exported.
+	Otp ExportOtp `json:"otp"`
+	// Api keys created by this account (without their tokens).
+	ApiKeys []ApiKey `json:"apiKeys"`
+}
+
+type ExportOtp struct {
+	// Is two factor authentication enabled?
+	Enabled bool `json:"enabled"`
+	// Number of recovery codes that were not used yet.
+	RecoveryCodes int64 `json:"recoveryCodes"`
+}
+
+func (h *Handler) exportUser(c echo.Context, id uuid.UUID) error {
+	ctx := context.Background()
+	user, err := h.getUser(ctx, id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No user found with given id")
+	} else if err != nil {
+		return err
+	}
+
+	profiles, err := h.db.ListProfiles(ctx, id)
+	if err != nil {
+		return err
+	}
+	sessions, err := h.db.GetUserSessions(ctx, id)
+	if err != nil {
+		return err
+	}
+	logs, err := h.db.ListUserAuditLogs(ctx, &id)
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := h.db.CountOtpRecoveryCodes(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	keys, err := h.db.ListUserApiKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	ret := Export{
+		ExportDate: time.Now().UTC(),
+		User:       user,
+		Profiles:   make([]Profile, 0, len(profiles)),
+		Sessions:   MapSessions(c, sessions),
+		AuditLogs:  make([]AuditLog, 0, len(logs)),
+		Otp: ExportOtp{
+			Enabled:       user.OtpEnabled,
+			RecoveryCodes: recoveryCodes,
+		},
+		ApiKeys: make([]ApiKey, 0, len(keys)),
+	}
+	for _, profile := range profiles {
+		ret.Profiles = append(ret.Profiles, MapProfile(&profile))
+	}
+	for _, log := range logs {
+		ret.AuditLogs = append(ret.AuditLogs, MapAuditLog(&log))
+	}
+	for _, key := range keys {
+		ret.ApiKeys = append(ret.ApiKeys, MapApiKey(&key))
+	}
+
+	h.audit(c, AuditEvent{
+		Action:  AuditUserExport,
+		Outcome: AuditSuccess,
+		Target:  &id,
+	})
+	c.Response().Header().Set(
+		echo.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="keibi-%s.json"`, user.Id),
+	)
+	return c.JSON(http.StatusOK, ret)
+}
+
+// @Summary      Export self
+// @Description  Download everything stored about your account: the account itself, its profiles, sessions, audit logs, 2fa status and api keys.
+// @Description  This can't be done while a profile is active.
+// @Tags         users
+// @Produce      json
+// @Security     Jwt
+// @Success      200  {object}  Export
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Router /users/me/export [get]
+func (h *Handler) ExportSelf(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	return h.exportUser(c, uid)
+}
+
+// @Summary      Export user
+// @Description  Download everything stored about an account: the account itself, its profiles, sessions, audit logs, 2fa status and api keys.
+// @Tags         users
+// @Produce      json
+// @Security     Jwt[users.export]
+// @Param        id   path      string  true  "Id of the user to export" Format(uuid)
+// @Success      200  {object}  Export
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "Missing users.export permission"
+// @Failure      404  {object}  problem.Problem "No user with the given id"
+// @Router /users/{id}/export [get]
+func (h *Handler) ExportUser(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.export"})
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	return h.exportUser(c, id)
+}
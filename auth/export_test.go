@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	s := NewTestServer(t, nil)
+	admin := s.Register("admin")
+	adminId := DecodeJwt(t, admin)["sub"].(string)
+	s.Request(http.MethodPost, "/apikeys", map[string]any{
+		"name":   "scanner",
+		"claims": map[string]any{"permissions": []string{"overall.write"}},
+	}).Expect(t, http.StatusCreated)
+
+	user := s.Register("user")
+	userId := DecodeJwt(t, user)["sub"].(string)
+	s.Auth = "Bearer " + admin
+	s.Request(http.MethodPatch, "/users/"+userId, map[string]any{
+		"roles": []string{"user", "admin"},
+	}).Expect(t, http.StatusOK)
+
+	var export Export
+	s.Auth = "Bearer " + user
+	s.Request(http.MethodGet, "/users/me/export", nil).Expect(t, http.StatusOK).Json(t, &export)
+	if export.Otp.Enabled || len(export.ApiKeys) != 0 {
+		t.Fatalf("invalid otp or api keys: %+v", export)
+	}
+	edited := false
+	for _, log := range export.AuditLogs {
+		if log.Action != AuditRolesEdit {
+			continue
+		}
+		edited = true
+		// only the user's own ip & user-agent are exported.
+		if log.ActorId != nil || log.Ip != nil || log.UserAgent != nil {
+			t.Fatalf("the admin's data should not be exported: %+v", log)
+		}
+	}
+	if !edited {
+		t.Fatal("the roles edit should be exported")
+	}
+
+	s.Auth = "Bearer " + admin
+	s.Request(http.MethodGet, "/users/me/export", nil).Expect(t, http.StatusOK).Json(t, &export)
+	if len(export.ApiKeys) != 1 || export.ApiKeys[0].Name != "scanner" {
+		t.Fatalf("the api keys created by the admin should be exported: %+v", export.ApiKeys)
+	}
+	for _, log := range export.AuditLogs {
+		if log.Action == AuditRolesEdit && (log.ActorId == nil || log.ActorId.String() != adminId || log.Ip == nil) {
+			t.Fatalf("the admin's own actions should be exported fully: %+v", log)
+		}
+	}
+}
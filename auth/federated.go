@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How long the list of providers of the federated instance is cached.
+const FederatedProvidersTtl = time.Hour
+
+type FederatedProfile struct {
+	// Id of the user on the provider.
+	Id string `json:"id"`
+	// Username of the user on the provider.
+	Username string `json:"username"`
+	// Email of the user on the provider. Empty if the provider did not give one.
+	Email string `json:"email" format:"email"`
+	// Link to the profile of the user on the provider. Null if unknown or irrelevant.
+	ProfileUrl *string `json:"profileUrl" format:"url"`
+}
+
+type FederatedProviders struct {
+	lock      sync.Mutex
+	url       string
+	providers []Provider
+	fetched   time.Time
+}
+
+func NewFederatedProviders(url string) *FederatedProviders {
+	return &FederatedProviders{url: url}
+}
+
+// List providers of the federated instance, fetching them only if the cache expired.
+func (f *FederatedProviders) List() ([]Provider, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.providers != nil && time.Since(f.fetched) < FederatedProvidersTtl {
+		return f.providers, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/providers", f.url), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	var ret []Provider
+	err = doJson(req, &ret)
+	if err != nil {
+		return nil, fmt.Errorf("could not list providers of the federated instance: %w", err)
+	}
+	f.providers = ret
+	f.fetched = time.Now()
+	return ret, nil
+}
+
+func (f *FederatedProviders) Has(provider string) (bool, error) {
+	providers, err := f.List()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(providers, func(p Provider) bool {
+		return p.Id == provider
+	}), nil
+}
+
+// Check if a provider not configured locally can be used via the federated instance.
+func (h *Handler) isFederated(c echo.Context) (bool, error) {
+	provider := c.Param("provider")
+	if _, ok := h.config.Oidc[provider]; ok || h.federated == nil {
+		return false, nil
+	}
+	ok, err := h.federated.Has(provider)
+	if err != nil {
+		c.Logger().Error(err)
+		return false, echo.NewHTTPError(http.StatusBadGateway, "Could not contact the federated instance.")
+	}
+	return ok, nil
+}
+
+func (h *Handler) federatedLogin(c echo.Context, redirectUrl string) error {
+	ret, err := url.Parse(fmt.Sprintf("%s/login/%s", h.federated.url, url.PathEscape(c.Param("provider"))))
+	if err != nil {
+		return err
+	}
+	// the federated instance only redirects to our origin, relative urls would be resolved against its own.
+	redirect, err := url.Parse(redirectUrl)
+	if err != nil {
+		return err
+	}
+	base, err := url.Parse(h.config.PublicUrl)
+	if err != nil {
+		return err
+	}
+	query := ret.Query()
+	query.Set("redirectUrl", base.ResolveReference(redirect).String())
+	query.Set("tenant", h.config.PublicUrl)
+	ret.RawQuery = query.Encode()
+	return c.Redirect(http.StatusFound, ret.String())
+}
+
+func (h *Handler) federatedCallback(c echo.Context, token string) error {
+	provider := c.Param("provider")
+	ret, err := url.Parse(fmt.Sprintf("%s/callback/%s", h.federated.url, url.PathEscape(provider)))
+	if err != nil {
+		return err
+	}
+	query := ret.Query()
+	query.Set("token", token)
+	query.Set("tenant", h.config.PublicUrl)
+	ret.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, ret.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	var profile FederatedProfile
+	err = doJson(req, &profile)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Federated instance refused the token. %s", err))
+	}
+	if profile.Id == "" || profile.Username == "" {
+		return echo.NewHTTPError(http.StatusBadGateway, "Federated instance returned an invalid profile.")
+	}
+
+	return h.loginOrLink(c, provider, &OidcProfile{
+		Sub:        profile.Id,
+		Username:   profile.Username,
+		Email:      profile.Email,
+		ProfileUrl: profile.ProfileUrl,
+	}, nil)
+}
+
+func (h *Handler) isTenantAllowed(tenant string) bool {
+	return slices.Contains(h.config.AllowedTenants, "*") || slices.Contains(h.config.AllowedTenants, tenant)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFederatedLogin(t *testing.T) {
+	provider := NewMockProvider(t, map[string]any{
+		"sub":                "mock-id",
+		"preferred_username": "mock-user",
+		"email":              "mock-user@zoriya.dev",
+	})
+	env := MockProviderEnv(provider)
+	env["KEIBI_ALLOWED_TENANTS"] = "*"
+	hosted := NewTestServer(t, env)
+	s := NewTestServer(t, map[string]string{"KEIBI_FEDERATED_URL": hosted.URL})
+
+	var providers []Provider
+	s.Request(http.MethodGet, "/providers", nil).Expect(t, http.StatusOK).Json(t, &providers)
+	if len(providers) != 1 || providers[0].Id != "mock" {
+		t.Fatalf("invalid providers: %v", providers)
+	}
+
+	resp := s.Request(http.MethodGet, "/login/mock?redirectUrl=/logged-in", nil).Expect(t, http.StatusFound)
+	login, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(login.String(), hosted.URL+"/login/mock?") ||
+		login.Query().Get("tenant") != s.URL ||
+		login.Query().Get("redirectUrl") != s.URL+"/logged-in" {
+		t.Fatalf("invalid federated login: %s", login)
+	}
+	token := OidcLoginToken(t, hosted, login.RawQuery)
+
+	// the token was given for our instance, it can't be used on the hosted one or for another tenant.
+	hosted.Request(http.MethodPost, "/callback/mock?token="+url.QueryEscape(token), nil).
+		Expect(t, http.StatusForbidden)
+	hosted.Request(http.MethodPost, "/callback/mock?tenant=http://evil.com&token="+url.QueryEscape(token), nil).
+		Expect(t, http.StatusForbidden)
+
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/callback/mock?token="+url.QueryEscape(token), nil).
+		Expect(t, http.StatusCreated).
+		Json(t, &session)
+	s.UseSession(session.Token)
+	var me User
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &me)
+	if me.Username != "mock-user" || me.Email != "mock-user@zoriya.dev" {
+		t.Fatalf("invalid user: %+v", me)
+	}
+
+	// the hosted instance does not store anything about the user.
+	if hosted.Register("hosted-admin") == "" {
+		t.Fatal("could not register on the hosted instance")
+	}
+	var users Page[User]
+	hosted.Request(http.MethodGet, "/users", nil).Expect(t, http.StatusOK).Json(t, &users)
+	if len(users.Items) != 1 {
+		t.Fatalf("the hosted instance created users: %+v", users.Items)
+	}
+}
+
+func TestFederatedTenant(t *testing.T) {
+	provider := NewMockProvider(t, map[string]any{"sub": "mock-id", "username": "mock-user"})
+	env := MockProviderEnv(provider)
+	env["KEIBI_ALLOWED_TENANTS"] = "https://kyoo.com"
+	hosted := NewTestServer(t, env)
+
+	for query, status := range map[string]int{
+		"tenant=https://other.com&redirectUrl=https://other.com/logged-in": http.StatusForbidden,
+		"tenant=kyoo.com&redirectUrl=https://kyoo.com/logged-in":           http.StatusBadRequest,
+		// a tenant can only receive tokens on its own origin.
+		"tenant=https://kyoo.com&redirectUrl=/logged-in":                     http.StatusBadRequest,
+		"tenant=https://kyoo.com&redirectUrl=" + url.QueryEscape(hosted.URL): http.StatusBadRequest,
+		"tenant=https://kyoo.com&redirectUrl=https://evil.com/logged-in":     http.StatusBadRequest,
+		"tenant=https://kyoo.com&redirectUrl=https://kyoo.com/logged-in":     http.StatusFound,
+	} {
+		hosted.Request(http.MethodGet, "/login/mock?"+query, nil).Expect(t, status)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Number of entries after which expired ones are removed from the forward auth cache.
+const ForwardAuthCacheSweep = 1024
+
+type cachedJwt struct {
+	token    string
+	expireAt time.Time
+}
+
+// Short lived cache of jwts created by the forward auth endpoint, indexed by the hash of the opaque token.
+type JwtCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedJwt
+}
+
+func NewJwtCache(ttl time.Duration) *JwtCache {
+	return &JwtCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedJwt),
+	}
+}
+
+func (j *JwtCache) Get(token string) (string, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	key := HashToken(token)
+	entry, ok := j.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expireAt) {
+		delete(j.entries, key)
+		return "", false
+	}
+	return entry.token, true
+}
+
+func (j *JwtCache) Set(token string, value string, jwtExpireAt time.Time) {
+	if j.ttl <= 0 {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if len(j.entries) >= ForwardAuthCacheSweep {
+		now := time.Now()
+		for key, entry := range j.entries {
+			if now.After(entry.expireAt) {
+				delete(j.entries, key)
+			}
+		}
+	}
+
+	expireAt := time.Now().Add(j.ttl)
+	// never return a jwt that's about to expire.
+	if limit := jwtExpireAt.Add(-time.Minute); limit.Before(expireAt) {
+		expireAt = limit
+	}
+	j.entries[HashToken(token)] = cachedJwt{token: value, expireAt: expireAt}
+}
+
+// @Summary      Forward auth
+// @Description  Endpoint for reverse proxies' forward auth (traefik's ForwardAuth, nginx's auth_request, caddy's forward_auth...).
+// @Description  Convert the session token or api key of the `Authorization` header to a jwt returned in the `Authorization` header of the response.
+// @Description  Requests already using a valid jwt are returned as is and requests without an `Authorization` header are refused.
+// @Tags         jwt
+// @Security     Token
+// @Param        audience  query  string  false  "Service behind the proxy (the `aud` claim of the jwt), must be one of `KEIBI_JWT_AUDIENCES`"
+// @Success      200  "The `Authorization` header contains the jwt to forward to the service"
+// @Failure      401  {object}  problem.Problem "Missing authorization header"
+// @Failure      403  {object}  problem.Problem "Invalid session token, api key or jwt (or expired)"
+// @Router /forward-auth [get]
+func (h *Handler) ForwardAuth(c echo.Context) error {
+	auth := c.Request().Header.Get("Authorization")
+	if auth == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Missing authorization header")
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid authorization header, expected a bearer token")
+	}
+	token := auth[len("Bearer "):]
+
+	if strings.Count(token, ".") == 2 {
+		tok, err := jwt.Parse(token, h.keys.Keyfunc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Invalid jwt: %s", err))
+		}
+		c.Set("user", tok)
+		if admin, _ := GetImpersonatorId(c); admin != nil {
+			// requests to other services made while impersonating a user are recorded too.
+			uid, _ := GetCurrentUserId(c)
+			req := c.Request().Header
+			h.audit(c, AuditEvent{
+				Action:  AuditImpersonationUse,
+				Outcome: AuditSuccess,
+				Target:  &uid,
+				Details: map[string]any{
+					"method": req.Get("X-Forwarded-Method"),
+					"host":   req.Get("X-Forwarded-Host"),
+					"path":   req.Get("X-Forwarded-Uri"),
+				},
+			})
+		}
+		c.Response().Header().Set("Authorization", auth)
+		return c.NoContent(http.StatusOK)
+	}
+
+	audience, err := h.getAudience(c)
+	if err != nil {
+		return err
+	}
+	// jwts of different audiences must not be mixed up in the cache.
+	key := audience + ":" + token
+	ret, ok := h.jwtCache.Get(key)
+	if !ok {
+		var exp time.Time
+		ret, exp, err = h.createJwt(context.Background(), token, audience)
+		if err != nil {
+			return err
+		}
+		h.jwtCache.Set(key, ret, exp)
+	}
+	c.Response().Header().Set("Authorization", fmt.Sprintf("Bearer %s", ret))
+	return c.NoContent(http.StatusOK)
+}
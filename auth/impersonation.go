@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+// Permissions removed from jwts of impersonated users, even if the user has them.
+var ImpersonationDeniedPermissions = []string{
+	"users.delete",
+	"users.password",
+	"users.claims",
+	"users.roles",
+	"users.impersonate",
+	"apikey.create",
+	"keys.rotate",
+}
+
+// Id of the admin impersonating the current user (from the rfc 8693 `act` claim), nil if the user is not impersonated.
+func GetImpersonatorId(c echo.Context) (*uuid.UUID, error) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return nil, echo.NewHTTPError(401, "Unauthorized")
+	}
+	act, ok := token.Claims.(jwt.MapClaims)["act"].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	sub, ok := act["sub"].(string)
+	if !ok {
+		return nil, echo.NewHTTPError(403, "Invalid act claim")
+	}
+	ret, err := uuid.Parse(sub)
+	if err != nil {
+		return nil, echo.NewHTTPError(403, "Invalid act claim")
+	}
+	return &ret, nil
+}
+
+// Add the `act` claim and remove permissions an admin should not use on behalf of a user.
+func restrictImpersonation(claims jwt.MapClaims, admin uuid.UUID) {
+	claims["act"] = map[string]any{"sub": admin.String()}
+	if perms, ok := claims["permissions"].([]string); ok {
+		claims["permissions"] = slices.DeleteFunc(slices.Clone(perms), func(perm string) bool {
+			return slices.Contains(ImpersonationDeniedPermissions, perm)
+		})
+	}
+}
+
+// Record every request made with an impersonation jwt.
+func (h *Handler) AuditImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, logged := c.Get("user").(*jwt.Token); !logged {
+			return next(c)
+		}
+		admin, _ := GetImpersonatorId(c)
+		if admin == nil {
+			return next(c)
+		}
+		uid, err := GetCurrentUserId(c)
+		if err != nil {
+			return err
+		}
+		err = next(c)
+		outcome := AuditSuccess
+		if err != nil || c.Response().Status >= 400 {
+			outcome = AuditFailure
+		}
+		h.audit(c, AuditEvent{
+			Action:  AuditImpersonationUse,
+			Outcome: outcome,
+			Target:  &uid,
+			Details: map[string]any{
+				"method": c.Request().Method,
+				"path":   c.Request().URL.Path,
+			},
+		})
+		return err
+	}
+}
+
+// @Summary      Impersonate user
+// @Description  Create a short lived jwt to act as another user (to see what they see).
+// @Description  The jwt has an `act` claim with the id of the admin (rfc 8693) and can't be refreshed.
+// @Description  It can't be used to delete or edit the account, change its password or use sensitive permissions.
+// @Description  Users with permissions you don't have can't be impersonated.
+// @Description  The impersonation appears in the user's sessions and every request made with it is recorded in the audit log.
+// @Tags         users
+// @Produce      json
+// @Security     Jwt[users.impersonate]
+// @Param        id   path      string  true  "Id of the user to impersonate" Format(uuid)
+// @Param        device  query   string  false  "Name displayed in the user's sessions"
+// @Param        audience  query  string  false  "Service that will consume the jwt (its `aud` claim)"
+// @Success      201  {object}  Jwt
+// @Failure      400  {object}  problem.Problem "Invalid id format, unknown audience or trying to impersonate yourself"
+// @Failure      403  {object}  problem.Problem "Missing users.impersonate permission, already impersonating a user or the user has permissions you don't have"
+// @Failure      404  {object}  problem.Problem "No user with the given id"
+// @Router /users/{id}/impersonate [post]
+func (h *Handler) Impersonate(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.impersonate"})
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	admin, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	if id == admin {
+		return echo.NewHTTPError(400, "You can't impersonate yourself")
+	}
+	// checked before creating the session so an invalid audience does not leave an unused impersonation.
+	audience, err := h.getAudience(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	user, err := h.getUser(ctx, id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No user found with given id")
+	} else if err != nil {
+		return err
+	}
+	// impersonating someone should not give more permissions than what the admin already has.
+	permissions, err := GetPermissions(c)
+	if err != nil {
+		return err
+	}
+	claims := maps.Clone(user.Claims)
+	if claims == nil {
+		claims = jwt.MapClaims{}
+	}
+	h.config.ExpandRoles(claims, user.Roles)
+	restrictImpersonation(claims, admin)
+	for _, perm := range claims["permissions"].([]string) {
+		if !slices.Contains(permissions, perm) {
+			return echo.NewHTTPError(403, "You can't impersonate a user with permissions you don't have")
+		}
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	expireAt := time.Now().UTC().Add(h.config.ImpersonationDuration)
+	// the session token is never returned, it's only used to create the jwt & list the impersonation in the user's sessions.
+	session, err := h.db.CreateImpersonationSession(ctx, dbc.CreateImpersonationSessionParams{
+		Token:          h.hashSessionToken(token),
+		UserPk:         user.Pk,
+		Device:         getDevice(c),
+		ImpersonatorId: &admin,
+		ExpireAt:       &expireAt,
+	})
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditImpersonate,
+		Outcome: AuditSuccess,
+		Target:  &user.Id,
+		Details: map[string]any{"session": session.Id, "expireDate": expireAt},
+	})
+	h.emitSessions(c, WebhookSessionCreated, user.Id, []dbc.Session{session})
+
+	ret, _, err := h.createJwt(ctx, token, audience)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, Jwt{Token: ret})
+}
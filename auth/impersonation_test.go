@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestImpersonatePermissions(t *testing.T) {
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_ROLE_SUPPORT": "users.impersonate,overall.read,overall.play",
+	})
+	admin := s.Register("admin")
+	adminId := DecodeJwt(t, admin)["sub"].(string)
+	userId := DecodeJwt(t, s.Register("user"))["sub"].(string)
+	supportId := DecodeJwt(t, s.Register("support"))["sub"].(string)
+
+	s.Auth = "Bearer " + admin
+	s.Request(http.MethodPatch, "/users/"+supportId, map[string]any{
+		"roles": []string{"support"},
+	}).Expect(t, http.StatusOK)
+
+	var ret Jwt
+	s.Request(http.MethodPost, "/users/"+supportId+"/impersonate", nil).
+		Expect(t, http.StatusCreated).
+		Json(t, &ret)
+	claims := DecodeJwt(t, ret.Token)
+	if claims["sub"] != supportId || claims["act"].(map[string]any)["sub"] != adminId {
+		t.Fatalf("invalid impersonation jwt: %v", claims)
+	}
+
+	s.Login("support")
+	s.Request(http.MethodPost, "/users/"+userId+"/impersonate", nil).Expect(t, http.StatusCreated)
+	// the admin has permissions support doesn't have.
+	s.Request(http.MethodPost, "/users/"+adminId+"/impersonate", nil).Expect(t, http.StatusForbidden)
+}
+
+func TestImpersonateInvalidAudience(t *testing.T) {
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_JWT_AUDIENCES": "kyoo",
+	})
+	s.Register("admin")
+	userId := DecodeJwt(t, s.Register("user"))["sub"].(string)
+	s.Login("admin")
+
+	var before, after []Session
+	s.Request(http.MethodGet, "/users/"+userId+"/sessions", nil).Expect(t, http.StatusOK).Json(t, &before)
+	s.Request(http.MethodPost, "/users/"+userId+"/impersonate?audience=unknown", nil).
+		Expect(t, http.StatusBadRequest)
+	// no impersonation session should be left behind.
+	s.Request(http.MethodGet, "/users/"+userId+"/sessions", nil).Expect(t, http.StatusOK).Json(t, &after)
+	if len(after) != len(before) {
+		t.Fatalf("an impersonation session was created: %v", after)
+	}
+}
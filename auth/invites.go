@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	// Anyone can create an account.
+	RegistrationOpen = "open"
+	// An invite code is required to create an account.
+	RegistrationInvite = "invite"
+	// Accounts created without an invite code need to be approved by an admin.
+	RegistrationApproval = "approval"
+	// Nobody can register (except the first user), invite codes are refused too.
+	RegistrationClosed = "closed"
+)
+
+type Invite struct {
+	// Id of the invite, can be used to revoke it.
+	Id uuid.UUID `json:"id"`
+	// Code to give in the `invite` field of the register request.
+	Code string `json:"code" example:"KDBW2LMNR3XYAZFT4Q7E6PHJCVGSU5OI"`
+	// Claims users registering with this invite will have.
+	Claims jwt.MapClaims `json:"claims"`
+	// Roles users registering with this invite will have.
+	Roles []string `json:"roles" example:"user"`
+	// How many accounts can be created with this invite.
+	MaxUses int32 `json:"maxUses" example:"1"`
+	// How many accounts were already created with this invite.
+	Uses int32 `json:"uses" example:"0"`
+	// When was this invite created?
+	CreatedDate time.Time `json:"createdDate"`
+	// Date after which this invite can't be used, null if it never expires.
+	ExpireDate *time.Time `json:"expireDate"`
+}
+
+type InviteDto struct {
+	// Claims users registering with this invite will have, defaults to the instance's default claims.
+	// Requires the `users.claims` permission.
+	Claims jwt.MapClaims `json:"claims,omitempty"`
+	// Roles users registering with this invite will have, defaults to the instance's default roles.
+	// Requires the `users.roles` permission.
+	Roles []string `json:"roles,omitempty" example:"user"`
+	// How many accounts can be created with this invite.
+	MaxUses int32 `json:"maxUses" validate:"omitempty,min=1" example:"1"`
+	// Date after which this invite can't be used, omit for an invite that never expires.
+	ExpireDate *time.Time `json:"expireDate,omitempty"`
+}
+
+func MapInvite(invite *dbc.Invite) Invite {
+	return Invite{
+		Id:          invite.Id,
+		Code:        invite.Code,
+		Claims:      invite.Claims,
+		Roles:       invite.Roles,
+		MaxUses:     invite.MaxUses,
+		Uses:        invite.Uses,
+		CreatedDate: invite.CreatedDate,
+		ExpireDate:  invite.ExpireDate,
+	}
+}
+
+// How a new account should be created.
+type Registration struct {
+	Claims  jwt.MapClaims
+	Roles   []string
+	Pending bool
+	// Invite used to register, nil if none was used.
+	Invite *dbc.Invite
+	// Allowed without an invite because the instance has no users, only valid if the account is the first user.
+	FirstUser bool
+}
+
+// Check if an account can be created with the configured registration mode and the given invite code.
+func (h *Handler) checkRegistration(ctx context.Context, code *string) (Registration, error) {
+	ret := Registration{
+		Claims: h.config.DefaultClaims,
+		Roles:  h.config.DefaultRoles,
+	}
+
+	if h.config.RegistrationMode == RegistrationOpen {
+		if code == nil || *code == "" {
+			return ret, nil
+		}
+	} else {
+		// the first user (the admin) must always be able to register.
+		exists, err := h.db.HasUsers(ctx)
+		if err != nil {
+			return ret, err
+		}
+		if !exists {
+			ret.FirstUser = true
+			return ret, nil
+		}
+	}
+	if h.config.RegistrationMode == RegistrationClosed {
+		return ret, echo.NewHTTPError(http.StatusForbidden, "Registrations are closed")
+	}
+
+	if code != nil && *code != "" {
+		invite, err := h.db.UseInvite(ctx, *code)
+		if err == pgx.ErrNoRows {
+			return ret, echo.NewHTTPError(http.StatusForbidden, "Invalid, expired or already used invite code")
+		} else if err != nil {
+			return ret, err
+		}
+		ret.Invite = &invite
+		if len(invite.Claims) > 0 {
+			ret.Claims = invite.Claims
+		}
+		if len(invite.Roles) > 0 {
+			ret.Roles = invite.Roles
+		}
+		return ret, nil
+	}
+
+	switch h.config.RegistrationMode {
+	case RegistrationInvite:
+		return ret, echo.NewHTTPError(http.StatusForbidden, "An invite code is required to register")
+	case RegistrationApproval:
+		ret.Pending = true
+	}
+	return ret, nil
+}
+
+// Create an account if the registration mode allows it, the claims, roles and pending state of `params` are set here.
+func (h *Handler) register(ctx context.Context, code *string, params dbc.CreateUserParams) (dbc.User, *Registration, error) {
+	reg, err := h.checkRegistration(ctx, code)
+	if err != nil {
+		return dbc.User{}, nil, err
+	}
+	params.Claims = reg.Claims
+	params.Roles = reg.Roles
+	params.Pending = reg.Pending
+	params.FirstUserRoles = h.config.FirstUserRoles
+	params.OnlyFirst = reg.FirstUser
+	user, err := CreateUser(ctx, h.db, params)
+	if err == pgx.ErrNoRows && reg.FirstUser {
+		// another account was created first, the registration mode applies now.
+		return h.register(ctx, code, params)
+	} else if err != nil {
+		h.releaseRegistration(ctx, &reg)
+	}
+	return user, &reg, err
+}
+
+// Give back the use of an invite if the account could not be created.
+func (h *Handler) releaseRegistration(ctx context.Context, reg *Registration) {
+	if reg.Invite != nil {
+		_ = h.db.ReleaseInvite(ctx, reg.Invite.Pk)
+	}
+}
+
+// @Summary      List invites
+// @Description  List all invite codes of this instance.
+// @Tags         invites
+// @Produce      json
+// @Security     Jwt[invites.read]
+// @Success      200  {object}  []Invite
+// @Failure      403  {object}  problem.Problem "Missing invites.read permission"
+// @Router /invites [get]
+func (h *Handler) ListInvites(c echo.Context) error {
+	err := CheckPermissions(c, []string{"invites.read"})
+	if err != nil {
+		return err
+	}
+
+	invites, err := h.db.ListInvites(context.Background())
+	if err != nil {
+		return err
+	}
+
+	ret := make([]Invite, 0, len(invites))
+	for _, invite := range invites {
+		ret = append(ret, MapInvite(&invite))
+	}
+	return c.JSON(200, ret)
+}
+
+// @Summary      Create invite
+// @Description  Create an invite code that can be used to register when registrations require an invite or an approval.
+// @Tags         invites
+// @Accept       json
+// @Produce      json
+// @Security     Jwt[invites.create]
+// @Param        invite  body  InviteDto  false  "Invite informations"
+// @Success      201  {object}  Invite
+// @Failure      400  {object}  problem.Problem "Invalid create body"
+// @Failure      403  {object}  problem.Problem "Missing invites.create permission (or users.claims/users.roles to set claims/roles)"
+// @Failure      422  {object}  problem.Problem "Unknown role"
+// @Router /invites [post]
+func (h *Handler) CreateInvite(c echo.Context) error {
+	err := CheckPermissions(c, []string{"invites.create"})
+	if err != nil {
+		return err
+	}
+
+	var req InviteDto
+	err = c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+	// an invite can't be used to give more permissions than the creator could give by editing a user.
+	if len(req.Claims) > 0 {
+		err = CheckPermissions(c, []string{"users.claims"})
+		if err != nil {
+			return err
+		}
+	}
+	if len(req.Roles) > 0 {
+		err = CheckPermissions(c, []string{"users.roles"})
+		if err != nil {
+			return err
+		}
+	}
+	if err = h.config.ValidateRoles(req.Roles); err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.Claims == nil {
+		req.Claims = make(jwt.MapClaims)
+	}
+	if req.Roles == nil {
+		req.Roles = make([]string, 0)
+	}
+
+	code, err := GenerateCode()
+	if err != nil {
+		return err
+	}
+
+	var creator *uuid.UUID
+	if uid, err := GetCurrentUserId(c); err == nil {
+		creator = &uid
+	}
+
+	invite, err := h.db.CreateInvite(context.Background(), dbc.CreateInviteParams{
+		Code:       code,
+		Claims:     req.Claims,
+		Roles:      req.Roles,
+		MaxUses:    req.MaxUses,
+		ExpireDate: req.ExpireDate,
+		UserId:     creator,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, MapInvite(&invite))
+}
+
+// @Summary      Delete invite
+// @Description  Revoke an invite code. Accounts already created with it are not affected.
+// @Tags         invites
+// @Produce      json
+// @Security     Jwt[invites.create]
+// @Param        id   path      string  true  "Id of the invite to delete" Format(uuid)
+// @Success      200  {object}  Invite
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "Missing invites.create permission"
+// @Failure      404  {object}  problem.Problem "No invite with the given id"
+// @Router /invites/{id} [delete]
+func (h *Handler) DeleteInvite(c echo.Context) error {
+	err := CheckPermissions(c, []string{"invites.create"})
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	invite, err := h.db.DeleteInvite(context.Background(), id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No invite found with given id")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(200, MapInvite(&invite))
+}
+
+// @Summary      Approve user
+// @Description  Approve an account created while registrations required an approval. It can then create jwts.
+// @Description  Use DELETE /users/{id} to refuse it.
+// @Tags         users
+// @Produce      json
+// @Security     Jwt[users.write]
+// @Param        id   path      string  true  "Id of the user to approve" Format(uuid)
+// @Success      200  {object}  User
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "Missing users.write permission"
+// @Failure      404  {object}  problem.Problem "No user with the given id"
+// @Router /users/{id}/approve [post]
+func (h *Handler) ApproveUser(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.write"})
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	user, err := h.db.ApproveUser(context.Background(), id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No user found with given id")
+	} else if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditUserApprove,
+		Outcome: AuditSuccess,
+		Target:  &user.Id,
+	})
+	ret := MapDbUser(&user)
+	h.emit(c, WebhookUserUpdated, ret)
+	return c.JSON(200, ret)
+}
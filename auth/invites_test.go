@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateInvitePermissions(t *testing.T) {
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_REGISTRATION": "invite",
+		"KEIBI_ROLE_INVITER": "invites.create",
+	})
+	admin := s.Register("admin")
+
+	var invite Invite
+	s.Request(http.MethodPost, "/invites", map[string]any{}).Expect(t, http.StatusCreated).Json(t, &invite)
+	s.Auth = ""
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/users", map[string]string{
+		"username": "inviter",
+		"password": "password-inviter",
+		"email":    "inviter@zoriya.dev",
+		"invite":   invite.Code,
+	}).Expect(t, http.StatusCreated).Json(t, &session)
+	inviter := DecodeJwt(t, s.UseSession(session.Token))["sub"].(string)
+	s.Auth = "Bearer " + admin
+	s.Request(http.MethodPatch, "/users/"+inviter, map[string]any{
+		"roles": []string{"inviter"},
+	}).Expect(t, http.StatusOK)
+
+	s.Login("inviter")
+	// an invite can't give more than what its creator could give by editing a user.
+	s.Request(http.MethodPost, "/invites", map[string]any{
+		"roles": []string{"admin"},
+	}).Expect(t, http.StatusForbidden)
+	s.Request(http.MethodPost, "/invites", map[string]any{
+		"claims": map[string]any{"permissions": []string{"users.write"}},
+	}).Expect(t, http.StatusForbidden)
+	s.Request(http.MethodPost, "/invites", map[string]any{"maxUses": 2}).Expect(t, http.StatusCreated)
+
+	s.Auth = "Bearer " + admin
+	s.Request(http.MethodPost, "/invites", map[string]any{
+		"roles":  []string{"admin"},
+		"claims": map[string]any{"permissions": []string{"users.write"}},
+	}).Expect(t, http.StatusCreated)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Delete expired sessions, codes and requests.
+func (h *Handler) Cleanup(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	sessions, err := h.db.CleanupSessions(ctx, now.Add(-h.config.ExpirationDelay))
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		err = h.webhooks.Emit(ctx, WebhookSessionDeleted, WebhookSession{
+			Session: Session{
+				Id:             session.Id,
+				CreatedDate:    session.CreatedDate,
+				LastUsed:       session.LastUsed,
+				Device:         session.Device,
+				ImpersonatorId: session.ImpersonatorId,
+				ExpireDate:     session.ExpireAt,
+			},
+			UserId: session.UserId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = h.db.CleanupOidcRequests(ctx, now.Add(-OidcRequestTimeout))
+	if err != nil {
+		return err
+	}
+	err = h.db.CleanupOtpChallenges(ctx, now.Add(-OtpChallengeTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = h.db.CleanupVerificationCodes(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = h.db.CleanupDeviceRequests(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = h.db.CleanupQuickConnects(ctx, now)
+	if err != nil {
+		return err
+	}
+	_, err = h.CleanupAuditLogs(ctx)
+	return err
+}
+
+// Run cleanups every `JanitorInterval` until the context is canceled.
+func (h *Handler) RunJanitor(ctx context.Context, logger echo.Logger) {
+	ticker := time.NewTicker(h.config.JanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		err := h.Cleanup(ctx)
+		if err != nil {
+			logger.Error("Janitor could not cleanup expired data: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
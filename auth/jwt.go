@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
-	"crypto/x509"
-	"encoding/pem"
 	"maps"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
 )
 
+// User fields that can be copied in jwt claims via `KEIBI_JWT_CLAIMS`.
+var JwtClaimFields = map[string]func(user *dbc.User) any{
+	"id":            func(user *dbc.User) any { return user.Id.String() },
+	"username":      func(user *dbc.User) any { return user.Username },
+	"email":         func(user *dbc.User) any { return user.Email },
+	"emailVerified": func(user *dbc.User) any { return user.EmailVerified },
+	"createdDate":   func(user *dbc.User) any { return jwt.NewNumericDate(user.CreatedDate) },
+}
+
 type Jwt struct {
 	// The jwt token you can use for all authorized call to either keibi or other services.
 	Token string `json:"token"`
@@ -20,17 +30,24 @@ type Jwt struct {
 
 type Info struct {
 	// The public key used to sign jwt tokens. It can be used by your services to check if the jwt is valid.
+	// Prefer using /.well-known/jwks.json which also contains previous keys after a rotation.
 	PublicKey string `json:"publicKey"`
+	// Id of the current key, jwts signed with it have this value in their `kid` header.
+	KeyId string `json:"keyId"`
+	// Algorithm used to sign jwts.
+	Algorithm string `json:"algorithm" example:"RS256"`
 }
 
 // @Summary      Get JWT
-// @Description  Convert a session token to a short lived JWT.
+// @Description  Convert a session token or an api key to a short lived JWT.
 // @Tags         jwt
 // @Produce      json
 // @Security     Token
+// @Param        audience  query  string  false  "Service that will consume the jwt (its `aud` claim), must be one of `KEIBI_JWT_AUDIENCES`"
 // @Success      200  {object}  Jwt
+// @Failure      400  {object}  problem.Problem "Unknown audience"
 // @Failure      401  {object}  problem.Problem "Missing session token"
-// @Failure      403  {object}  problem.Problem "Invalid session token (or expired)"
+// @Failure      403  {object}  problem.Problem "Invalid session token (or expired), or account waiting for an approval"
 // @Router /jwt [get]
 func (h *Handler) CreateJwt(c echo.Context) error {
 	auth := c.Request().Header.Get("Authorization")
@@ -38,38 +55,120 @@ func (h *Handler) CreateJwt(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "Missing session token")
 	}
 	token := auth[len("Bearer "):]
+	audience, err := h.getAudience(c)
+	if err != nil {
+		return err
+	}
 
-	session, err := h.db.GetUserFromToken(context.Background(), token)
+	t, _, err := h.createJwt(context.Background(), token, audience)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusForbidden, "Invalid token")
+		return err
+	}
+	return c.JSON(http.StatusOK, Jwt{
+		Token: t,
+	})
+}
+
+// Read the `audience` query param, defaults to the first configured audience (or none).
+func (h *Handler) getAudience(c echo.Context) (string, error) {
+	audience := c.QueryParam("audience")
+	if audience == "" {
+		if len(h.config.JwtAudiences) == 0 {
+			return "", nil
+		}
+		return h.config.JwtAudiences[0], nil
+	}
+	if !slices.Contains(h.config.JwtAudiences, audience) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Unknown audience, it must be listed in KEIBI_JWT_AUDIENCES")
+	}
+	return audience, nil
+}
+
+// Set registered claims and sign the jwt.
+func (h *Handler) signJwt(claims jwt.MapClaims, exp time.Time, audience string) (string, error) {
+	now := time.Now().UTC()
+	claims["iss"] = h.config.Issuer
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["nbf"] = jwt.NewNumericDate(now)
+	claims["exp"] = jwt.NewNumericDate(exp)
+	if audience != "" {
+		claims["aud"] = audience
+	} else {
+		delete(claims, "aud")
+	}
+	return h.keys.Sign(claims)
+}
+
+// Create a jwt from a session token or an api key, returning the jwt and its expiration date.
+func (h *Handler) createJwt(ctx context.Context, token string, audience string) (string, time.Time, error) {
+	session, err := h.db.GetUserFromToken(ctx, h.hashSessionToken(token))
+	if err == pgx.ErrNoRows {
+		return h.createApiJwt(ctx, token, audience)
+	} else if err != nil {
+		return "", time.Time{}, err
 	}
 	if session.LastUsed.Add(h.config.ExpirationDelay).Compare(time.Now().UTC()) < 0 {
-		return echo.NewHTTPError(http.StatusForbidden, "Token has expired")
+		return "", time.Time{}, echo.NewHTTPError(http.StatusForbidden, "Token has expired")
+	}
+	if session.ExpireAt != nil && session.ExpireAt.Before(time.Now().UTC()) {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusForbidden, "Token has expired")
+	}
+	if session.User.Pending {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusForbidden, "Account waiting for an admin approval")
 	}
 
 	go func() {
 		h.db.TouchSession(context.Background(), session.Id)
-		h.db.TouchUser(context.Background(), session.User.Id)
+		// an admin impersonating a user should not count as activity of the user.
+		if session.ImpersonatorId == nil {
+			h.db.TouchUser(context.Background(), session.User.Id)
+		}
 	}()
 
+	exp := time.Now().UTC().Add(h.config.JwtExpiration)
+	if session.ExpireAt != nil && session.ExpireAt.Before(exp) {
+		exp = *session.ExpireAt
+	}
 	claims := maps.Clone(session.User.Claims)
-	claims["sub"] = session.User.Id.String()
-	claims["sid"] = session.Id.String()
-	claims["iss"] = h.config.Issuer
-	claims["exp"] = &jwt.NumericDate{
-		Time: time.Now().UTC().Add(time.Hour),
+	if session.ProfileId != nil {
+		// profiles can only add claims, the user's claims may have been set after the profile was created.
+		for key, value := range session.ProfileClaims {
+			if _, ok := claims[key]; !ok {
+				claims[key] = value
+			}
+		}
+		claims["profile"] = session.ProfileId.String()
 	}
-	claims["iss"] = &jwt.NumericDate{
-		Time: time.Now().UTC(),
+	// reserved claims are refused when editing profiles, they are set bellow anyway.
+	for claim, field := range h.config.JwtClaims {
+		claims[claim] = JwtClaimFields[field](&session.User)
 	}
-	jwt := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	t, err := jwt.SignedString(h.config.JwtPrivateKey)
-	if err != nil {
-		return err
+	h.config.ExpandRoles(claims, session.User.Roles)
+	if session.ImpersonatorId != nil {
+		restrictImpersonation(claims, *session.ImpersonatorId)
 	}
-	return c.JSON(http.StatusOK, Jwt{
-		Token: t,
-	})
+	claims["sub"] = session.User.Id.String()
+	claims["sid"] = session.Id.String()
+	t, err := h.signJwt(claims, exp, audience)
+	return t, exp, err
+}
+
+func (h *Handler) createApiJwt(ctx context.Context, apikey string, audience string) (string, time.Time, error) {
+	key, err := h.db.GetApiKey(ctx, HashToken(apikey))
+	if err == pgx.ErrNoRows {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusForbidden, "Invalid token")
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+
+	go func() {
+		h.db.TouchApiKey(context.Background(), key.Pk)
+	}()
+
+	exp := time.Now().UTC().Add(h.config.JwtExpiration)
+	claims := maps.Clone(key.Claims)
+	t, err := h.signJwt(claims, exp, audience)
+	return t, exp, err
 }
 
 // @Summary      Info
@@ -79,14 +178,15 @@ func (h *Handler) CreateJwt(c echo.Context) error {
 // @Success      200  {object}  Info
 // @Router /info [get]
 func (h *Handler) GetInfo(c echo.Context) error {
-	key := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: x509.MarshalPKCS1PublicKey(h.config.JwtPublicKey),
-		},
-	)
+	current := h.keys.Current()
+	key, err := EncodePublicKey(current.PrivateKey.Public())
+	if err != nil {
+		return err
+	}
 
 	return c.JSON(200, Info{
-		PublicKey: string(key),
+		PublicKey: key,
+		KeyId:     current.Id,
+		Algorithm: current.Method.Alg(),
 	})
 }
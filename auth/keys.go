@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	// Config key of the key currently used to sign jwts.
+	JwtPrivateKey = "jwt_private_key"
+	// Prefix of config keys storing previous signing keys, followed by their kid.
+	JwtRetiredKeyPrefix = "jwt_retired_key:"
+	// Config key of the secret used to hash session tokens (unless KEIBI_TOKEN_SECRET is set).
+	SessionTokenSecret = "session_token_secret"
+	// How often keys are reloaded from the database to pick up rotations made by other instances.
+	KeysRefreshInterval = time.Minute
+)
+
+// Algorithms that can be used to sign jwts (via `KEIBI_JWT_ALGORITHM`).
+var JwtAlgorithms = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+type SigningKey struct {
+	Id         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+}
+
+type VerificationKey struct {
+	Id        string
+	Method    jwt.SigningMethod
+	PublicKey crypto.PublicKey
+	// Date after which jwts signed with this key are rejected. Nil for the current key.
+	ExpireDate *time.Time
+}
+
+func (k *SigningKey) Verification() VerificationKey {
+	return VerificationKey{
+		Id:        k.Id,
+		Method:    k.Method,
+		PublicKey: k.PrivateKey.Public(),
+	}
+}
+
+// Format of retired keys stored in the config table.
+type RetiredKey struct {
+	PublicKey   string    `json:"publicKey"`
+	RetiredDate time.Time `json:"retiredDate"`
+	ExpireDate  time.Time `json:"expireDate"`
+}
+
+type Jwk struct {
+	// Key type: RSA, EC or OKP (for EdDSA).
+	Kty string `json:"kty" example:"RSA"`
+	// Usage of the key, always sig.
+	Use string `json:"use" example:"sig"`
+	// Algorithm used to sign jwts with this key.
+	Alg string `json:"alg" example:"RS256"`
+	// Id of the key, matches the `kid` header of jwts.
+	Kid string `json:"kid"`
+	// Modulus of the rsa key (base64url encoded).
+	N string `json:"n,omitempty"`
+	// Exponent of the rsa key (base64url encoded).
+	E string `json:"e,omitempty" example:"AQAB"`
+	// Curve of EC and OKP keys.
+	Crv string `json:"crv,omitempty" example:"P-256"`
+	// X coordinate of EC keys or public key of OKP keys (base64url encoded).
+	X string `json:"x,omitempty"`
+	// Y coordinate of EC keys (base64url encoded).
+	Y string `json:"y,omitempty"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type KeyStore struct {
+	lock sync.RWMutex
+	db   *dbc.Queries
+	// Algorithm used for new keys.
+	alg     string
+	current SigningKey
+	keys    []VerificationKey
+	loaded  time.Time
+}
+
+func b64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Public parameters of a key in the jwk format, without the kid, use & alg.
+func publicJwk(key crypto.PublicKey) Jwk {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return Jwk{
+			Kty: "RSA",
+			N:   b64url(k.N.Bytes()),
+			E:   b64url(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return Jwk{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   b64url(k.X.FillBytes(make([]byte, size))),
+			Y:   b64url(k.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		return Jwk{Kty: "OKP", Crv: "Ed25519", X: b64url(k)}
+	}
+	return Jwk{}
+}
+
+// Compute the kid of a key using its jwk thumbprint (rfc7638).
+func KeyId(key crypto.PublicKey) string {
+	jwk := publicJwk(key)
+	var thumbprint string
+	// required members only, in lexicographic order.
+	switch jwk.Kty {
+	case "RSA":
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Crv, jwk.X)
+	}
+	sum := sha256.Sum256([]byte(thumbprint))
+	return b64url(sum[:])
+}
+
+// Algorithm used to sign jwts with the given key.
+func KeyMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ecdsa curve: %s", k.Curve.Params().Name)
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", key)
+}
+
+// Rsa keys use the pkcs1 format (for compatibility with keys created by previous versions), others use pkix.
+func EncodePublicKey(key crypto.PublicKey) (string, error) {
+	if k, ok := key.(*rsa.PublicKey); ok {
+		return string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PUBLIC KEY",
+			Bytes: x509.MarshalPKCS1PublicKey(k),
+		})), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+func parsePublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid pem")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func parsePrivateKey(data string) (*SigningKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid pem")
+	}
+	var key crypto.Signer
+	if block.Type == "RSA PRIVATE KEY" {
+		rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = rsaKey
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", parsed)
+		}
+		key = signer
+	}
+	method, err := KeyMethod(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Id: KeyId(key.Public()), Method: method, PrivateKey: key}, nil
+}
+
+// Load the signing keys, `alg` is only used for keys created after this call.
+func LoadKeys(ctx context.Context, db *dbc.Queries, alg string) (*KeyStore, error) {
+	ret := &KeyStore{db: db, alg: alg}
+	err := ret.reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Rotate the current key (with the given grace period) if it does not use the configured algorithm.
+// Only the server does this on startup, admin commands should not rotate keys as a side effect.
+func (s *KeyStore) EnsureAlgorithm(ctx context.Context, grace time.Duration) error {
+	if s.Current().Method.Alg() == s.alg {
+		return nil
+	}
+	_, err := s.Rotate(ctx, grace)
+	return err
+}
+
+func (s *KeyStore) reload(ctx context.Context) error {
+	confs, err := s.db.LoadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	var current *SigningKey
+	keys := make([]VerificationKey, 0)
+	for _, conf := range confs {
+		switch {
+		case conf.Key == JwtPrivateKey:
+			current, err = parsePrivateKey(conf.Value)
+			if err != nil {
+				return fmt.Errorf("invalid jwt private key in database: %w", err)
+			}
+		case strings.HasPrefix(conf.Key, JwtRetiredKeyPrefix):
+			var retired RetiredKey
+			err := json.Unmarshal([]byte(conf.Value), &retired)
+			if err != nil {
+				return fmt.Errorf("invalid retired key %s: %w", conf.Key, err)
+			}
+			// expired keys are kept in the database for history but never trusted again.
+			if retired.ExpireDate.Before(time.Now().UTC()) {
+				continue
+			}
+			key, err := parsePublicKey(retired.PublicKey)
+			if err != nil {
+				return fmt.Errorf("invalid retired key %s: %w", conf.Key, err)
+			}
+			method, err := KeyMethod(key)
+			if err != nil {
+				return fmt.Errorf("invalid retired key %s: %w", conf.Key, err)
+			}
+			keys = append(keys, VerificationKey{
+				Id:         strings.TrimPrefix(conf.Key, JwtRetiredKeyPrefix),
+				Method:     method,
+				PublicKey:  key,
+				ExpireDate: &retired.ExpireDate,
+			})
+		}
+	}
+
+	if current == nil {
+		current, err = s.generate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	keys = append([]VerificationKey{current.Verification()}, keys...)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.current = *current
+	s.keys = keys
+	s.loaded = time.Now()
+	return nil
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case jwt.SigningMethodES256.Alg():
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+}
+
+func (s *KeyStore) generate(ctx context.Context) (*SigningKey, error) {
+	key, err := generateKey(s.alg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pemd := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	_, err = s.db.SaveConfig(ctx, dbc.SaveConfigParams{
+		Key:   JwtPrivateKey,
+		Value: string(pemd),
+	})
+	if err != nil {
+		return nil, err
+	}
+	method, err := KeyMethod(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Id: KeyId(key.Public()), Method: method, PrivateKey: key}, nil
+}
+
+// Reload keys if they were loaded more than `maxAge` ago. Errors are ignored, the previous keys are kept.
+func (s *KeyStore) refresh(maxAge time.Duration) {
+	s.lock.RLock()
+	stale := time.Since(s.loaded) > maxAge
+	s.lock.RUnlock()
+	if stale {
+		_ = s.reload(context.Background())
+	}
+}
+
+func (s *KeyStore) Current() SigningKey {
+	s.refresh(KeysRefreshInterval)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.current
+}
+
+func (s *KeyStore) List() []VerificationKey {
+	s.refresh(KeysRefreshInterval)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys
+}
+
+func (s *KeyStore) find(kid string) *VerificationKey {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	idx := slices.IndexFunc(s.keys, func(k VerificationKey) bool { return k.Id == kid })
+	if idx == -1 {
+		return nil
+	}
+	return &s.keys[idx]
+}
+
+func (s *KeyStore) Sign(claims jwt.Claims) (string, error) {
+	key := s.Current()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.PrivateKey)
+}
+
+// Keyfunc to validate jwts signed by any non-expired key.
+func (s *KeyStore) Keyfunc(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		// jwts created before key rotation was supported don't have a kid.
+		current := s.Current()
+		if token.Method.Alg() != current.Method.Alg() {
+			return nil, fmt.Errorf("unexpected jwt signing method: %s", token.Method.Alg())
+		}
+		return current.PrivateKey.Public(), nil
+	}
+
+	key := s.find(kid)
+	if key == nil {
+		// the key might have been rotated by another instance.
+		s.refresh(10 * time.Second)
+		key = s.find(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown jwt key: %s", kid)
+	}
+	// never trust the alg header, it must match the key.
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected jwt signing method: %s", token.Method.Alg())
+	}
+	if key.ExpireDate != nil && key.ExpireDate.Before(time.Now().UTC()) {
+		return nil, fmt.Errorf("jwt key %s has expired", kid)
+	}
+	return key.PublicKey, nil
+}
+
+// Create a new signing key. The previous one stays valid to verify jwts for `grace`.
+func (s *KeyStore) Rotate(ctx context.Context, grace time.Duration) (*SigningKey, error) {
+	err := s.reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prev := s.Current()
+
+	public, err := EncodePublicKey(prev.PrivateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	retired, err := json.Marshal(RetiredKey{
+		PublicKey:   public,
+		RetiredDate: now,
+		ExpireDate:  now.Add(grace),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.SaveConfig(ctx, dbc.SaveConfigParams{
+		Key:   JwtRetiredKeyPrefix + prev.Id,
+		Value: string(retired),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.generate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = s.reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := s.Current()
+	return &ret, nil
+}
+
+// Load the secret used to hash session tokens, generating one if none exists.
+func LoadTokenSecret(ctx context.Context, db *dbc.Queries) ([]byte, error) {
+	if secret := os.Getenv("KEIBI_TOKEN_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	fmt.Println(
+		"WARNING: KEIBI_TOKEN_SECRET is not set, session tokens are hashed with a secret stored in the database." +
+			" Anyone with a copy of the database can use the sessions it contains, set KEIBI_TOKEN_SECRET to prevent this.",
+	)
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	// another instance might be starting at the same time, only the first secret is kept.
+	err = db.CreateConfig(ctx, dbc.CreateConfigParams{
+		Key:   SessionTokenSecret,
+		Value: base64.StdEncoding.EncodeToString(secret),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	confs, err := db.LoadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, conf := range confs {
+		if conf.Key == SessionTokenSecret {
+			return base64.StdEncoding.DecodeString(conf.Value)
+		}
+	}
+	return nil, errors.New("could not load the session token secret")
+}
+
+func MapJwk(key *VerificationKey) Jwk {
+	ret := publicJwk(key.PublicKey)
+	ret.Use = "sig"
+	ret.Alg = key.Method.Alg()
+	ret.Kid = key.Id
+	return ret
+}
+
+// @Summary      Jwks
+// @Description  List public keys that can be used to validate jwts (current and previous ones still in their grace period).
+// @Tags         jwt
+// @Produce      json
+// @Success      200  {object}  Jwks
+// @Router /.well-known/jwks.json [get]
+func (h *Handler) GetJwks(c echo.Context) error {
+	keys := h.keys.List()
+	ret := Jwks{Keys: make([]Jwk, 0, len(keys))}
+	for _, key := range keys {
+		ret.Keys = append(ret.Keys, MapJwk(&key))
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, ret)
+}
+
+// @Summary      Rotate keys
+// @Description  Create a new key to sign jwts. The previous key can still be used to validate jwts until the grace period expires.
+// @Tags         jwt
+// @Produce      json
+// @Security     Jwt[keys.rotate]
+// @Success      200  {object}  Jwk "The new signing key"
+// @Failure      403  {object}  problem.Problem "Missing keys.rotate permission"
+// @Router /jwt/rotate [post]
+func (h *Handler) RotateKeys(c echo.Context) error {
+	err := CheckPermissions(c, []string{"keys.rotate"})
+	if err != nil {
+		return err
+	}
+
+	prev := h.keys.Current()
+	key, err := h.keys.Rotate(context.Background(), h.config.KeyRotationGrace)
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditKeysRotate,
+		Outcome: AuditSuccess,
+		Details: map[string]any{"previous": prev.Id, "current": key.Id},
+	})
+	ret := key.Verification()
+	return c.JSON(http.StatusOK, MapJwk(&ret))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenSecretConcurrentGeneration(t *testing.T) {
+	s := NewTestServer(t, map[string]string{"KEIBI_TOKEN_SECRET": ""})
+	ctx := context.Background()
+	_, err := s.h.db.DeleteConfig(ctx, SessionTokenSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := make([][]byte, 10)
+	var wg sync.WaitGroup
+	for i := range secrets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secret, err := LoadTokenSecret(ctx, s.h.db)
+			if err != nil {
+				t.Error(err)
+			}
+			secrets[i] = secret
+		}()
+	}
+	wg.Wait()
+	for _, secret := range secrets {
+		if len(secret) != 32 || !bytes.Equal(secret, secrets[0]) {
+			t.Fatal("instances started at the same time use different secrets")
+		}
+	}
+}
+
+// Public key of a jwk, as served by /.well-known/jwks.json.
+func parseJwk(t *testing.T, jwk Jwk) crypto.PublicKey {
+	t.Helper()
+	decode := func(value string) []byte {
+		ret, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	switch jwk.Kty {
+	case "EC":
+		if jwk.Crv != "P-256" {
+			t.Fatalf("unexpected curve: %s", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(jwk.X)),
+			Y:     new(big.Int).SetBytes(decode(jwk.Y)),
+		}
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			t.Fatalf("unexpected curve: %s", jwk.Crv)
+		}
+		return ed25519.PublicKey(decode(jwk.X))
+	case "RSA":
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(jwk.N)),
+			E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64()),
+		}
+	}
+	t.Fatalf("unexpected key type: %s", jwk.Kty)
+	return nil
+}
+
+func TestJwtAlgorithms(t *testing.T) {
+	for alg, kty := range map[string]string{"ES256": "EC", "EdDSA": "OKP"} {
+		t.Run(alg, func(t *testing.T) {
+			s := NewTestServer(t, map[string]string{
+				"KEIBI_JWT_ALGORITHM": alg,
+				"KEIBI_JWT_AUDIENCES": "kyoo,scanner",
+				"KEIBI_ISSUER":        "keibi-test",
+			})
+			var session struct{ Token string }
+			s.Request(http.MethodPost, "/users", map[string]string{
+				"username": "user",
+				"password": "password-user",
+				"email":    "user@zoriya.dev",
+			}).Expect(t, http.StatusCreated).Json(t, &session)
+			s.Auth = "Bearer " + session.Token
+
+			var jwks Jwks
+			s.Request(http.MethodGet, "/.well-known/jwks.json", nil).Expect(t, http.StatusOK).Json(t, &jwks)
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != kty || jwks.Keys[0].Alg != alg {
+				t.Fatalf("invalid jwks: %+v", jwks)
+			}
+			key := parseJwk(t, jwks.Keys[0])
+
+			for _, audience := range []string{"kyoo", "scanner"} {
+				var ret Jwt
+				s.Request(http.MethodGet, "/jwt?audience="+audience, nil).Expect(t, http.StatusOK).Json(t, &ret)
+				before := time.Now().Add(-time.Minute)
+				token, err := jwt.Parse(
+					ret.Token,
+					func(token *jwt.Token) (any, error) {
+						if token.Header["kid"] != jwks.Keys[0].Kid {
+							return nil, fmt.Errorf("unexpected kid: %v", token.Header["kid"])
+						}
+						return key, nil
+					},
+					jwt.WithValidMethods([]string{alg}),
+					jwt.WithAudience(audience),
+					jwt.WithIssuer("keibi-test"),
+					jwt.WithIssuedAt(),
+					jwt.WithExpirationRequired(),
+				)
+				if err != nil {
+					t.Fatalf("invalid jwt: %v", err)
+				}
+				iat, _ := token.Claims.GetIssuedAt()
+				nbf, _ := token.Claims.GetNotBefore()
+				if iat == nil || nbf == nil || iat.Before(before) || !nbf.Equal(iat.Time) {
+					t.Fatalf("invalid iat/nbf: %v", token.Claims)
+				}
+			}
+			s.Request(http.MethodGet, "/jwt?audience=unknown", nil).Expect(t, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestLoadKeysDoesNotRotate(t *testing.T) {
+	s := NewTestServer(t, map[string]string{"KEIBI_JWT_ALGORITHM": "EdDSA"})
+	ctx := context.Background()
+	current := s.h.keys.Current()
+
+	// admin commands load keys with the configured algorithm, they should not rotate them.
+	keys, err := LoadKeys(ctx, s.h.db, "ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current().Id != current.Id {
+		t.Fatal("loading keys rotated the current key")
+	}
+
+	err = keys.EnsureAlgorithm(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current().Id == current.Id || keys.Current().Method.Alg() != "ES256" {
+		t.Fatal("the key was not rotated to the new algorithm")
+	}
+	if len(keys.List()) != 2 {
+		t.Fatal("the previous key should be kept for the grace period")
+	}
+}
+
+func TestSignAlgorithms(t *testing.T) {
+	for _, alg := range JwtAlgorithms {
+		t.Run(alg, func(t *testing.T) {
+			private, err := generateKey(alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			method, err := KeyMethod(private.Public())
+			if err != nil || method.Alg() != alg {
+				t.Fatalf("invalid method for %s: %v", alg, err)
+			}
+			key := SigningKey{Id: KeyId(private.Public()), Method: method, PrivateKey: private}
+			// no database needed, the keys were just loaded.
+			store := &KeyStore{alg: alg, current: key, keys: []VerificationKey{key.Verification()}, loaded: time.Now()}
+
+			signed, err := store.Sign(jwt.MapClaims{"sub": "user"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := jwt.Parse(signed, store.Keyfunc, jwt.WithValidMethods([]string{alg}))
+			if err != nil || token.Header["kid"] != key.Id {
+				t.Fatalf("invalid jwt: %v", err)
+			}
+
+			// the jwk served in the jwks is enough to verify jwts.
+			jwk := publicJwk(private.Public())
+			_, err = jwt.Parse(signed, func(*jwt.Token) (any, error) { return parseJwk(t, jwk), nil })
+			if err != nil {
+				t.Fatalf("jwt can't be verified with its jwk: %v", err)
+			}
+			if KeyId(parseJwk(t, jwk)) != key.Id {
+				t.Fatal("the kid of the jwk does not match")
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	// Provider name used to store ldap identities in the oidc_handle table.
+	LdapProvider = "ldap"
+	LdapTimeout  = 10 * time.Second
+)
+
+var (
+	ErrLdapInvalidCredentials = errors.New("invalid ldap credentials")
+	ErrLdapUserNotFound       = errors.New("ldap user not found")
+)
+
+type LdapGroupConfig struct {
+	// Roles given to members of the group.
+	Roles []string `json:"roles"`
+	// Claims given to members of the group.
+	Claims jwt.MapClaims `json:"claims"`
+}
+
+type LdapConfig struct {
+	// `ldap://` or `ldaps://` url of the server.
+	Url string
+	// Upgrade `ldap://` connections with StartTLS.
+	StartTls bool
+	// Account used to search users, anonymous if empty.
+	BindDn       string
+	BindPassword string
+	// Where users are searched.
+	BaseDn string
+	// Filter used to find users, `{login}` is replaced by the escaped username or email.
+	UserFilter string
+	// Attribute uniquely identifying a user (the dn is used if it's missing).
+	IdAttribute       string
+	UsernameAttribute string
+	EmailAttribute    string
+	// Attribute listing groups of a user (their dn).
+	GroupAttribute string
+	// Roles & claims of each group, indexed by the group dn or cn.
+	Groups map[string]LdapGroupConfig
+}
+
+type LdapUser struct {
+	Dn       string
+	Id       string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+func LoadLdapConfig(c *Configuration) (*LdapConfig, error) {
+	url := os.Getenv("KEIBI_LDAP_URL")
+	if url == "" {
+		return nil, nil
+	}
+	ret := LdapConfig{
+		Url:               url,
+		StartTls:          os.Getenv("KEIBI_LDAP_STARTTLS") == "true",
+		BindDn:            os.Getenv("KEIBI_LDAP_BIND_DN"),
+		BindPassword:      os.Getenv("KEIBI_LDAP_BIND_PASSWORD"),
+		BaseDn:            os.Getenv("KEIBI_LDAP_BASE_DN"),
+		UserFilter:        GetenvOr("KEIBI_LDAP_USER_FILTER", "(&(objectClass=person)(|(uid={login})(mail={login})))"),
+		IdAttribute:       GetenvOr("KEIBI_LDAP_ID_ATTRIBUTE", "entryUUID"),
+		UsernameAttribute: GetenvOr("KEIBI_LDAP_USERNAME_ATTRIBUTE", "uid"),
+		EmailAttribute:    GetenvOr("KEIBI_LDAP_EMAIL_ATTRIBUTE", "mail"),
+		GroupAttribute:    GetenvOr("KEIBI_LDAP_GROUP_ATTRIBUTE", "memberOf"),
+	}
+	if !strings.HasPrefix(ret.Url, "ldap://") && !strings.HasPrefix(ret.Url, "ldaps://") {
+		return nil, fmt.Errorf("invalid KEIBI_LDAP_URL, expected an ldap:// or ldaps:// url: %s", ret.Url)
+	}
+	if ret.BaseDn == "" {
+		return nil, fmt.Errorf("KEIBI_LDAP_BASE_DN must be set to use ldap")
+	}
+	if !strings.Contains(ret.UserFilter, "{login}") {
+		return nil, fmt.Errorf("invalid KEIBI_LDAP_USER_FILTER, it must contain {login}")
+	}
+	if _, err := ldap.CompileFilter(strings.ReplaceAll(ret.UserFilter, "{login}", "login")); err != nil {
+		return nil, fmt.Errorf("invalid KEIBI_LDAP_USER_FILTER: %w", err)
+	}
+	if groups := os.Getenv("KEIBI_LDAP_GROUPS"); groups != "" {
+		err := json.Unmarshal([]byte(groups), &ret.Groups)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEIBI_LDAP_GROUPS, expected a json object: %w", err)
+		}
+		for group, conf := range ret.Groups {
+			if err = c.ValidateRoles(conf.Roles); err != nil {
+				return nil, fmt.Errorf("invalid KEIBI_LDAP_GROUPS, group %s: %w", group, err)
+			}
+		}
+	}
+	return &ret, nil
+}
+
+// Find the user matching `login` and check its password with a bind.
+func (l *LdapConfig) Authenticate(login string, password string) (*LdapUser, error) {
+	// an empty password would be an unauthenticated bind, which always succeeds (rfc 4513).
+	if password == "" {
+		return nil, ErrLdapInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(l.Url, ldap.DialWithDialer(&net.Dialer{Timeout: LdapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(LdapTimeout)
+
+	if l.StartTls && strings.HasPrefix(l.Url, "ldap://") {
+		u, err := url.Parse(l.Url)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return nil, err
+		}
+	}
+	if l.BindDn != "" {
+		if err = conn.Bind(l.BindDn, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("could not bind with the ldap service account: %w", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(LdapTimeout.Seconds()),
+		false,
+		strings.ReplaceAll(l.UserFilter, "{login}", ldap.EscapeFilter(login)),
+		[]string{l.IdAttribute, l.UsernameAttribute, l.EmailAttribute, l.GroupAttribute},
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("multiple ldap users match %s, check KEIBI_LDAP_USER_FILTER", login)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrLdapUserNotFound
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("multiple ldap users match %s, check KEIBI_LDAP_USER_FILTER", login)
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrLdapInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &LdapUser{
+		Dn:       entry.DN,
+		Id:       cmp.Or(entry.GetEqualFoldAttributeValue(l.IdAttribute), entry.DN),
+		Username: entry.GetEqualFoldAttributeValue(l.UsernameAttribute),
+		Email:    entry.GetEqualFoldAttributeValue(l.EmailAttribute),
+		Groups:   entry.GetEqualFoldAttributeValues(l.GroupAttribute),
+	}, nil
+}
+
+// Configured groups the user is a member of, sorted so claims are merged in a stable order.
+func (l *LdapConfig) userGroups(user *LdapUser) []LdapGroupConfig {
+	names := slices.Sorted(maps.Keys(l.Groups))
+	ret := make([]LdapGroupConfig, 0)
+	for _, name := range names {
+		member := slices.ContainsFunc(user.Groups, func(dn string) bool {
+			if strings.EqualFold(dn, name) {
+				return true
+			}
+			// allow groups to be configured by their cn instead of their full dn.
+			rdn, _, _ := strings.Cut(dn, ",")
+			_, cn, _ := strings.Cut(rdn, "=")
+			return strings.EqualFold(cn, name)
+		})
+		if member {
+			ret = append(ret, l.Groups[name])
+		}
+	}
+	return ret
+}
+
+// Roles & claims given by the groups of a user, `roles` is nil if no group mapping is configured.
+// The first user of the instance always keeps `FirstUserRoles` so it can't be locked out by the group mapping.
+func (h *Handler) ldapPermissions(user *LdapUser, claims jwt.MapClaims, firstUser bool) ([]string, jwt.MapClaims) {
+	if len(h.config.Ldap.Groups) == 0 {
+		return nil, claims
+	}
+	claims = maps.Clone(claims)
+	if claims == nil {
+		claims = make(jwt.MapClaims)
+	}
+	// claims managed by groups are rebuilt on each login, leaving a group must remove what it gave.
+	for _, group := range h.config.Ldap.Groups {
+		for key := range group.Claims {
+			if value, ok := h.config.DefaultClaims[key]; ok {
+				claims[key] = value
+			} else {
+				delete(claims, key)
+			}
+		}
+	}
+
+	roles := make([]string, 0)
+	for _, group := range h.config.Ldap.userGroups(user) {
+		roles = append(roles, group.Roles...)
+		maps.Copy(claims, group.Claims)
+	}
+	if len(roles) == 0 {
+		roles = slices.Clone(h.config.DefaultRoles)
+	}
+	if firstUser {
+		roles = append(roles, h.config.FirstUserRoles...)
+	}
+	slices.Sort(roles)
+	return slices.Compact(roles), claims
+}
+
+// Users linked to the directory must always login via ldap: they can't set a local password or unlink
+// the directory, otherwise disabling them in the directory would not revoke their access anymore.
+func (h *Handler) isLdapUser(user []dbc.GetUserRow) bool {
+	return h.config.Ldap != nil && slices.ContainsFunc(user, func(row dbc.GetUserRow) bool {
+		return row.Provider != nil && *row.Provider == LdapProvider
+	})
+}
+
+// Login with the ldap server, used when the login does not match a user with a password.
+// `existing` is the user matching the login, nil if none was found.
+func (h *Handler) ldapLogin(ctx context.Context, c echo.Context, req *LoginDto, existing *dbc.User) error {
+	account := strings.ToLower(req.Login)
+	var target *uuid.UUID
+	if existing != nil {
+		account = existing.Id.String()
+		target = &existing.Id
+	}
+	err := h.reserveAttempt(ctx, c, AccountAttempts, account, h.config.LoginMaxAttempts)
+	if err != nil {
+		h.auditLoginFailure(c, target, req.Login, "account locked")
+		return err
+	}
+
+	luser, err := h.config.Ldap.Authenticate(req.Login, req.Password)
+	if err == ErrLdapUserNotFound || err == ErrLdapInvalidCredentials {
+		reason := "unknown account"
+		herr := echo.NewHTTPError(http.StatusNotFound, "No account exists with the specified email or username.")
+		if err == ErrLdapInvalidCredentials {
+			reason = "invalid password"
+			herr = echo.NewHTTPError(http.StatusForbidden, "Invalid password")
+		} else if existing != nil {
+			// a local user created via oidc, not an ldap user.
+			reason = "no password"
+			herr = echo.NewHTTPError(http.StatusUnprocessableEntity, "Can't login with password, this account was created with OIDC.")
+		}
+		h.auditLoginFailure(c, target, req.Login, reason)
+		return h.failLogin(ctx, c, account, herr)
+	} else if err != nil {
+		c.Logger().Errorf("ldap login failed: %v", err)
+		// the credentials were not checked, this should not count as a failure.
+		if err = h.releaseAttempt(ctx, AccountAttempts, account); err != nil {
+			return err
+		}
+		if err = h.releaseAttempt(ctx, IpAttempts, c.RealIP()); err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusBadGateway, "Could not contact the ldap server.")
+	}
+	// users created by this login can't have 2fa enabled yet.
+	err = h.passwordLoginAttempts(ctx, c, account, existing != nil && existing.OtpEnabled)
+	if err != nil {
+		return err
+	}
+
+	dbuser, err := h.syncLdapUser(ctx, c, luser)
+	if err != nil {
+		return err
+	}
+	if dbuser.OtpEnabled || isOtpRequired(&dbuser) {
+		return h.createOtpChallenge(c, &dbuser)
+	}
+
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &dbuser.Id,
+		Target:  &dbuser.Id,
+		Details: map[string]any{"method": "ldap"},
+	})
+	user := MapDbUser(&dbuser)
+	return h.createSession(c, &user)
+}
+
+// Create the user on its first login or update it with the directory's informations.
+func (h *Handler) syncLdapUser(ctx context.Context, c echo.Context, luser *LdapUser) (dbc.User, error) {
+	if luser.Username == "" || luser.Email == "" {
+		return dbc.User{}, echo.NewHTTPError(
+			http.StatusUnprocessableEntity,
+			"This ldap account has no username or email, check KEIBI_LDAP_USERNAME_ATTRIBUTE and KEIBI_LDAP_EMAIL_ATTRIBUTE.",
+		)
+	}
+
+	dbuser, err := h.db.GetUserByOidc(ctx, dbc.GetUserByOidcParams{
+		Provider: LdapProvider,
+		Id:       luser.Id,
+	})
+	if err == pgx.ErrNoRows {
+		// the directory decides who can login, the registration mode does not apply.
+		roles, claims := h.ldapPermissions(luser, h.config.DefaultClaims, false)
+		firstRoles, _ := h.ldapPermissions(luser, h.config.DefaultClaims, true)
+		if roles == nil {
+			roles = h.config.DefaultRoles
+			firstRoles = h.config.FirstUserRoles
+		}
+		dbuser, err = CreateUser(ctx, h.db, dbc.CreateUserParams{
+			Username: luser.Username,
+			Email:    luser.Email,
+			Password: nil,
+			Claims:   claims,
+			// the directory is trusted to have valid emails.
+			EmailVerified:  true,
+			Roles:          roles,
+			FirstUserRoles: firstRoles,
+			Pending:        false,
+		})
+		if ErrIs(err, pgerrcode.UniqueViolation) {
+			return dbuser, echo.NewHTTPError(
+				http.StatusConflict,
+				"A user already exists with the same username or email.",
+			)
+		} else if err != nil {
+			return dbuser, err
+		}
+		h.audit(c, AuditEvent{
+			Action:  AuditRegister,
+			Outcome: AuditSuccess,
+			Actor:   &dbuser.Id,
+			Target:  &dbuser.Id,
+			Details: map[string]any{"method": "ldap", "dn": luser.Dn},
+		})
+		h.emit(c, WebhookUserCreated, MapDbUser(&dbuser))
+	} else if err != nil {
+		return dbuser, err
+	} else {
+		roles, claims := h.ldapPermissions(luser, dbuser.Claims, dbuser.FirstUser)
+		if roles == nil {
+			roles = dbuser.Roles
+		}
+		changed := dbuser.Username != luser.Username ||
+			dbuser.Email != luser.Email ||
+			!slices.Equal(slices.Sorted(slices.Values(dbuser.Roles)), roles) ||
+			!maps.EqualFunc(dbuser.Claims, claims, func(a any, b any) bool {
+				return fmt.Sprint(a) == fmt.Sprint(b)
+			})
+		if changed {
+			dbuser, err = h.db.UpdateUser(ctx, dbc.UpdateUserParams{
+				Id:       dbuser.Id,
+				Username: luser.Username,
+				Email:    luser.Email,
+				Password: dbuser.Password,
+				Claims:   claims,
+				Roles:    roles,
+			})
+			if ErrIs(err, pgerrcode.UniqueViolation) {
+				return dbuser, echo.NewHTTPError(
+					http.StatusConflict,
+					"Another user already has the username or email of this ldap account.",
+				)
+			} else if err != nil {
+				return dbuser, err
+			}
+			if !dbuser.EmailVerified {
+				dbuser, err = h.db.VerifyUserEmail(ctx, dbc.VerifyUserEmailParams{
+					Pk:    dbuser.Pk,
+					Email: dbuser.Email,
+				})
+				if err != nil {
+					return dbuser, err
+				}
+			}
+			h.emit(c, WebhookUserUpdated, MapDbUser(&dbuser))
+		}
+	}
+
+	_, err = h.db.SaveOidcHandle(ctx, dbc.SaveOidcHandleParams{
+		UserPk:   dbuser.Pk,
+		Provider: LdapProvider,
+		Id:       luser.Id,
+		Username: luser.Username,
+	})
+	return dbuser, err
+}
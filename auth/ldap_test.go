@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type ldapTestUser struct {
+	Dn       string
+	Uid      string
+	Mail     string
+	Password string
+	Groups   []string
+}
+
+// In-process ldap server supporting simple binds & searches by uid, only for tests.
+type LdapTestServer struct {
+	Url  string
+	lock sync.Mutex
+	// Service account used by keibi to search users.
+	bindDn       string
+	bindPassword string
+	users        []ldapTestUser
+}
+
+func NewLdapTestServer(t *testing.T, users ...ldapTestUser) *LdapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ret := &LdapTestServer{
+		Url:          "ldap://" + l.Addr().String(),
+		bindDn:       "cn=keibi,dc=zoriya,dc=dev",
+		bindPassword: "keibi-password",
+		users:        users,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ret.serve(conn)
+		}
+	}()
+	return ret
+}
+
+func (s *LdapTestServer) SetGroups(uid string, groups ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range s.users {
+		if s.users[i].Uid == uid {
+			s.users[i].Groups = groups
+		}
+	}
+}
+
+func ldapResponse(id int64, op *ber.Packet) *ber.Packet {
+	ret := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	ret.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	ret.AppendChild(op)
+	return ret
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	ret := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	ret.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	ret.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	ret.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return ret
+}
+
+func ldapEntry(user *ldapTestUser) *ber.Packet {
+	ret := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	ret.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, user.Dn, "objectName"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range map[string][]string{
+		"entryUUID": {"uuid-" + user.Uid},
+		"uid":       {user.Uid},
+		"mail":      {user.Mail},
+		"memberOf":  user.Groups,
+	} {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attr.AppendChild(set)
+		attributes.AppendChild(attr)
+	}
+	ret.AppendChild(attributes)
+	return ret
+}
+
+func (s *LdapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		s.lock.Lock()
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == s.bindDn && password == s.bindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, user := range s.users {
+				if dn == user.Dn && password == user.Password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, user := range s.users {
+				if strings.Contains(filter, "(uid="+user.Uid+")") || strings.Contains(filter, "(mail="+user.Mail+")") {
+					responses = append(responses, ldapEntry(&user))
+				}
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			// unbind, or anything we don't support.
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+
+		for _, response := range responses {
+			if _, err = conn.Write(ldapResponse(id, response).Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func ldapTestConfig(server *LdapTestServer) *LdapConfig {
+	return &LdapConfig{
+		Url:               server.Url,
+		BindDn:            server.bindDn,
+		BindPassword:      server.bindPassword,
+		BaseDn:            "dc=zoriya,dc=dev",
+		UserFilter:        "(&(objectClass=person)(|(uid={login})(mail={login})))",
+		IdAttribute:       "entryUUID",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		GroupAttribute:    "memberOf",
+	}
+}
+
+var ldapAlice = ldapTestUser{
+	Dn:       "uid=alice,ou=people,dc=zoriya,dc=dev",
+	Uid:      "alice",
+	Mail:     "alice@zoriya.dev",
+	Password: "alice-password",
+	Groups:   []string{"cn=kids,ou=groups,dc=zoriya,dc=dev"},
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	server := NewLdapTestServer(t, ldapAlice)
+	conf := ldapTestConfig(server)
+
+	_, err := conf.Authenticate("alice", "invalid")
+	if !errors.Is(err, ErrLdapInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	_, err = conf.Authenticate("bob", "bob-password")
+	if !errors.Is(err, ErrLdapUserNotFound) {
+		t.Fatalf("expected an unknown user, got %v", err)
+	}
+
+	user, err := conf.Authenticate("alice@zoriya.dev", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Dn != ldapAlice.Dn || user.Id != "uuid-alice" || user.Username != "alice" ||
+		user.Email != "alice@zoriya.dev" || !slices.Equal(user.Groups, ldapAlice.Groups) {
+		t.Fatalf("invalid ldap user: %+v", user)
+	}
+
+	// the service account must be valid to search users.
+	conf.BindPassword = "invalid"
+	_, err = conf.Authenticate("alice", "alice-password")
+	if err == nil || errors.Is(err, ErrLdapInvalidCredentials) {
+		t.Fatalf("a service account error should not be reported as invalid credentials: %v", err)
+	}
+}
+
+func TestLdapLogin(t *testing.T) {
+	server := NewLdapTestServer(t, ldapAlice)
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_LDAP_URL":           server.Url,
+		"KEIBI_LDAP_BASE_DN":       "dc=zoriya,dc=dev",
+		"KEIBI_LDAP_BIND_DN":       server.bindDn,
+		"KEIBI_LDAP_BIND_PASSWORD": server.bindPassword,
+		"KEIBI_LDAP_GROUPS":        `{"admins": {"roles": ["admin"]}, "kids": {"roles": ["user"], "claims": {"maxRating": "PG"}}}`,
+	})
+	// the first user is local so alice only gets the roles of its groups.
+	s.Register("admin")
+	s.Auth = ""
+
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "alice",
+		"password": "invalid",
+	}).Expect(t, http.StatusForbidden)
+
+	login := func() User {
+		t.Helper()
+		s.Auth = ""
+		var session struct{ Token string }
+		s.Request(http.MethodPost, "/sessions", map[string]string{
+			"login":    "alice",
+			"password": "alice-password",
+		}).Expect(t, http.StatusCreated).Json(t, &session)
+		s.UseSession(session.Token)
+		var me User
+		s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &me)
+		return me
+	}
+
+	// the user is created on its first login, with the roles & claims of its groups.
+	me := login()
+	if me.Username != "alice" || me.Email != "alice@zoriya.dev" || !me.EmailVerified ||
+		!slices.Equal(me.Roles, []string{"user"}) || me.Claims["maxRating"] != "PG" {
+		t.Fatalf("invalid ldap user: %+v", me)
+	}
+	if _, ok := me.Oidc[LdapProvider]; !ok {
+		t.Fatalf("the ldap identity should be linked: %+v", me.Oidc)
+	}
+
+	server.SetGroups("alice", "cn=admins,ou=groups,dc=zoriya,dc=dev")
+	me = login()
+	if !slices.Equal(me.Roles, []string{"admin"}) {
+		t.Fatalf("roles should follow groups: %v", me.Roles)
+	}
+	if _, ok := me.Claims["maxRating"]; ok {
+		t.Fatalf("leaving a group should remove its claims: %v", me.Claims)
+	}
+
+	// logins must keep going through the directory.
+	s.Request(http.MethodPatch, "/users/me", map[string]string{"password": "local-password"}).
+		Expect(t, http.StatusUnprocessableEntity)
+	s.Request(http.MethodDelete, "/unlink/"+LdapProvider, nil).Expect(t, http.StatusUnprocessableEntity)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	AccountAttempts = "account"
+	IpAttempts      = "ip"
+	// Max duration of a lockout, lockouts double after each new lockout (or each failure over the limit).
+	LoginLockoutMax = time.Hour
+	// Failures older than this are forgotten.
+	LoginAttemptsReset = 24 * time.Hour
+)
+
+// Hash compared against when the user does not exist so failed logins always take the same time.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := argon2id.CreateHash("keibi", argon2id.DefaultParams)
+	return hash
+})
+
+func (h *Handler) lockedError(c echo.Context, until time.Time) error {
+	retry := int(math.Ceil(time.Until(until).Seconds()))
+	c.Response().Header().Set("Retry-After", fmt.Sprint(retry))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "Too many failed login attempts, try again later.")
+}
+
+// Count an attempt as a failure before checking the credentials, so concurrent requests can't try more than `maxAttempts` times.
+// The attempt must then be given to either `failAttempt`, `releaseAttempt` or cleared with `ClearLoginAttempts`.
+func (h *Handler) reserveAttempt(ctx context.Context, c echo.Context, kind string, target string, maxAttempts int) error {
+	attempt, err := h.db.ReserveLoginAttempt(ctx, dbc.ReserveLoginAttemptParams{
+		Kind:        kind,
+		Target:      target,
+		ResetBefore: time.Now().UTC().Add(-LoginAttemptsReset),
+		MaxAttempts: int32(maxAttempts),
+	})
+	if err == pgx.ErrNoRows {
+		// the target is locked, nothing was reserved.
+		attempt, err = h.db.GetLoginAttempt(ctx, dbc.GetLoginAttemptParams{
+			Kind:   kind,
+			Target: target,
+		})
+		if err != nil || attempt.LockedUntil == nil || attempt.LockedUntil.Before(time.Now().UTC()) {
+			// the lock expired (or was cleared) in between.
+			return h.reserveAttempt(ctx, c, kind, target, maxAttempts)
+		}
+		return h.lockedError(c, *attempt.LockedUntil)
+	} else if err != nil {
+		return err
+	}
+	if int(attempt.Failures) > maxAttempts {
+		// other requests used the remaining attempts since the last failure.
+		until, err := h.lockLogin(ctx, &attempt, maxAttempts)
+		if err != nil {
+			return err
+		}
+		return h.lockedError(c, until)
+	}
+	return nil
+}
+
+// The reserved attempt succeeded, it should not count as a failure.
+func (h *Handler) releaseAttempt(ctx context.Context, kind string, target string) error {
+	return h.db.ReleaseLoginAttempt(ctx, dbc.ReleaseLoginAttemptParams{
+		Kind:   kind,
+		Target: target,
+	})
+}
+
+// The reserved attempt failed, lock the target if it has no attempts left.
+func (h *Handler) failAttempt(ctx context.Context, kind string, target string, maxAttempts int) error {
+	attempt, err := h.db.GetLoginAttempt(ctx, dbc.GetLoginAttemptParams{
+		Kind:   kind,
+		Target: target,
+	})
+	if err != nil {
+		return err
+	}
+	if int(attempt.Failures) < maxAttempts {
+		return nil
+	}
+	_, err = h.lockLogin(ctx, &attempt, maxAttempts)
+	return err
+}
+
+func (h *Handler) lockLogin(ctx context.Context, attempt *dbc.LoginAttempt, maxAttempts int) (time.Time, error) {
+	over := int(attempt.Lockouts) + int(attempt.Failures) - maxAttempts
+	delay := LoginLockoutMax
+	if over < 16 {
+		delay = min(h.config.LoginLockoutDelay<<over, LoginLockoutMax)
+	}
+	until := time.Now().UTC().Add(delay)
+	err := h.db.LockLogin(ctx, dbc.LockLoginParams{
+		Kind:        attempt.Kind,
+		Target:      attempt.Target,
+		LockedUntil: &until,
+	})
+	return until, err
+}
+
+// The credentials were valid: clear failures of the account and release the attempt of the ip.
+func (h *Handler) clearLoginAttempts(ctx context.Context, c echo.Context, account string) error {
+	err := h.db.ClearLoginAttempts(ctx, dbc.ClearLoginAttemptsParams{
+		Kind:   AccountAttempts,
+		Target: account,
+	})
+	if err != nil {
+		return err
+	}
+	return h.releaseAttempt(ctx, IpAttempts, c.RealIP())
+}
+
+// The password was valid but the user has 2fa enabled: only release the attempt of the ip.
+// Failures of the account are cleared once the code is validated (see `OtpLogin`),
+// otherwise each new challenge would give more attempts to guess the code.
+func (h *Handler) passwordLoginAttempts(ctx context.Context, c echo.Context, account string, otpEnabled bool) error {
+	if otpEnabled {
+		return h.releaseAttempt(ctx, IpAttempts, c.RealIP())
+	}
+	return h.clearLoginAttempts(ctx, c, account)
+}
+
+// Fail the attempts reserved for the account and the ip then return `err`
+// (or a generic error if the instance is configured to hide why logins failed).
+func (h *Handler) failLogin(ctx context.Context, c echo.Context, account string, err error) error {
+	ferr := h.failAttempt(ctx, AccountAttempts, account, h.config.LoginMaxAttempts)
+	if ferr != nil {
+		return ferr
+	}
+	ferr = h.failAttempt(ctx, IpAttempts, c.RealIP(), h.config.LoginMaxIpAttempts)
+	if ferr != nil {
+		return ferr
+	}
+	if h.config.GenericLoginErrors {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid login or password.")
+	}
+	return err
+}
+
+// @Summary      Clear lockout
+// @Description  Clear failed login attempts of an user, allowing them to login again immediately.
+// @Tags         users
+// @Produce      json
+// @Security     Jwt[users.write]
+// @Param        id   path      string  true  "The id of the user" Format(uuid)
+// @Success      200  {object}  User
+// @Failure      403  {object}  problem.Problem "Missing users.write permission"
+// @Failure      404  {object}  problem.Problem "No user with the given id found"
+// @Router /users/{id}/lockout [delete]
+func (h *Handler) ClearLockout(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.write"})
+	if err != nil {
+		return err
+	}
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	ctx := context.Background()
+	user, err := h.getUser(ctx, uid)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No user found with given id")
+	} else if err != nil {
+		return err
+	}
+	err = h.db.ClearLoginAttempts(ctx, dbc.ClearLoginAttemptsParams{
+		Kind:   AccountAttempts,
+		Target: uid.String(),
+	})
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLockoutClear,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+	})
+	return c.JSON(http.StatusOK, user)
+}
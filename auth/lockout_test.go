@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockoutConcurrentLogins(t *testing.T) {
+	s := NewTestServer(t, nil)
+	s.Register("lockout-user")
+	s.Auth = ""
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	checked := 0
+	for range 4 * s.h.config.LoginMaxAttempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.Request(http.MethodPost, "/sessions", map[string]string{
+				"login":    "lockout-user",
+				"password": "invalid",
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			if resp.Status == http.StatusForbidden {
+				checked++
+			}
+		}()
+	}
+	wg.Wait()
+	if checked > s.h.config.LoginMaxAttempts {
+		t.Fatalf("%d passwords were checked, the limit is %d", checked, s.h.config.LoginMaxAttempts)
+	}
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "lockout-user",
+		"password": "password-lockout-user",
+	}).Expect(t, http.StatusTooManyRequests)
+}
+
+func TestLockoutSuccessfulLogins(t *testing.T) {
+	s := NewTestServer(t, nil)
+	s.Register("login-user")
+
+	// successful logins never count towards the limit of the ip.
+	for range s.h.config.LoginMaxIpAttempts + 5 {
+		s.Login("login-user")
+	}
+}
+
+func TestLockoutExpiration(t *testing.T) {
+	s := NewTestServer(t, nil)
+	s.Register("expired-user")
+	s.Auth = ""
+
+	login := func(password string, status int) {
+		t.Helper()
+		s.Request(http.MethodPost, "/sessions", map[string]string{
+			"login":    "expired-user",
+			"password": password,
+		}).Expect(t, status)
+	}
+	expire := func() {
+		t.Helper()
+		_, err := s.db.Exec(context.Background(), "update login_attempts set locked_until = now() - interval '1 second'")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lockedFor := func() time.Duration {
+		t.Helper()
+		var until time.Time
+		err := s.db.QueryRow(
+			context.Background(),
+			"select locked_until from login_attempts where kind = 'account' and locked_until is not null",
+		).Scan(&until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Until(until)
+	}
+
+	for range s.h.config.LoginMaxAttempts {
+		login("invalid", http.StatusForbidden)
+	}
+	login("password-expired-user", http.StatusTooManyRequests)
+	first := lockedFor()
+
+	// a single attempt is allowed once the lockout expires, failing it locks again for longer.
+	expire()
+	login("invalid", http.StatusForbidden)
+	login("password-expired-user", http.StatusTooManyRequests)
+	if lockedFor() <= first {
+		t.Fatalf("the second lockout should be longer than the first (%s)", first)
+	}
+
+	expire()
+	login("password-expired-user", http.StatusCreated)
+	login("invalid", http.StatusForbidden)
+}
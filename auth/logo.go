@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Max size of an uploaded logo, in bytes.
+	MaxLogoSize = 5 << 20
+	// Max width or height of an uploaded logo, checked before decoding the whole image.
+	MaxLogoDimension = 4096
+	DefaultLogoSize  = 256
+)
+
+// Logos are resized to all those sizes (in px, logos are always square) on upload.
+var LogoSizes = []int{64, 256, 512}
+
+var LogoContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+type LogoStorage interface {
+	// Save the png encoded logo of the given user for the given size.
+	Save(ctx context.Context, id uuid.UUID, size int, data []byte) error
+	// Open the png encoded logo of the given user. Returns fs.ErrNotExist if the user has no logo.
+	Open(ctx context.Context, id uuid.UUID, size int) ([]byte, time.Time, error)
+	// Delete every sizes of the logo of the given user.
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+type LocalLogoStorage struct {
+	Root string
+}
+
+func (s *LocalLogoStorage) path(id uuid.UUID, size int) string {
+	return filepath.Join(s.Root, id.String(), fmt.Sprintf("%d.png", size))
+}
+
+func (s *LocalLogoStorage) Save(ctx context.Context, id uuid.UUID, size int, data []byte) error {
+	path := s.path(id, size)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first to never serve half written logos.
+	// the name must be unique since multiple uploads can happen at the same time.
+	tmp, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("%d.*.tmp", size))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0o644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalLogoStorage) Open(ctx context.Context, id uuid.UUID, size int) ([]byte, time.Time, error) {
+	path := s.path(id, size)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, info.ModTime(), nil
+}
+
+func (s *LocalLogoStorage) Delete(ctx context.Context, id uuid.UUID) error {
+	path := filepath.Join(s.Root, id.String())
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+func getLogoSize(c echo.Context) (int, error) {
+	param := c.QueryParam("size")
+	if param == "" {
+		return DefaultLogoSize, nil
+	}
+	size, err := strconv.Atoi(param)
+	if err != nil || !slices.Contains(LogoSizes, size) {
+		return 0, echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Invalid size, available sizes are: %v", LogoSizes),
+		)
+	}
+	return size, nil
+}
+
+// @Summary      Get logo
+// @Description  Get the logo of a user. A generated logo is returned if the user has not uploaded one.
+// @Tags         users
+// @Produce      png
+// @Param        id    path    string  true   "The id of the user" Format(uuid)
+// @Param        size  query   int     false  "Size of the logo (in px)" Enums(64, 256, 512)
+// @Success      200  {file}    binary
+// @Success      304
+// @Failure      400  {object}  problem.Problem "Invalid id or size"
+// @Router /users/{id}/logo [get]
+func (h *Handler) GetLogo(c echo.Context) error {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	return h.serveLogo(c, uid)
+}
+
+// @Summary      Get my logo
+// @Description  Get the logo of the current user. A generated logo is returned if you have not uploaded one.
+// @Tags         users
+// @Produce      png
+// @Security     Jwt
+// @Param        size  query   int     false  "Size of the logo (in px)" Enums(64, 256, 512)
+// @Success      200  {file}    binary
+// @Success      304
+// @Failure      400  {object}  problem.Problem "Invalid size"
+// @Router /users/me/logo [get]
+func (h *Handler) GetMyLogo(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	return h.serveLogo(c, uid)
+}
+
+func (h *Handler) serveLogo(c echo.Context, id uuid.UUID) error {
+	size, err := getLogoSize(c)
+	if err != nil {
+		return err
+	}
+
+	data, modtime, err := h.logos.Open(context.Background(), id, size)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = DefaultLogo(id, size)
+		if err != nil {
+			return err
+		}
+		modtime = time.Time{}
+		c.Response().Header().Set("ETag", fmt.Sprintf(`"default-%s-%d"`, id, size))
+	} else if err != nil {
+		return err
+	} else {
+		c.Response().Header().Set("ETag", fmt.Sprintf(`"%s-%d-%d"`, id, size, modtime.Unix()))
+	}
+
+	c.Response().Header().Set("Content-Type", "image/png")
+	// users can change their logos, let clients revalidate with the etag after a while.
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600, must-revalidate")
+	http.ServeContent(c.Response(), c.Request(), "logo.png", modtime, bytes.NewReader(data))
+	return nil
+}
+
+// @Summary      Upload logo
+// @Description  Upload a logo for a user. The image can be sent as the raw body or as the `logo` field of a multipart form.
+// @Description  Png, jpeg, gif and webp images are supported, they will be cropped to a square.
+// @Tags         users
+// @Accept       png,jpeg,gif,octet-stream,mpfd
+// @Produce      json
+// @Security     Jwt[users.write]
+// @Param        id    path    string  true   "The id of the user" Format(uuid)
+// @Success      204
+// @Failure      400  {object}  problem.Problem "Invalid or unsupported image"
+// @Failure      403  {object}  problem.Problem "Missing users.write permission"
+// @Failure      413  {object}  problem.Problem "Image too big"
+// @Router /users/{id}/logo [post]
+func (h *Handler) UploadLogo(c echo.Context) error {
+	uid, err := h.getEditableUserId(c)
+	if err != nil {
+		return err
+	}
+	return h.uploadLogo(c, uid)
+}
+
+// @Summary      Upload my logo
+// @Description  Upload a logo for the current user. The image can be sent as the raw body or as the `logo` field of a multipart form.
+// @Description  Png, jpeg, gif and webp images are supported, they will be cropped to a square.
+// @Tags         users
+// @Accept       png,jpeg,gif,octet-stream,mpfd
+// @Produce      json
+// @Security     Jwt
+// @Success      204
+// @Failure      400  {object}  problem.Problem "Invalid or unsupported image"
+// @Failure      413  {object}  problem.Problem "Image too big"
+// @Router /users/me/logo [post]
+func (h *Handler) UploadMyLogo(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	return h.uploadLogo(c, uid)
+}
+
+func (h *Handler) uploadLogo(c echo.Context, id uuid.UUID) error {
+	var body io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get("Content-Type"), "multipart/form-data") {
+		c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, MaxLogoSize+(1<<10))
+		file, err := c.FormFile("logo")
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Missing `logo` file in form.")
+		}
+		src, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		body = src
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, MaxLogoSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxLogoSize {
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Logo too big, max size is %d bytes.", MaxLogoSize),
+		)
+	}
+
+	mime := http.DetectContentType(data)
+	if !slices.Contains(LogoContentTypes, mime) {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("Unsupported image type %s, use one of %s.", mime, strings.Join(LogoContentTypes, ", ")),
+		)
+	}
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid image.")
+	}
+	if conf.Width > MaxLogoDimension || conf.Height > MaxLogoDimension {
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Logo too big, max dimensions are %dx%d.", MaxLogoDimension, MaxLogoDimension),
+		)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid image.")
+	}
+
+	ctx := context.Background()
+	square := cropSquare(img)
+	for _, size := range LogoSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), square, square.Bounds(), draw.Src, nil)
+
+		var buf bytes.Buffer
+		err = png.Encode(&buf, dst)
+		if err != nil {
+			return err
+		}
+		err = h.logos.Save(ctx, id, size, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	rect := image.Rect(x, y, x+side, y+side)
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	ret := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(ret, ret.Bounds(), img, rect.Min, draw.Src)
+	return ret
+}
+
+// @Summary      Delete logo
+// @Description  Delete the logo of a user. The generated logo will be used instead.
+// @Tags         users
+// @Security     Jwt[users.write]
+// @Param        id    path    string  true   "The id of the user" Format(uuid)
+// @Success      204
+// @Failure      403  {object}  problem.Problem "Missing users.write permission"
+// @Failure      404  {object}  problem.Problem "The user does not have a logo"
+// @Router /users/{id}/logo [delete]
+func (h *Handler) DeleteLogo(c echo.Context) error {
+	uid, err := h.getEditableUserId(c)
+	if err != nil {
+		return err
+	}
+	return h.deleteLogo(c, uid)
+}
+
+// @Summary      Delete my logo
+// @Description  Delete the logo of the current user. The generated logo will be used instead.
+// @Tags         users
+// @Security     Jwt
+// @Success      204
+// @Failure      404  {object}  problem.Problem "You don't have a logo"
+// @Router /users/me/logo [delete]
+func (h *Handler) DeleteMyLogo(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	return h.deleteLogo(c, uid)
+}
+
+func (h *Handler) deleteLogo(c echo.Context, id uuid.UUID) error {
+	err := h.logos.Delete(context.Background(), id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return echo.NewHTTPError(http.StatusNotFound, "No logo found for this user.")
+	} else if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Generate a github-like identicon from the user id.
+func DefaultLogo(id uuid.UUID, size int) ([]byte, error) {
+	hash := sha256.Sum256(id[:])
+	fg := color.RGBA{R: hash[0], G: hash[1], B: hash[2], A: 255}
+	bg := color.RGBA{R: 240, G: 240, B: 240, A: 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	const cells = 5
+	for y := 0; y < cells; y++ {
+		// only compute the left half and mirror it.
+		for x := 0; x < (cells+1)/2; x++ {
+			if hash[3+y*3+x]%2 == 0 {
+				continue
+			}
+			for _, cx := range []int{x, cells - 1 - x} {
+				rect := image.Rect(cx*size/cells, y*size/cells, (cx+1)*size/cells, (y+1)*size/cells)
+				draw.Draw(img, rect, &image.Uniform{fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
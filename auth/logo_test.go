@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestLocalLogoConcurrentSave(t *testing.T) {
+	s := &LocalLogoStorage{Root: t.TempDir()}
+	id := uuid.New()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Save(context.Background(), id, DefaultLogoSize, bytes.Repeat([]byte{byte(i)}, 4096))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _, err := s.Open(context.Background(), id, DefaultLogoSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the logo must be one of the uploads, never a mix of them.
+	if !bytes.Equal(data, bytes.Repeat(data[:1], 4096)) {
+		t.Fatal("the logo was corrupted by concurrent uploads")
+	}
+	entries, err := os.ReadDir(filepath.Join(s.Root, id.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != fmt.Sprintf("%d.png", DefaultLogoSize) {
+		t.Fatalf("temporary files were left behind: %v", entries)
+	}
+}
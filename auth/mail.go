@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+func formatMail(from string, to string, subject string, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+type SmtpMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SmtpMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient: %q", to)
+	}
+	msg := formatMail(m.From, to, subject, body)
+	addr := net.JoinHostPort(m.Host, m.Port)
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// port 465 uses implicit tls, others use STARTTLS if the server supports it.
+	if m.Port != "465" {
+		return smtp.SendMail(addr, auth, m.From, []string{to}, msg)
+	}
+
+	dialer := tls.Dialer{Config: &tls.Config{ServerName: m.Host}}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(m.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Write mails to a writer instead of sending them, useful for development or tests.
+type WriterMailer struct {
+	lock sync.Mutex
+	From string
+	Out  io.Writer
+}
+
+func (m *WriterMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := m.Out.Write(formatMail(m.From, to, subject, body))
+	if err != nil {
+		return err
+	}
+	_, err = m.Out.Write([]byte("\r\n.\r\n"))
+	return err
+}
+
+func NewMailer() (Mailer, error) {
+	from := GetenvOr("KEIBI_MAIL_FROM", "keibi@localhost")
+
+	switch kind := os.Getenv("KEIBI_MAILER"); kind {
+	case "":
+		return nil, nil
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required to use the smtp mailer")
+		}
+		return &SmtpMailer{
+			Host:     host,
+			Port:     GetenvOr("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	case "stdout":
+		return &WriterMailer{From: from, Out: os.Stdout}, nil
+	case "file":
+		path := GetenvOr("KEIBI_MAIL_FILE", "mails.txt")
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &WriterMailer{From: from, Out: file}, nil
+	default:
+		return nil, fmt.Errorf("invalid mailer: %s, expected smtp, stdout or file", kind)
+	}
+}
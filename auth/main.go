@@ -117,8 +117,16 @@ func OpenDatabase() (*pgxpool.Pool, error) {
 }
 
 type Handler struct {
-	db     *dbc.Queries
-	config *Configuration
+	db        *dbc.Queries
+	config    *Configuration
+	logos     LogoStorage
+	federated *FederatedProviders
+	mailer    Mailer
+	keys      *KeyStore
+	jwtCache  *JwtCache
+	webhooks  *Webhooks
+	// Key used to hash session tokens.
+	tokenSecret []byte
 }
 
 // @title Keibi - Kyoo's auth
@@ -142,51 +150,187 @@ type Handler struct {
 // @in header
 // @name Authorization
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(RunCli(os.Args[1:]))
+	}
+
 	e := echo.New()
 	e.Use(middleware.Logger())
-	e.Validator = &Validator{validator: validator.New(validator.WithRequiredStructEnabled())}
-	e.HTTPErrorHandler = ErrorHandler
 
 	db, err := OpenDatabase()
 	if err != nil {
 		e.Logger.Fatal("Could not open databse: ", err)
 		return
 	}
+	h, err := SetupServer(e, db)
+	if err != nil {
+		e.Logger.Fatal(err)
+		return
+	}
+	go h.RunJanitor(context.Background(), e.Logger)
+	go h.webhooks.Run(context.Background(), e.Logger)
+
+	e.Logger.Fatal(e.Start(":4568"))
+}
+
+// Load the configuration & keys and register every routes on `e`.
+func SetupServer(e *echo.Echo, db *pgxpool.Pool) (*Handler, error) {
+	e.Validator = &Validator{validator: validator.New(validator.WithRequiredStructEnabled())}
+	e.HTTPErrorHandler = ErrorHandler
+	// only trust X-Forwarded-For from private networks (our reverse proxy).
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 
 	h := Handler{
 		db: dbc.New(db),
 	}
-	conf, err := LoadConfiguration(h.db)
+	conf, err := LoadConfiguration()
 	if err != nil {
-		e.Logger.Fatal("Could not load configuration: ", err)
-		return
+		return nil, fmt.Errorf("could not load configuration: %w", err)
 	}
 	h.config = conf
+	h.keys, err = LoadKeys(context.Background(), h.db, conf.JwtAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("could not load jwt keys: %w", err)
+	}
+	err = h.keys.EnsureAlgorithm(context.Background(), conf.KeyRotationGrace)
+	if err != nil {
+		return nil, fmt.Errorf("could not rotate jwt keys to %s: %w", conf.JwtAlgorithm, err)
+	}
+	h.logos = &LocalLogoStorage{Root: conf.LogoDir}
+	h.jwtCache = NewJwtCache(conf.ForwardAuthCacheTtl)
+	h.webhooks = NewWebhooks(h.db, conf.Webhooks)
+	if conf.FederatedUrl != "" {
+		h.federated = NewFederatedProviders(conf.FederatedUrl)
+	}
+	h.mailer, err = NewMailer()
+	if err != nil {
+		return nil, fmt.Errorf("could not create mailer: %w", err)
+	}
+	if conf.RequireVerifiedEmail && h.mailer == nil {
+		return nil, errors.New("a mailer is required to verify emails, set KEIBI_MAILER")
+	}
+	h.tokenSecret, err = LoadTokenSecret(context.Background(), h.db)
+	if err != nil {
+		return nil, fmt.Errorf("could not load token secret: %w", err)
+	}
+	err = h.HashSessionTokens(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not hash session tokens: %w", err)
+	}
+
+	h.RegisterRoutes(e)
+	return &h, nil
+}
 
+func (h *Handler) RegisterRoutes(e *echo.Echo) {
+	conf := h.config
 	g := e.Group(conf.Prefix)
 	r := e.Group(conf.Prefix)
 	r.Use(echojwt.WithConfig(echojwt.Config{
-		SigningMethod: "RS256",
-		SigningKey:    h.config.JwtPublicKey,
+		KeyFunc: h.keys.Keyfunc,
+	}))
+	r.Use(h.AuditImpersonation)
+
+	o := e.Group(conf.Prefix)
+	o.Use(echojwt.WithConfig(echojwt.Config{
+		KeyFunc:                h.keys.Keyfunc,
+		ContinueOnIgnoredError: true,
+		ErrorHandler: func(c echo.Context, err error) error {
+			// Only allow requests without jwt, invalid jwts should still be rejected.
+			var terr *echojwt.TokenExtractionError
+			if errors.As(err, &terr) {
+				return nil
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid or expired jwt")
+		},
 	}))
+	o.Use(h.AuditImpersonation)
 
 	g.GET("/health", h.CheckHealth)
 
 	r.GET("/users", h.ListUsers)
 	r.GET("/users/:id", h.GetUser)
 	r.GET("/users/me", h.GetMe)
+	r.PUT("/users/:id", h.EditUser)
+	r.PUT("/users/me", h.EditSelf)
+	r.PATCH("/users/:id", h.EditUser)
+	r.PATCH("/users/me", h.EditSelf)
 	r.DELETE("/users/:id", h.DeleteUser)
 	r.DELETE("/users/me", h.DeleteSelf)
+	g.GET("/users/:id/logo", h.GetLogo)
+	r.GET("/users/me/logo", h.GetMyLogo)
+	r.POST("/users/:id/logo", h.UploadLogo)
+	r.POST("/users/me/logo", h.UploadMyLogo)
+	r.DELETE("/users/:id/logo", h.DeleteLogo)
+	r.DELETE("/users/me/logo", h.DeleteMyLogo)
 	g.POST("/users", h.Register)
+	r.POST("/users/:id/approve", h.ApproveUser)
+	r.POST("/users/:id/impersonate", h.Impersonate)
+	r.GET("/users/me/export", h.ExportSelf)
+	r.GET("/users/:id/export", h.ExportUser)
+
+	r.GET("/invites", h.ListInvites)
+	r.POST("/invites", h.CreateInvite)
+	r.DELETE("/invites/:id", h.DeleteInvite)
+
+	g.POST("/password-reset", h.RequestPasswordReset)
+	g.POST("/password-reset/confirm", h.ResetPassword)
+	g.POST("/verify-email", h.RequestEmailVerification)
+	g.POST("/verify-email/confirm", h.VerifyEmail)
 
 	g.POST("/sessions", h.Login)
+	g.POST("/sessions/otp", h.OtpLogin)
+	r.GET("/sessions", h.ListMySessions)
+	r.GET("/users/:id/sessions", h.ListUserSessions)
 	r.DELETE("/sessions", h.Logout)
+	r.DELETE("/sessions/others", h.LogoutOthers)
 	r.DELETE("/sessions/:id", h.Logout)
+	r.PUT("/sessions/current/profile", h.SwitchProfile)
+
+	g.POST("/device/code", h.RequestDeviceCode)
+	g.POST("/device/token", h.PollDeviceToken)
+	r.GET("/device/:code", h.GetDeviceRequest)
+	r.POST("/device/:code/approve", h.ApproveDevice)
+	r.POST("/device/:code/deny", h.DenyDevice)
+
+	g.POST("/quick-connect", h.InitiateQuickConnect)
+	g.POST("/quick-connect/session", h.PollQuickConnect)
+	r.GET("/quick-connect/:code", h.GetQuickConnect)
+	r.POST("/quick-connect/:code/approve", h.ApproveQuickConnect)
+
+	r.GET("/users/me/profiles", h.ListProfiles)
+	r.POST("/users/me/profiles", h.CreateProfile)
+	r.PATCH("/users/me/profiles/:id", h.EditProfile)
+	r.DELETE("/users/me/profiles/:id", h.DeleteProfile)
+	g.GET("/profiles/:id/logo", h.GetProfileLogo)
+	r.POST("/users/me/profiles/:id/logo", h.UploadProfileLogo)
+	r.DELETE("/users/me/profiles/:id/logo", h.DeleteProfileLogo)
+
+	g.GET("/providers", h.ListProviders)
+	g.GET("/login/:provider", h.OidcLogin)
+	g.GET("/logged/:provider", h.OidcLogged)
+	o.POST("/callback/:provider", h.OidcCallback)
+	r.DELETE("/unlink/:provider", h.OidcUnlink)
+
+	r.POST("/users/me/otp", h.EnrollOtp)
+	r.POST("/users/me/otp/confirm", h.ConfirmOtp)
+	r.POST("/users/me/otp/recovery-codes", h.RegenerateRecoveryCodes)
+	r.DELETE("/users/me/otp", h.DisableOtp)
+	r.DELETE("/users/:id/otp", h.ResetOtp)
+	r.DELETE("/users/:id/lockout", h.ClearLockout)
+
+	r.GET("/audit", h.ListAuditLogs)
+
+	r.GET("/apikeys", h.ListApiKeys)
+	r.POST("/apikeys", h.CreateApiKey)
+	r.DELETE("/apikeys/:id", h.DeleteApiKey)
 
 	g.GET("/jwt", h.CreateJwt)
+	r.POST("/jwt/rotate", h.RotateKeys)
+	// proxies might forward the method of the original request.
+	g.Any("/forward-auth", h.ForwardAuth)
+	g.GET("/.well-known/jwks.json", h.GetJwks)
 	g.GET("/info", h.GetInfo)
 
 	g.GET("/swagger/*", echoSwagger.WrapHandler)
-
-	e.Logger.Fatal(e.Start(":4568"))
 }
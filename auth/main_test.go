@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+)
+
+// Tests use the database configured via POSTGRES_* (like the server), each test uses its own schema.
+// They are skipped if the database can't be reached.
+
+type TestServer struct {
+	*httptest.Server
+	h  *Handler
+	db *pgxpool.Pool
+	t  *testing.T
+	// Value of the Authorization header, set by Register/Login.
+	Auth string
+}
+
+type TestResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func (r *TestResponse) Json(t *testing.T, ret any) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, ret); err != nil {
+		t.Fatalf("invalid json body (%d): %s", r.Status, r.Body)
+	}
+}
+
+func (r *TestResponse) Expect(t *testing.T, status int) *TestResponse {
+	t.Helper()
+	if r.Status != status {
+		t.Fatalf("expected status %d, got %d: %s", status, r.Status, r.Body)
+	}
+	return r
+}
+
+// Start a keibi server, `env` is applied over the environment before loading the configuration.
+func NewTestServer(t *testing.T, env map[string]string) *TestServer {
+	t.Helper()
+	id := make([]byte, 6)
+	_, _ = rand.Read(id)
+	schema := "keibi_test_" + hex.EncodeToString(id)
+	t.Setenv("POSTGRES_SCHEMA", schema)
+	t.Setenv("KEIBI_LOGO_DIR", t.TempDir())
+
+	srv := httptest.NewUnstartedServer(nil)
+	// the url must be known before loading the configuration.
+	t.Setenv("PUBLIC_URL", "http://"+srv.Listener.Addr().String())
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	db, err := OpenDatabase()
+	if err != nil {
+		srv.Close()
+		t.Skipf("could not open the database: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = db.Exec(context.Background(), fmt.Sprintf("drop schema %s cascade", schema))
+		db.Close()
+	})
+
+	e := echo.New()
+	h, err := SetupServer(e, db)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	srv.Config.Handler = e
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return &TestServer{Server: srv, h: h, db: db, t: t}
+}
+
+var testClient = &http.Client{
+	// redirects are checked by the tests.
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (s *TestServer) Request(method string, path string, body any) *TestResponse {
+	s.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.Auth != "" {
+		req.Header.Set("Authorization", s.Auth)
+	}
+	resp, err := testClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ret, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return &TestResponse{Status: resp.StatusCode, Header: resp.Header, Body: ret}
+}
+
+// Exchange a session token for a jwt and use it for the next requests.
+func (s *TestServer) UseSession(token string) string {
+	s.t.Helper()
+	s.Auth = "Bearer " + token
+	var ret Jwt
+	s.Request(http.MethodGet, "/jwt", nil).Expect(s.t, http.StatusOK).Json(s.t, &ret)
+	s.Auth = "Bearer " + ret.Token
+	return ret.Token
+}
+
+func (s *TestServer) Register(username string) string {
+	s.t.Helper()
+	s.Auth = ""
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/users", map[string]string{
+		"username": username,
+		"password": "password-" + username,
+		"email":    username + "@zoriya.dev",
+	}).Expect(s.t, http.StatusCreated).Json(s.t, &session)
+	return s.UseSession(session.Token)
+}
+
+func (s *TestServer) Login(username string) string {
+	s.t.Helper()
+	s.Auth = ""
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    username,
+		"password": "password-" + username,
+	}).Expect(s.t, http.StatusCreated).Json(s.t, &session)
+	return s.UseSession(session.Token)
+}
+
+// Decode the claims of a jwt without checking its signature.
+func DecodeJwt(t *testing.T, token string) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("invalid jwt: %s", token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret map[string]any
+	if err = json.Unmarshal(payload, &ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
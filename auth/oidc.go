@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+type AuthMethod string
+
+const (
+	ClientSecretBasic AuthMethod = "ClientSecretBasic"
+	ClientSecretPost  AuthMethod = "ClientSecretPost"
+)
+
+// How long the user has between a call to /login and a call to /callback.
+const OidcRequestTimeout = 10 * time.Minute
+
+type OidcProviderConfig struct {
+	Id               string
+	Name             string
+	Logo             string
+	ClientId         string
+	Secret           string
+	AuthorizationUrl string
+	TokenUrl         string
+	ProfileUrl       string
+	Scope            string
+	AuthMethod       AuthMethod
+	// Some token endpoints do not respect the spec and require a json body instead of a form url encoded.
+	TokenUseJsonBody bool
+	GetProfileUrl    func(profile *OidcProfile) *string
+	GetExtraHeaders  func(prov *OidcProviderConfig) map[string]string
+}
+
+func (p *OidcProviderConfig) Enabled() bool {
+	return p.AuthorizationUrl != "" &&
+		p.TokenUrl != "" &&
+		p.ProfileUrl != "" &&
+		p.ClientId != "" &&
+		p.Secret != ""
+}
+
+var KnownProviders = map[string]OidcProviderConfig{
+	"google": {
+		Name:             "Google",
+		Logo:             "https://logo.clearbit.com/google.com",
+		AuthorizationUrl: "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenUrl:         "https://oauth2.googleapis.com/token",
+		ProfileUrl:       "https://openidconnect.googleapis.com/v1/userinfo",
+		Scope:            "email profile",
+	},
+	"discord": {
+		Name:             "Discord",
+		Logo:             "https://logo.clearbit.com/discord.com",
+		AuthorizationUrl: "https://discord.com/oauth2/authorize",
+		TokenUrl:         "https://discord.com/api/oauth2/token",
+		ProfileUrl:       "https://discord.com/api/users/@me",
+		Scope:            "email identify",
+	},
+	"simkl": {
+		Name:             "Simkl",
+		Logo:             "https://logo.clearbit.com/simkl.com",
+		AuthorizationUrl: "https://simkl.com/oauth/authorize",
+		TokenUrl:         "https://api.simkl.com/oauth/token",
+		ProfileUrl:       "https://api.simkl.com/users/settings",
+		AuthMethod:       ClientSecretPost,
+		TokenUseJsonBody: true,
+		GetProfileUrl: func(profile *OidcProfile) *string {
+			ret := fmt.Sprintf("https://simkl.com/%s/dashboard/", profile.Sub)
+			return &ret
+		},
+		GetExtraHeaders: func(prov *OidcProviderConfig) map[string]string {
+			return map[string]string{"simkl-api-key": prov.ClientId}
+		},
+	},
+	"trakt": {
+		Name:             "Trakt",
+		Logo:             "https://logo.clearbit.com/trakt.tv",
+		AuthorizationUrl: "https://api.trakt.tv/oauth/authorize",
+		TokenUrl:         "https://api.trakt.tv/oauth/token",
+		ProfileUrl:       "https://api.trakt.tv/users/settings",
+		TokenUseJsonBody: true,
+		GetProfileUrl: func(profile *OidcProfile) *string {
+			ret := fmt.Sprintf("https://trakt.tv/users/%s", profile.Username)
+			return &ret
+		},
+		GetExtraHeaders: func(prov *OidcProviderConfig) map[string]string {
+			return map[string]string{"trakt-api-key": prov.ClientId, "trakt-api-version": "2"}
+		},
+	},
+}
+
+func NewOidcProviderConfig(id string) OidcProviderConfig {
+	ret, ok := KnownProviders[id]
+	if !ok {
+		ret = OidcProviderConfig{Name: id}
+	}
+	ret.Id = id
+	ret.AuthMethod = cmp.Or(ret.AuthMethod, ClientSecretBasic)
+	return ret
+}
+
+type Provider struct {
+	// Id of the provider, used in /login/{provider}
+	Id string `json:"id" example:"google"`
+	// Display name of the provider.
+	Name string `json:"name" example:"Google"`
+	// Logo of the provider. Null if unknown.
+	Logo *string `json:"logo" format:"url"`
+}
+
+type OidcToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type OidcProfile struct {
+	Sub        string
+	Username   string
+	Email      string
+	ProfileUrl *string
+}
+
+func (h *Handler) getProvider(c echo.Context) (*OidcProviderConfig, error) {
+	prov, ok := h.config.Oidc[c.Param("provider")]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "No oidc provider registered with this name.")
+	}
+	return &prov, nil
+}
+
+func (h *Handler) oidcRedirectUrl(prov *OidcProviderConfig) string {
+	return fmt.Sprintf("%s%s/logged/%s", h.config.PublicUrl, h.config.Prefix, prov.Id)
+}
+
+// @Summary      List providers
+// @Description  List the oidc providers available on this instance.
+// @Description  Providers of the federated instance (if any) are also listed.
+// @Tags         oidc
+// @Produce      json
+// @Success      200  {object}  []Provider
+// @Router /providers [get]
+func (h *Handler) ListProviders(c echo.Context) error {
+	ret := make([]Provider, 0, len(h.config.Oidc))
+	if h.federated != nil {
+		federated, err := h.federated.List()
+		if err != nil {
+			// the federated instance being down should not prevent local logins.
+			c.Logger().Error(err)
+		}
+		for _, prov := range federated {
+			if _, ok := h.config.Oidc[prov.Id]; !ok {
+				ret = append(ret, prov)
+			}
+		}
+	}
+	for _, prov := range h.config.Oidc {
+		var logo *string
+		if prov.Logo != "" {
+			logo = &prov.Logo
+		}
+		ret = append(ret, Provider{
+			Id:   prov.Id,
+			Name: prov.Name,
+			Logo: logo,
+		})
+	}
+	slices.SortFunc(ret, func(a, b Provider) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return c.JSON(200, ret)
+}
+
+// @Summary      OIDC login
+// @Description  Start an oidc login by redirecting to the provider's login page.
+// @Tags         oidc
+// @Param        provider     path    string  true   "The id of the provider" example(google)
+// @Param        redirectUrl  query   string  true   "Url the user will be redirected to once logged in (with a `token` or `error` query param)"
+// @Param        tenant       query   string  false  "Public url of the instance using this one for federated logins"
+// @Success      302
+// @Failure      400  {object}  problem.Problem "Missing or forbidden redirect url, or invalid tenant"
+// @Failure      403  {object}  problem.Problem "Federated logins are not allowed for this tenant"
+// @Failure      404  {object}  problem.Problem "Unknown provider"
+// @Router /login/{provider} [get]
+func (h *Handler) OidcLogin(c echo.Context) error {
+	redirectUrl := c.QueryParam("redirectUrl")
+	if redirectUrl == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing `redirectUrl` parameter.")
+	}
+	var tenant *string
+	if t := c.QueryParam("tenant"); t != "" {
+		if u, err := url.Parse(t); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `tenant`, it must be the public url of an instance.")
+		}
+		if !h.isTenantAllowed(t) {
+			return echo.NewHTTPError(http.StatusForbidden, "This instance does not allow federated logins for this tenant.")
+		}
+		tenant = &t
+	}
+	if !h.isRedirectAllowed(redirectUrl, tenant) {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			"Invalid `redirectUrl`, it must be on PUBLIC_URL or an origin of KEIBI_ALLOWED_REDIRECTS (or on the tenant for federated logins).",
+		)
+	}
+	federated, err := h.isFederated(c)
+	if err != nil {
+		return err
+	}
+	if federated {
+		return h.federatedLogin(c, redirectUrl)
+	}
+
+	prov, err := h.getProvider(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = h.db.CleanupOidcRequests(ctx, time.Now().UTC().Add(-OidcRequestTimeout))
+	if err != nil {
+		return err
+	}
+	req, err := h.db.CreateOidcRequest(ctx, dbc.CreateOidcRequestParams{
+		Provider:    prov.Id,
+		RedirectUrl: redirectUrl,
+		Tenant:      tenant,
+	})
+	if err != nil {
+		return err
+	}
+
+	auth, err := url.Parse(prov.AuthorizationUrl)
+	if err != nil {
+		return err
+	}
+	query := auth.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", prov.ClientId)
+	query.Set("redirect_uri", h.oidcRedirectUrl(prov))
+	query.Set("state", req.Id.String())
+	if prov.Scope != "" {
+		query.Set("scope", prov.Scope)
+	}
+	auth.RawQuery = query.Encode()
+	return c.Redirect(http.StatusFound, auth.String())
+}
+
+// @Summary      OIDC logged
+// @Description  Callback called by the oidc provider once the user is logged in. Don't call it manually.
+// @Description  Redirects to the `redirectUrl` given to /login with a `token` to use on /callback (or an `error`).
+// @Tags         oidc
+// @Param        provider  path    string  true   "The id of the provider" example(google)
+// @Param        code      query   string  false  "Authorization code given by the provider"
+// @Param        state     query   string  true   "State given to the provider during /login"
+// @Param        error     query   string  false  "Error given by the provider"
+// @Success      302
+// @Failure      400  {object}  problem.Problem "Invalid state"
+// @Failure      404  {object}  problem.Problem "Unknown provider or state"
+// @Router /logged/{provider} [get]
+func (h *Handler) OidcLogged(c echo.Context) error {
+	prov, err := h.getProvider(c)
+	if err != nil {
+		return err
+	}
+	state, err := uuid.Parse(c.QueryParam("state"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid state.")
+	}
+
+	ctx := context.Background()
+	code := c.QueryParam("code")
+	perr := c.QueryParam("error")
+	if perr != "" || code == "" {
+		req, err := h.db.DeleteOidcRequest(ctx, dbc.DeleteOidcRequestParams{
+			Id:       state,
+			Provider: prov.Id,
+		})
+		if err == pgx.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired state.")
+		} else if err != nil {
+			return err
+		}
+		return redirectWithQuery(c, req.RedirectUrl, "error", cmp.Or(perr, "Missing code."))
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	req, err := h.db.SetOidcRequestCode(ctx, dbc.SetOidcRequestCodeParams{
+		Id:       state,
+		Provider: prov.Id,
+		Code:     &code,
+		Token:    &token,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired state.")
+	} else if err != nil {
+		return err
+	}
+	return redirectWithQuery(c, req.RedirectUrl, "token", token)
+}
+
+// The login token is sent to the redirect url, anyone receiving it can login as the user.
+// Only allow relative urls and urls on our own origins.
+// For federated logins, only the tenant's origin is allowed: the tenant is not authenticated but it can only
+// use tokens that were sent to its own origin, so another instance can't claim to be it.
+func (h *Handler) isRedirectAllowed(redirect string, tenant *string) bool {
+	target, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
+	if tenant != nil {
+		u, err := url.Parse(*tenant)
+		return err == nil &&
+			target.Host != "" &&
+			strings.EqualFold(u.Scheme, target.Scheme) &&
+			strings.EqualFold(u.Host, target.Host)
+	}
+	if target.Scheme == "" && target.Host == "" {
+		// browsers treat `/\` like `//` (a protocol relative url).
+		return strings.HasPrefix(redirect, "/") &&
+			!strings.HasPrefix(redirect, "//") &&
+			!strings.HasPrefix(redirect, "/\\")
+	}
+
+	allowed := append([]string{h.config.PublicUrl}, h.config.AllowedRedirects...)
+	return slices.ContainsFunc(allowed, func(origin string) bool {
+		u, err := url.Parse(origin)
+		return err == nil &&
+			u.Host != "" &&
+			strings.EqualFold(u.Scheme, target.Scheme) &&
+			strings.EqualFold(u.Host, target.Host)
+	})
+}
+
+func redirectWithQuery(c echo.Context, redirect string, key string, value string) error {
+	ret, err := url.Parse(redirect)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid redirect url.")
+	}
+	query := ret.Query()
+	query.Set(key, value)
+	ret.RawQuery = query.Encode()
+	return c.Redirect(http.StatusFound, ret.String())
+}
+
+// @Summary      OIDC callback
+// @Description  Exchange the token given to the `redirectUrl` of /login for a session.
+// @Description  If called with a jwt, the provider's account is linked to the current user instead.
+// @Description  If the login was started with a `tenant`, the profile of the user is returned and nothing is stored.
+// @Tags         oidc
+// @Produce      json
+// @Param        provider  path    string  true   "The id of the provider" example(google)
+// @Param        token     query   string  true   "The token received by the redirectUrl"
+// @Param        tenant    query   string  false  "The tenant given to /login, required for federated logins"
+// @Param        device    query   string  false  "The device the created session will be used on"
+// @Success      200  {object}  User "Account linked"
+// @Success      201  {object}  dbc.Session "Logged in"
+// @Success      202  {object}  FederatedProfile "Profile of the user (for federated logins)"
+// @Failure      400  {object}  problem.Problem "Missing token or email from the provider"
+// @Failure      403  {object}  problem.Problem "Invalid or expired token, invalid tenant, or the provider refused the code"
+// @Failure      404  {object}  problem.Problem "Unknown provider"
+// @Failure      409  {object}  problem.Problem "Account already linked to another user or username/email already taken"
+// @Router /callback/{provider} [post]
+func (h *Handler) OidcCallback(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing `token` parameter.")
+	}
+	federated, err := h.isFederated(c)
+	if err != nil {
+		return err
+	}
+	if federated {
+		return h.federatedCallback(c, token)
+	}
+
+	prov, err := h.getProvider(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	req, err := h.db.ConsumeOidcRequest(ctx, dbc.ConsumeOidcRequestParams{
+		Token:    &token,
+		Provider: prov.Id,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid token.")
+	} else if err != nil {
+		return err
+	}
+	if req.CreatedDate.Add(OidcRequestTimeout).Compare(time.Now().UTC()) < 0 {
+		return echo.NewHTTPError(http.StatusForbidden, "Token has expired.")
+	}
+	// a token created for a tenant should never be usable to login locally (and the other way around).
+	tenant := c.QueryParam("tenant")
+	if (req.Tenant == nil && tenant != "") || (req.Tenant != nil && *req.Tenant != tenant) {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid tenant.")
+	}
+
+	profile, tok, err := h.translateCode(prov, *req.Code)
+	if err != nil {
+		return err
+	}
+	if req.Tenant != nil {
+		return c.JSON(http.StatusAccepted, FederatedProfile{
+			Id:         profile.Sub,
+			Username:   profile.Username,
+			Email:      profile.Email,
+			ProfileUrl: profile.ProfileUrl,
+		})
+	}
+	return h.loginOrLink(c, prov.Id, profile, tok)
+}
+
+func (h *Handler) loginOrLink(c echo.Context, provider string, profile *OidcProfile, tok *OidcToken) error {
+	ctx := context.Background()
+	handle := dbc.SaveOidcHandleParams{
+		Provider:   provider,
+		Id:         profile.Sub,
+		Username:   profile.Username,
+		ProfileUrl: profile.ProfileUrl,
+	}
+	if tok != nil {
+		handle.AccessToken = &tok.AccessToken
+		if tok.RefreshToken != "" {
+			handle.RefreshToken = &tok.RefreshToken
+		}
+		if tok.ExpiresIn > 0 {
+			expire := time.Now().UTC().Add(time.Duration(tok.ExpiresIn) * time.Second)
+			handle.ExpireAt = &expire
+		}
+	}
+
+	existing, err := h.db.GetUserByOidc(ctx, dbc.GetUserByOidcParams{
+		Provider: provider,
+		Id:       profile.Sub,
+	})
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	found := err == nil
+
+	if _, logged := c.Get("user").(*jwt.Token); logged {
+		uid, err := GetCurrentUserId(c)
+		if err != nil {
+			return err
+		}
+		if found && existing.Id != uid {
+			return echo.NewHTTPError(http.StatusConflict, "This account is already linked to another user.")
+		}
+		user, err := h.getUser(ctx, uid)
+		if err != nil {
+			return err
+		}
+		handle.UserPk = user.Pk
+		_, err = h.db.SaveOidcHandle(ctx, handle)
+		if err != nil {
+			return err
+		}
+		h.audit(c, AuditEvent{
+			Action:  AuditOidcLink,
+			Outcome: AuditSuccess,
+			Target:  &uid,
+			Details: map[string]any{"provider": provider},
+		})
+		user, err = h.getUser(ctx, uid)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, user)
+	}
+
+	if !found {
+		if profile.Email == "" {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				"Could not find an email for this account. You may need to add more scopes.",
+			)
+		}
+		existing, _, err = h.register(ctx, nil, dbc.CreateUserParams{
+			Username: profile.Username,
+			Email:    profile.Email,
+			Password: nil,
+			// the provider already verified the email.
+			EmailVerified: true,
+		})
+		if ErrIs(err, pgerrcode.UniqueViolation) {
+			return echo.NewHTTPError(
+				http.StatusConflict,
+				"A user already exists with the same username or email. If this is you, login via username and then link your account.",
+			)
+		} else if err != nil {
+			return err
+		}
+		h.audit(c, AuditEvent{
+			Action:  AuditRegister,
+			Outcome: AuditSuccess,
+			Actor:   &existing.Id,
+			Target:  &existing.Id,
+			Details: map[string]any{"method": "oidc", "provider": provider, "pending": existing.Pending},
+		})
+		h.emit(c, WebhookUserCreated, MapDbUser(&existing))
+	}
+
+	handle.UserPk = existing.Pk
+	_, err = h.db.SaveOidcHandle(ctx, handle)
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &existing.Id,
+		Target:  &existing.Id,
+		Details: map[string]any{"method": "oidc", "provider": provider},
+	})
+	user := MapDbUser(&existing)
+	return h.createSession(c, &user)
+}
+
+func (h *Handler) translateCode(prov *OidcProviderConfig, code string) (*OidcProfile, *OidcToken, error) {
+	data := map[string]string{
+		"code":         code,
+		"redirect_uri": h.oidcRedirectUrl(prov),
+		"grant_type":   "authorization_code",
+	}
+	if prov.AuthMethod == ClientSecretPost {
+		data["client_id"] = prov.ClientId
+		data["client_secret"] = prov.Secret
+	}
+
+	var body io.Reader
+	contentType := "application/x-www-form-urlencoded"
+	if prov.TokenUseJsonBody {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	} else {
+		form := url.Values{}
+		for key, value := range data {
+			form.Set(key, value)
+		}
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, prov.TokenUrl, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if prov.AuthMethod == ClientSecretBasic {
+		req.SetBasicAuth(url.QueryEscape(prov.ClientId), url.QueryEscape(prov.Secret))
+	}
+
+	var token OidcToken
+	err = doJson(req, &token)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Invalid code or configuration. %s", err))
+	}
+	if token.AccessToken == "" {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, "Could not retrieve token.")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, prov.ProfileUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenType := token.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenType, token.AccessToken))
+	req.Header.Set("Accept", "application/json")
+	if prov.GetExtraHeaders != nil {
+		for key, value := range prov.GetExtraHeaders(prov) {
+			req.Header.Set(key, value)
+		}
+	}
+
+	var raw map[string]any
+	err = doJson(req, &raw)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Could not retrieve profile. %s", err))
+	}
+	profile := ParseOidcProfile(raw)
+	if profile.Sub == "" {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Missing sub on user object.")
+	}
+	if profile.Username == "" {
+		return nil, nil, echo.NewHTTPError(
+			http.StatusBadRequest,
+			"Could not find a username for the user. You may need to add more scopes.",
+		)
+	}
+	if prov.GetProfileUrl != nil {
+		profile.ProfileUrl = prov.GetProfileUrl(profile)
+	}
+	return profile, &token, nil
+}
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+func doJson(req *http.Request, ret any) error {
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%d: %s", resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+func ParseOidcProfile(raw map[string]any) *OidcProfile {
+	ret := OidcProfile{
+		Sub:      getString(raw, "sub", "uid", "id", "guid"),
+		Username: getString(raw, "username", "preferred_username", "login", "name"),
+		Email:    getString(raw, "email"),
+	}
+
+	// simkl store their ids there.
+	if account, ok := raw["account"].(map[string]any); ok {
+		ret.Sub = cmp.Or(ret.Sub, getString(account, "id"))
+	}
+	if user, ok := raw["user"].(map[string]any); ok {
+		// trakt store their name there (they also store name but that's not the same).
+		// simkl store their name there.
+		ret.Username = cmp.Or(ret.Username, getString(user, "username", "name"))
+		if ids, ok := user["ids"].(map[string]any); ok {
+			ret.Sub = cmp.Or(ret.Sub, getString(ids, "uuid"))
+		}
+	}
+	return &ret
+}
+
+func getString(raw map[string]any, keys ...string) string {
+	for _, key := range keys {
+		switch value := raw[key].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64:
+			return fmt.Sprintf("%.0f", value)
+		}
+	}
+	return ""
+}
+
+// @Summary      Unlink provider
+// @Description  Remove an oidc provider from the current account.
+// @Tags         oidc
+// @Produce      json
+// @Security     Jwt
+// @Param        provider  path    string  true   "The id of the provider" example(google)
+// @Success      200  {object}  User
+// @Failure      404  {object}  problem.Problem "Provider not linked to this account"
+// @Failure      422  {object}  problem.Problem "This is the only login method of this account (or the ldap directory)"
+// @Router /unlink/{provider} [delete]
+func (h *Handler) OidcUnlink(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	provider := c.Param("provider")
+
+	ctx := context.Background()
+	dbuser, err := h.db.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if len(dbuser) == 0 {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid token, user already deleted.")
+	}
+	if provider == LdapProvider && h.isLdapUser(dbuser) {
+		return echo.NewHTTPError(
+			http.StatusUnprocessableEntity,
+			"Can't unlink the ldap directory while it's configured on this instance.",
+		)
+	}
+	if dbuser[0].User.Password == nil && len(dbuser) == 1 && dbuser[0].Provider != nil && *dbuser[0].Provider == provider {
+		return echo.NewHTTPError(
+			http.StatusUnprocessableEntity,
+			"Can't unlink the only login method of an account without password.",
+		)
+	}
+
+	_, err = h.db.DeleteOidcHandle(ctx, dbc.DeleteOidcHandleParams{
+		UserId:   uid,
+		Provider: provider,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "This provider is not linked to your account.")
+	} else if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditOidcUnlink,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"provider": provider},
+	})
+
+	user, err := h.getUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
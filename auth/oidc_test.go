@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Minimal oidc provider, it accepts the code `valid-code` for the client `keibi`.
+func NewMockProvider(t *testing.T, profile map[string]any) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "keibi" || secret != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("code") != "valid-code" || r.FormValue("grant_type") != "authorization_code" {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access-token",
+			"token_type":   "bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(profile)
+	})
+	ret := httptest.NewServer(mux)
+	t.Cleanup(ret.Close)
+	return ret
+}
+
+func MockProviderEnv(provider *httptest.Server) map[string]string {
+	return map[string]string{
+		"OIDC_MOCK_NAME":          "Mock",
+		"OIDC_MOCK_CLIENTID":      "keibi",
+		"OIDC_MOCK_SECRET":        "secret",
+		"OIDC_MOCK_AUTHORIZATION": provider.URL + "/authorize",
+		"OIDC_MOCK_TOKEN":         provider.URL + "/token",
+		"OIDC_MOCK_PROFILE":       provider.URL + "/userinfo",
+	}
+}
+
+// Follow /login & /logged like a browser would and return the token given to the redirect url.
+func OidcLoginToken(t *testing.T, s *TestServer, query string) string {
+	t.Helper()
+	resp := s.Request(http.MethodGet, "/login/mock?"+query, nil).Expect(t, http.StatusFound)
+	auth, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Query().Get("redirect_uri") != s.URL+"/logged/mock" {
+		t.Fatalf("invalid redirect_uri: %s", auth)
+	}
+
+	state := url.QueryEscape(auth.Query().Get("state"))
+	resp = s.Request(http.MethodGet, "/logged/mock?code=valid-code&state="+state, nil).Expect(t, http.StatusFound)
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Path != "/logged-in" || redirect.Query().Get("token") == "" {
+		t.Fatalf("invalid redirect: %s", redirect)
+	}
+	return redirect.Query().Get("token")
+}
+
+func TestOidcLogin(t *testing.T) {
+	provider := NewMockProvider(t, map[string]any{
+		"sub":                "mock-id",
+		"preferred_username": "mock-user",
+		"email":              "mock-user@zoriya.dev",
+	})
+	s := NewTestServer(t, MockProviderEnv(provider))
+
+	var providers []Provider
+	s.Request(http.MethodGet, "/providers", nil).Expect(t, http.StatusOK).Json(t, &providers)
+	if len(providers) != 1 || providers[0].Id != "mock" {
+		t.Fatalf("invalid providers: %v", providers)
+	}
+
+	token := OidcLoginToken(t, s, "redirectUrl=/logged-in")
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/callback/mock?token="+url.QueryEscape(token), nil).
+		Expect(t, http.StatusCreated).
+		Json(t, &session)
+	// the token can only be used once.
+	s.Request(http.MethodPost, "/callback/mock?token="+url.QueryEscape(token), nil).Expect(t, http.StatusForbidden)
+
+	jwt := DecodeJwt(t, s.UseSession(session.Token))
+	var me User
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &me)
+	if me.Id.String() != jwt["sub"] ||
+		me.Username != "mock-user" ||
+		me.Email != "mock-user@zoriya.dev" ||
+		len(me.Oidc) != 1 {
+		t.Fatalf("invalid user: %+v", me)
+	}
+
+	// logging in again uses the same account.
+	token = OidcLoginToken(t, s, "redirectUrl=/logged-in")
+	s.Auth = ""
+	s.Request(http.MethodPost, "/callback/mock?token="+url.QueryEscape(token), nil).
+		Expect(t, http.StatusCreated).
+		Json(t, &session)
+	if DecodeJwt(t, s.UseSession(session.Token))["sub"] != jwt["sub"] {
+		t.Fatal("a second account was created")
+	}
+}
+
+func TestOidcRedirectUrl(t *testing.T) {
+	provider := NewMockProvider(t, map[string]any{"sub": "mock-id", "username": "mock-user"})
+	s := NewTestServer(t, MockProviderEnv(provider))
+
+	for _, redirect := range []string{
+		"https://evil.com/logged-in",
+		"//evil.com/logged-in",
+		"/\\evil.com/logged-in",
+		"javascript:alert(1)",
+	} {
+		s.Request(http.MethodGet, "/login/mock?redirectUrl="+url.QueryEscape(redirect), nil).
+			Expect(t, http.StatusBadRequest)
+	}
+	s.Request(http.MethodGet, "/login/mock?redirectUrl="+url.QueryEscape(s.URL+"/logged-in"), nil).
+		Expect(t, http.StatusFound)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	TotpPeriod = 30
+	TotpDigits = 6
+	TotpSkew   = 1
+	// Claim admins can set to force users to enable 2fa.
+	OtpRequiredClaim = "otpRequired"
+
+	OtpChallengeTimeout     = 5 * time.Minute
+	OtpChallengeMaxAttempts = 5
+	OtpRecoveryCodesCount   = 10
+)
+
+var otpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type OtpSecret struct {
+	// Base32 encoded secret, to type in an authenticator app.
+	Secret string `json:"secret"`
+	// otpauth:// uri of the secret, to display as a qrcode.
+	Uri string `json:"uri" example:"otpauth://totp/kyoo:zoriya?secret=JBSWY3DPEHPK3PXP&issuer=kyoo"`
+}
+
+type OtpRecoveryCodes struct {
+	// Single use codes that can be used instead of an otp code. They are only shown once.
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type OtpChallenge struct {
+	// Token to send to POST /sessions/otp with a code from your authenticator app.
+	Challenge string `json:"challenge"`
+	// When does this challenge expire.
+	ExpireAt time.Time `json:"expireAt"`
+	// True if the user needs to enroll 2fa before logging in, `secret` and `uri` are set in this case.
+	Enroll bool `json:"enroll"`
+	// Secret to register in an authenticator app (only if `enroll` is true).
+	Secret *string `json:"secret,omitempty"`
+	// otpauth:// uri of the secret (only if `enroll` is true).
+	Uri *string `json:"uri,omitempty"`
+}
+
+type OtpSession struct {
+	dbc.Session
+	// Recovery codes, only set if 2fa was enrolled during this login. They are only shown once.
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+type OtpCodeDto struct {
+	// A code from your authenticator app or a recovery code.
+	Code string `json:"code" validate:"required"`
+}
+
+type OtpLoginDto struct {
+	// The challenge returned by POST /sessions.
+	Challenge string `json:"challenge" validate:"required"`
+	// A code from your authenticator app or a recovery code.
+	Code string `json:"code" validate:"required"`
+}
+
+func GenerateTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return otpEncoding.EncodeToString(secret), nil
+}
+
+func TotpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation from rfc4226
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TotpDigits, code%1_000_000)
+}
+
+// Check a totp code, returning the time step that matched.
+func ValidateTotp(secret string, code string, now time.Time) (int64, bool) {
+	key, err := otpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TotpDigits {
+		return 0, false
+	}
+	counter := now.Unix() / TotpPeriod
+	for i := -TotpSkew; i <= TotpSkew; i++ {
+		if hmac.Equal([]byte(TotpCode(key, counter+int64(i))), []byte(code)) {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+func (h *Handler) totpUri(user *dbc.User, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", h.config.Issuer, user.Username))
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", h.config.Issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TotpDigits))
+	query.Set("period", fmt.Sprint(TotpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func isOtpRequired(user *dbc.User) bool {
+	required, _ := user.Claims[OtpRequiredClaim].(bool)
+	return required
+}
+
+// Check an otp code or a recovery code. Codes can only be used once.
+func (h *Handler) checkOtp(ctx context.Context, user *dbc.User, code string) (bool, error) {
+	if user.OtpSecret == nil {
+		return false, nil
+	}
+	if counter, ok := ValidateTotp(*user.OtpSecret, strings.TrimSpace(code), time.Now()); ok {
+		rows, err := h.db.UseOtpCounter(ctx, dbc.UseOtpCounterParams{
+			Pk:      user.Pk,
+			Counter: &counter,
+		})
+		return rows == 1, err
+	}
+	if !user.OtpEnabled {
+		return false, nil
+	}
+	rows, err := h.db.UseOtpRecoveryCode(ctx, dbc.UseOtpRecoveryCodeParams{
+		UserPk: user.Pk,
+		Code:   HashToken(normalizeRecoveryCode(code)),
+	})
+	return rows == 1, err
+}
+
+func (h *Handler) createRecoveryCodes(ctx context.Context, user *dbc.User) ([]string, error) {
+	err := h.db.DeleteOtpRecoveryCodes(ctx, user.Pk)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, OtpRecoveryCodesCount)
+	for range OtpRecoveryCodesCount {
+		raw := make([]byte, 5)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, err
+		}
+		code := otpEncoding.EncodeToString(raw)
+		err = h.db.CreateOtpRecoveryCode(ctx, dbc.CreateOtpRecoveryCodeParams{
+			UserPk: user.Pk,
+			Code:   HashToken(code),
+		})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fmt.Sprintf("%s-%s", code[:4], code[4:]))
+	}
+	return ret, nil
+}
+
+func (h *Handler) getOtpUser(ctx context.Context, c echo.Context) (*dbc.User, error) {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return nil, err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return nil, err
+	}
+	dbuser, err := h.db.GetUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(dbuser) == 0 {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Invalid token, user already deleted.")
+	}
+	return &dbuser[0].User, nil
+}
+
+func (h *Handler) createOtpChallenge(c echo.Context, user *dbc.User) error {
+	ctx := context.Background()
+	err := h.db.CleanupOtpChallenges(ctx, time.Now().UTC().Add(-OtpChallengeTimeout))
+	if err != nil {
+		return err
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	// the secret is kept on the challenge until a code is validated, a login without the
+	// second factor must not be able to change the secret of the user.
+	var secret *string
+	if !user.OtpEnabled {
+		s, err := GenerateTotpSecret()
+		if err != nil {
+			return err
+		}
+		secret = &s
+	}
+	challenge, err := h.db.CreateOtpChallenge(ctx, dbc.CreateOtpChallengeParams{
+		Token:     HashToken(token),
+		UserPk:    user.Pk,
+		OtpSecret: secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	ret := OtpChallenge{
+		Challenge: token,
+		ExpireAt:  challenge.CreatedDate.Add(OtpChallengeTimeout),
+		Enroll:    !user.OtpEnabled,
+	}
+	if secret != nil {
+		uri := h.totpUri(user, *secret)
+		ret.Secret = secret
+		ret.Uri = &uri
+	}
+	return c.JSON(http.StatusAccepted, ret)
+}
+
+// @Summary      Login with otp
+// @Description  Finish a login started with POST /sessions for accounts with 2fa enabled.
+// @Description  If 2fa was enrolled during this login, recovery codes are returned with the session.
+// @Tags         sessions
+// @Accept       json
+// @Produce      json
+// @Param        device  query   string       false  "The device the created session will be used on"
+// @Param        login   body    OtpLoginDto  false  "Challenge and otp code"
+// @Success      201  {object}   OtpSession
+// @Failure      400  {object}   problem.Problem "Invalid body"
+// @Failure      403  {object}   problem.Problem "Invalid code, invalid/expired challenge or too many attempts"
+// @Failure      429  {object}   problem.Problem "Too many failed attempts for this account, see the Retry-After header"
+// @Router /sessions/otp [post]
+func (h *Handler) OtpLogin(c echo.Context) error {
+	var req OtpLoginDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	challenge, err := h.db.GetOtpChallenge(ctx, HashToken(req.Challenge))
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid challenge.")
+	} else if err != nil {
+		return err
+	}
+	if challenge.OtpChallenge.CreatedDate.Add(OtpChallengeTimeout).Compare(time.Now().UTC()) < 0 {
+		_, err = h.db.DeleteOtpChallenge(ctx, challenge.OtpChallenge.Pk)
+		if err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusForbidden, "Challenge has expired, please login again.")
+	}
+	// codes also count as attempts of the account, new challenges can't be used to try more codes.
+	account := challenge.User.Id.String()
+	err = h.reserveAttempt(ctx, c, AccountAttempts, account, h.config.LoginMaxAttempts)
+	if err != nil {
+		return err
+	}
+	// reserve the attempt before checking the code so concurrent requests can't go over the limit.
+	rows, err := h.db.UseOtpChallengeAttempt(ctx, dbc.UseOtpChallengeAttemptParams{
+		Pk:          challenge.OtpChallenge.Pk,
+		MaxAttempts: OtpChallengeMaxAttempts,
+	})
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		_, err = h.db.DeleteOtpChallenge(ctx, challenge.OtpChallenge.Pk)
+		if err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusForbidden, "Too many attempts, please login again.")
+	}
+
+	var ok bool
+	var counter int64
+	enroll := challenge.OtpChallenge.OtpSecret
+	if enroll != nil {
+		counter, ok = ValidateTotp(*enroll, strings.TrimSpace(req.Code), time.Now())
+	} else {
+		ok, err = h.checkOtp(ctx, &challenge.User, req.Code)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		h.audit(c, AuditEvent{
+			Action:  AuditLogin,
+			Outcome: AuditFailure,
+			Target:  &challenge.User.Id,
+			Details: map[string]any{"method": "otp", "reason": "invalid code"},
+		})
+		if err = h.failAttempt(ctx, AccountAttempts, account, h.config.LoginMaxAttempts); err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid code.")
+	}
+
+	// a challenge can only be used once, another request may have used it since we read it.
+	rows, err = h.db.DeleteOtpChallenge(ctx, challenge.OtpChallenge.Pk)
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid challenge.")
+	}
+	err = h.db.ClearLoginAttempts(ctx, dbc.ClearLoginAttemptsParams{
+		Kind:   AccountAttempts,
+		Target: account,
+	})
+	if err != nil {
+		return err
+	}
+	var codes []string
+	if enroll != nil {
+		// user enrolled during login since 2fa is required for their account.
+		err = h.db.EnrollOtp(ctx, dbc.EnrollOtpParams{
+			Pk:        challenge.User.Pk,
+			OtpSecret: enroll,
+			Counter:   &counter,
+		})
+		if err != nil {
+			return err
+		}
+		h.audit(c, AuditEvent{
+			Action:  AuditOtpEnable,
+			Outcome: AuditSuccess,
+			Actor:   &challenge.User.Id,
+			Target:  &challenge.User.Id,
+		})
+		codes, err = h.createRecoveryCodes(ctx, &challenge.User)
+		if err != nil {
+			return err
+		}
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &challenge.User.Id,
+		Target:  &challenge.User.Id,
+		Details: map[string]any{"method": "otp"},
+	})
+	user := MapDbUser(&challenge.User)
+	session, err := h.newSession(c, &user, getDevice(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, OtpSession{Session: *session, RecoveryCodes: codes})
+}
+
+// @Summary      Enroll otp
+// @Description  Generate a new otp secret for your account. 2fa is enabled once a code is sent to POST /users/me/otp/confirm.
+// @Tags         otp
+// @Produce      json
+// @Security     Jwt
+// @Success      200  {object}  OtpSecret
+// @Failure      409  {object}  problem.Problem "2fa is already enabled"
+// @Router /users/me/otp [post]
+func (h *Handler) EnrollOtp(c echo.Context) error {
+	ctx := context.Background()
+	user, err := h.getOtpUser(ctx, c)
+	if err != nil {
+		return err
+	}
+	if user.OtpEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "2fa is already enabled, disable it first to create a new secret.")
+	}
+
+	secret, err := GenerateTotpSecret()
+	if err != nil {
+		return err
+	}
+	_, err = h.db.SetOtpSecret(ctx, dbc.SetOtpSecretParams{
+		Pk:        user.Pk,
+		OtpSecret: &secret,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, OtpSecret{
+		Secret: secret,
+		Uri:    h.totpUri(user, secret),
+	})
+}
+
+// @Summary      Confirm otp
+// @Description  Enable 2fa by sending a code generated with the secret returned by POST /users/me/otp.
+// @Tags         otp
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        code  body  OtpCodeDto  false  "A code from your authenticator app"
+// @Success      200  {object}  OtpRecoveryCodes
+// @Failure      403  {object}  problem.Problem "Invalid code"
+// @Failure      409  {object}  problem.Problem "2fa is already enabled"
+// @Failure      422  {object}  problem.Problem "No otp secret, call POST /users/me/otp first"
+// @Router /users/me/otp/confirm [post]
+func (h *Handler) ConfirmOtp(c echo.Context) error {
+	var req OtpCodeDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	user, err := h.getOtpUser(ctx, c)
+	if err != nil {
+		return err
+	}
+	if user.OtpEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "2fa is already enabled.")
+	}
+	if user.OtpSecret == nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "No otp secret, call POST /users/me/otp first.")
+	}
+	ok, err := h.checkOtp(ctx, user, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid code.")
+	}
+
+	err = h.db.EnableOtp(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditOtpEnable,
+		Outcome: AuditSuccess,
+		Target:  &user.Id,
+	})
+	codes, err := h.createRecoveryCodes(ctx, user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, OtpRecoveryCodes{RecoveryCodes: codes})
+}
+
+// @Summary      Regenerate recovery codes
+// @Description  Invalidate your recovery codes and create new ones.
+// @Tags         otp
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        code  body  OtpCodeDto  false  "A code from your authenticator app or a recovery code"
+// @Success      200  {object}  OtpRecoveryCodes
+// @Failure      403  {object}  problem.Problem "Invalid code"
+// @Failure      422  {object}  problem.Problem "2fa is not enabled"
+// @Router /users/me/otp/recovery-codes [post]
+func (h *Handler) RegenerateRecoveryCodes(c echo.Context) error {
+	var req OtpCodeDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	user, err := h.getOtpUser(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !user.OtpEnabled {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "2fa is not enabled.")
+	}
+	ok, err := h.checkOtp(ctx, user, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid code.")
+	}
+
+	codes, err := h.createRecoveryCodes(ctx, user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, OtpRecoveryCodes{RecoveryCodes: codes})
+}
+
+// @Summary      Disable otp
+// @Description  Disable 2fa for your account.
+// @Tags         otp
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        code  body  OtpCodeDto  false  "A code from your authenticator app or a recovery code"
+// @Success      200  {object}  User
+// @Failure      403  {object}  problem.Problem "Invalid code or 2fa is required for this account"
+// @Failure      422  {object}  problem.Problem "2fa is not enabled"
+// @Router /users/me/otp [delete]
+func (h *Handler) DisableOtp(c echo.Context) error {
+	var req OtpCodeDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	user, err := h.getOtpUser(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !user.OtpEnabled {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "2fa is not enabled.")
+	}
+	if isOtpRequired(user) {
+		return echo.NewHTTPError(http.StatusForbidden, "2fa is required for your account.")
+	}
+	ok, err := h.checkOtp(ctx, user, req.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid code.")
+	}
+
+	return h.disableOtp(c, user.Id, user.Pk)
+}
+
+// @Summary      Reset otp
+// @Description  Disable 2fa of another user (if they lost their authenticator app and recovery codes for example).
+// @Tags         otp
+// @Produce      json
+// @Security     Jwt[users.write]
+// @Param        id   path      string  true  "The id of the user" Format(uuid)
+// @Success      200  {object}  User
+// @Failure      403  {object}  problem.Problem "Missing users.write permission"
+// @Failure      404  {object}  problem.Problem "No user with the given id found"
+// @Router /users/{id}/otp [delete]
+func (h *Handler) ResetOtp(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.write"})
+	if err != nil {
+		return err
+	}
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	dbuser, err := h.db.GetUser(context.Background(), uid)
+	if err != nil {
+		return err
+	}
+	if len(dbuser) == 0 {
+		return echo.NewHTTPError(404, "No user found with given id")
+	}
+	return h.disableOtp(c, uid, dbuser[0].User.Pk)
+}
+
+func (h *Handler) disableOtp(c echo.Context, id uuid.UUID, pk int32) error {
+	ctx := context.Background()
+	err := h.db.DisableOtp(ctx, pk)
+	if err != nil {
+		return err
+	}
+	err = h.db.DeleteOtpRecoveryCodes(ctx, pk)
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditOtpDisable,
+		Outcome: AuditSuccess,
+		Target:  &id,
+	})
+	user, err := h.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Register a user that needs to enroll 2fa and start a login.
+func otpRequiredUser(t *testing.T, s *TestServer, username string) {
+	t.Helper()
+	s.Register("admin")
+	var user User
+	s.Register(username)
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &user)
+	s.Login("admin")
+	s.Request(http.MethodPatch, "/users/"+user.Id.String(), map[string]any{
+		"claims": map[string]any{OtpRequiredClaim: true},
+	}).Expect(t, http.StatusOK)
+	s.Auth = ""
+}
+
+func otpChallenge(t *testing.T, s *TestServer, username string) OtpChallenge {
+	t.Helper()
+	var ret OtpChallenge
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    username,
+		"password": "password-" + username,
+	}).Expect(t, http.StatusAccepted).Json(t, &ret)
+	return ret
+}
+
+func totpNow(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := otpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TotpCode(key, time.Now().Unix()/TotpPeriod)
+}
+
+func TestOtpEnrollDuringLogin(t *testing.T) {
+	s := NewTestServer(t, nil)
+	otpRequiredUser(t, s, "otp-user")
+
+	first := otpChallenge(t, s, "otp-user")
+	if !first.Enroll || first.Secret == nil {
+		t.Fatalf("expected an enrollment challenge: %+v", first)
+	}
+	// logging in again (without the second factor) must not replace the secret of the first challenge.
+	second := otpChallenge(t, s, "otp-user")
+	if second.Secret == nil || *second.Secret == *first.Secret {
+		t.Fatalf("expected a new secret: %+v", second)
+	}
+
+	var session OtpSession
+	s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+		"challenge": first.Challenge,
+		"code":      totpNow(t, *first.Secret),
+	}).Expect(t, http.StatusCreated).Json(t, &session)
+	if session.Token == "" || len(session.RecoveryCodes) != OtpRecoveryCodesCount {
+		t.Fatalf("expected a session with recovery codes: %+v", session)
+	}
+	// the secret of the other challenge was never enabled.
+	s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+		"challenge": second.Challenge,
+		"code":      totpNow(t, *second.Secret),
+	}).Expect(t, http.StatusForbidden)
+
+	// next logins use the enrolled secret or the recovery codes.
+	challenge := otpChallenge(t, s, "otp-user")
+	if challenge.Enroll || challenge.Secret != nil {
+		t.Fatalf("2fa should be enabled: %+v", challenge)
+	}
+	s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+		"challenge": challenge.Challenge,
+		"code":      session.RecoveryCodes[0],
+	}).Expect(t, http.StatusCreated).Json(t, &session)
+	if session.RecoveryCodes != nil {
+		t.Fatal("recovery codes should only be returned on enrollment")
+	}
+}
+
+func TestOtpAttempts(t *testing.T) {
+	s := NewTestServer(t, nil)
+	otpRequiredUser(t, s, "otp-user")
+	challenge := otpChallenge(t, s, "otp-user")
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	invalid := 0
+	for range 3 * OtpChallengeMaxAttempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+				"challenge": challenge.Challenge,
+				"code":      "000000",
+			})
+			var body struct{ Detail string }
+			resp.Json(t, &body)
+			lock.Lock()
+			defer lock.Unlock()
+			if body.Detail == "Invalid code." {
+				invalid++
+			}
+		}()
+	}
+	wg.Wait()
+	if invalid > OtpChallengeMaxAttempts {
+		t.Fatalf("%d codes were checked, the limit is %d", invalid, OtpChallengeMaxAttempts)
+	}
+
+	s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+		"challenge": challenge.Challenge,
+		"code":      totpNow(t, *challenge.Secret),
+	}).Expect(t, http.StatusForbidden)
+}
+
+func TestOtpAccountLockout(t *testing.T) {
+	s := NewTestServer(t, nil)
+	otpRequiredUser(t, s, "otp-user")
+	enroll := otpChallenge(t, s, "otp-user")
+	s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+		"challenge": enroll.Challenge,
+		"code":      totpNow(t, *enroll.Secret),
+	}).Expect(t, http.StatusCreated)
+
+	// new challenges don't give more attempts, codes count as failures of the account.
+	invalid := 0
+	for range 2 * s.h.config.LoginMaxAttempts {
+		resp := s.Request(http.MethodPost, "/sessions", map[string]string{
+			"login":    "otp-user",
+			"password": "password-otp-user",
+		})
+		if resp.Status == http.StatusTooManyRequests {
+			break
+		}
+		var challenge OtpChallenge
+		resp.Expect(t, http.StatusAccepted).Json(t, &challenge)
+		resp = s.Request(http.MethodPost, "/sessions/otp", map[string]string{
+			"challenge": challenge.Challenge,
+			"code":      "000000",
+		})
+		if resp.Status == http.StatusForbidden {
+			invalid++
+		}
+	}
+	if invalid >= s.h.config.LoginMaxAttempts {
+		t.Fatalf("%d codes were checked, the limit is %d", invalid, s.h.config.LoginMaxAttempts)
+	}
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "otp-user",
+		"password": "password-otp-user",
+	}).Expect(t, http.StatusTooManyRequests)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 250
+)
+
+type Page[T any] struct {
+	// Items of this page.
+	Items []T `json:"items"`
+	// Link to this page.
+	This string `json:"this" example:"/users?limit=20"`
+	// Link to the next page, null if this is the last page.
+	Next *string `json:"next" example:"/users?after=eyJpZCI6Ii4uLiJ9&limit=20"`
+}
+
+// Create a page from the items of a request, the next link uses the cursor of the last item in the `after` query param.
+func NewPage[T any](c echo.Context, items []T, limit int32, cursor func(*T) (string, error)) (Page[T], error) {
+	req := c.Request()
+	ret := Page[T]{
+		Items: items,
+		This:  req.URL.RequestURI(),
+	}
+	if ret.Items == nil {
+		ret.Items = make([]T, 0)
+	}
+	if len(items) < int(limit) || len(items) == 0 {
+		return ret, nil
+	}
+
+	after, err := cursor(&items[len(items)-1])
+	if err != nil {
+		return ret, err
+	}
+	query := req.URL.Query()
+	query.Set("after", after)
+	next := fmt.Sprintf("%s?%s", req.URL.Path, query.Encode())
+	ret.Next = &next
+	return ret, nil
+}
+
+func GetPageLimit(c echo.Context) (int32, error) {
+	param := c.QueryParam("limit")
+	if param == "" {
+		return DefaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > MaxPageSize {
+		return 0, echo.NewHTTPError(400, fmt.Sprintf("Invalid `limit` parameter, expected a number between 1 and %d", MaxPageSize))
+	}
+	return int32(limit), nil
+}
+
+func EncodeCursor(cursor any) (string, error) {
+	ret, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(ret), nil
+}
+
+func DecodeCursor(cursor string, ret any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid `after` parameter")
+	}
+	err = json.Unmarshal(raw, ret)
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid `after` parameter")
+	}
+	return nil
+}
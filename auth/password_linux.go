@@ -0,0 +1,22 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Run `read` with the echo of the terminal `fd` disabled, ok is false if `fd` is not a terminal.
+func withoutEcho(fd int, read func() (string, error)) (ret string, ok bool, err error) {
+	state, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return "", false, nil
+	}
+	noecho := *state
+	noecho.Lflag &^= unix.ECHO
+	noecho.Lflag |= unix.ICANON | unix.ISIG
+	if err = unix.IoctlSetTermios(fd, unix.TCSETS, &noecho); err != nil {
+		return "", true, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, state)
+	ret, err = read()
+	return ret, true, err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Only implemented on linux, the password is read like any other input (pipe it to avoid echoing it).
+func withoutEcho(fd int, read func() (string, error)) (string, bool, error) {
+	return "", false, nil
+}
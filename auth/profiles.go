@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const ProfileAttempts = "profile"
+
+// Claims set by keibi that profiles can't override.
+var ReservedClaims = []string{"sub", "sid", "iss", "aud", "exp", "nbf", "iat", "jti", "act", "permissions", "roles", "profile"}
+
+type Profile struct {
+	// Id of the profile.
+	Id uuid.UUID `json:"id"`
+	// Name displayed in the profile picker.
+	Name string `json:"name" example:"kids"`
+	// Is a pin required to switch to this profile?
+	HasPin bool `json:"hasPin"`
+	// Claims added to jwts created while this profile is active.
+	Claims jwt.MapClaims `json:"claims" example:"maxRating:PG-13"`
+	// When was this profile created?
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+type ProfileDto struct {
+	// Name displayed in the profile picker.
+	Name string `json:"name" validate:"required,max=256" example:"kids"`
+	// Pin required to switch to this profile (4 to 8 digits), omit for a profile without pin.
+	Pin *string `json:"pin,omitempty" validate:"omitnil,numeric,min=4,max=8" example:"1234"`
+	// Claims added to jwts created while this profile is active (a maximum content rating for example).
+	Claims jwt.MapClaims `json:"claims,omitempty"`
+}
+
+type EditProfileDto struct {
+	// New name of the profile.
+	Name *string `json:"name,omitempty" validate:"omitnil,min=1,max=256" example:"kids"`
+	// New pin of the profile (4 to 8 digits), use an empty string to remove it.
+	Pin *string `json:"pin,omitempty" example:"1234"`
+	// New claims of the profile, replaces the previous ones.
+	Claims jwt.MapClaims `json:"claims,omitempty"`
+}
+
+type SwitchProfileDto struct {
+	// Id of the profile to use, null to go back to the account.
+	Profile *uuid.UUID `json:"profile" format:"uuid"`
+	// Pin of the profile, required if the profile has one (unless you are switching from the account).
+	Pin *string `json:"pin,omitempty" example:"1234"`
+	// Password of the account, required to go back to the account from a profile.
+	Password *string `json:"password,omitempty"`
+}
+
+func MapProfile(profile *dbc.Profile) Profile {
+	return Profile{
+		Id:          profile.Id,
+		Name:        profile.Name,
+		HasPin:      profile.Pin != nil,
+		Claims:      profile.Claims,
+		CreatedDate: profile.CreatedDate,
+	}
+}
+
+// Get the profile active in the current jwt, nil if the jwt was not created from a profile.
+func GetCurrentProfileId(c echo.Context) (*uuid.UUID, error) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return nil, echo.NewHTTPError(401, "Unauthorized")
+	}
+	profile, ok := token.Claims.(jwt.MapClaims)["profile"].(string)
+	if !ok {
+		return nil, nil
+	}
+	ret, err := uuid.Parse(profile)
+	if err != nil {
+		return nil, echo.NewHTTPError(400, "Invalid profile id")
+	}
+	return &ret, nil
+}
+
+// Actions on the whole account (managing profiles, deleting the account...) can't be done from a profile
+// or while an admin impersonates the user.
+func RequireAccountSession(c echo.Context) error {
+	profile, err := GetCurrentProfileId(c)
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		return echo.NewHTTPError(
+			http.StatusForbidden,
+			"This can't be done from a profile, switch back to your account first.",
+		)
+	}
+	admin, err := GetImpersonatorId(c)
+	if err != nil {
+		return err
+	}
+	if admin != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "This can't be done while impersonating a user.")
+	}
+	return nil
+}
+
+// Profiles can only add claims, they can't override reserved claims, the ones set via
+// KEIBI_JWT_CLAIMS or the claims of the user (set by admins).
+func (h *Handler) validateProfileClaims(ctx context.Context, uid uuid.UUID, claims jwt.MapClaims) error {
+	if len(claims) == 0 {
+		return nil
+	}
+	user, err := h.getUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	for key := range claims {
+		_, jwtClaim := h.config.JwtClaims[key]
+		_, userClaim := user.Claims[key]
+		if slices.Contains(ReservedClaims, key) || jwtClaim || userClaim {
+			return echo.NewHTTPError(
+				http.StatusUnprocessableEntity,
+				fmt.Sprintf("The `%s` claim can't be set on a profile.", key),
+			)
+		}
+	}
+	return nil
+}
+
+func isValidPin(pin string) bool {
+	if len(pin) < 4 || len(pin) > 8 {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func hashPin(pin *string) (*string, error) {
+	if pin == nil || *pin == "" {
+		return nil, nil
+	}
+	ret, err := argon2id.CreateHash(*pin, argon2id.DefaultParams)
+	return &ret, err
+}
+
+// @Summary      List my profiles
+// @Description  List the profiles of your account.
+// @Tags         profiles
+// @Produce      json
+// @Security     Jwt
+// @Success      200  {object}  []Profile
+// @Failure      401  {object}  problem.Problem "Missing jwt token"
+// @Router /users/me/profiles [get]
+func (h *Handler) ListProfiles(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := h.db.ListProfiles(context.Background(), uid)
+	if err != nil {
+		return err
+	}
+	ret := make([]Profile, 0, len(profiles))
+	for _, profile := range profiles {
+		ret = append(ret, MapProfile(&profile))
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+// @Summary      Create profile
+// @Description  Create a new profile in your account. This can't be done while a profile is active.
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        profile  body  ProfileDto  false  "Profile informations"
+// @Success      201  {object}  Profile
+// @Failure      400  {object}  problem.Problem "Invalid create body"
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      409  {object}  problem.Problem "A profile with the same name already exists"
+// @Failure      422  {object}  problem.Problem "Reserved claim or claim already set on the user"
+// @Router /users/me/profiles [post]
+func (h *Handler) CreateProfile(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+
+	var req ProfileDto
+	err = c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+	if err = h.validateProfileClaims(context.Background(), uid, req.Claims); err != nil {
+		return err
+	}
+	if req.Claims == nil {
+		req.Claims = make(jwt.MapClaims)
+	}
+	pin, err := hashPin(req.Pin)
+	if err != nil {
+		return err
+	}
+
+	profile, err := h.db.CreateProfile(context.Background(), dbc.CreateProfileParams{
+		UserId: uid,
+		Name:   req.Name,
+		Pin:    pin,
+		Claims: req.Claims,
+	})
+	if ErrIs(err, pgerrcode.UniqueViolation) {
+		return echo.NewHTTPError(409, "A profile with the same name already exists.")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(201, MapProfile(&profile))
+}
+
+// @Summary      Edit profile
+// @Description  Edit a profile of your account. This can't be done while a profile is active.
+// @Tags         profiles
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        id       path  string          true   "Id of the profile" Format(uuid)
+// @Param        profile  body  EditProfileDto  false  "Edited informations"
+// @Success      200  {object}  Profile
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "No profile with the given id"
+// @Failure      409  {object}  problem.Problem "A profile with the same name already exists"
+// @Failure      422  {object}  problem.Problem "Reserved claim or claim already set on the user"
+// @Router /users/me/profiles/{id} [patch]
+func (h *Handler) EditProfile(c echo.Context) error {
+	ctx := context.Background()
+	profile, err := h.getMyProfile(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	var req EditProfileDto
+	err = c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	params := dbc.UpdateProfileParams{
+		Pk:     profile.Pk,
+		Name:   profile.Name,
+		Pin:    profile.Pin,
+		Claims: profile.Claims,
+	}
+	if req.Name != nil {
+		params.Name = *req.Name
+	}
+	if req.Pin != nil {
+		if *req.Pin != "" && !isValidPin(*req.Pin) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid pin, expected 4 to 8 digits.")
+		}
+		params.Pin, err = hashPin(req.Pin)
+		if err != nil {
+			return err
+		}
+	}
+	if req.Claims != nil {
+		uid, err := GetCurrentUserId(c)
+		if err != nil {
+			return err
+		}
+		if err = h.validateProfileClaims(ctx, uid, req.Claims); err != nil {
+			return err
+		}
+		params.Claims = req.Claims
+	}
+
+	updated, err := h.db.UpdateProfile(ctx, params)
+	if ErrIs(err, pgerrcode.UniqueViolation) {
+		return echo.NewHTTPError(409, "A profile with the same name already exists.")
+	} else if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, MapProfile(&updated))
+}
+
+// @Summary      Delete profile
+// @Description  Delete a profile of your account, sessions using it are closed. This can't be done while a profile is active.
+// @Tags         profiles
+// @Produce      json
+// @Security     Jwt
+// @Param        id   path      string  true  "Id of the profile" Format(uuid)
+// @Success      200  {object}  Profile
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "No profile with the given id"
+// @Router /users/me/profiles/{id} [delete]
+func (h *Handler) DeleteProfile(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	ctx := context.Background()
+	sessions, err := h.db.DeleteProfileSessions(ctx, dbc.DeleteProfileSessionsParams{
+		Id:     id,
+		UserId: uid,
+	})
+	if err != nil {
+		return err
+	}
+	profile, err := h.db.DeleteProfile(ctx, dbc.DeleteProfileParams{
+		Id:     id,
+		UserId: uid,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No profile found with given id")
+	} else if err != nil {
+		return err
+	}
+	h.emitSessions(c, WebhookSessionDeleted, uid, sessions)
+	_ = h.logos.Delete(ctx, profile.Id)
+	return c.JSON(http.StatusOK, MapProfile(&profile))
+}
+
+// Get a profile of the current user from the `id` param, only allowed from the account session.
+func (h *Handler) getMyProfile(ctx context.Context, c echo.Context) (dbc.Profile, error) {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return dbc.Profile{}, err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return dbc.Profile{}, err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return dbc.Profile{}, echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	profile, err := h.db.GetProfile(ctx, dbc.GetProfileParams{
+		Id:     id,
+		UserId: uid,
+	})
+	if err == pgx.ErrNoRows {
+		return profile, echo.NewHTTPError(404, "No profile found with given id")
+	}
+	return profile, err
+}
+
+// @Summary      Get profile logo
+// @Description  Get the logo of a profile. A generated logo is returned if none was uploaded.
+// @Tags         profiles
+// @Produce      png
+// @Param        id    path    string  true   "The id of the profile" Format(uuid)
+// @Param        size  query   int     false  "Size of the logo (in px)" Enums(64, 256, 512)
+// @Success      200  {file}    binary
+// @Success      304
+// @Failure      400  {object}  problem.Problem "Invalid id or size"
+// @Router /profiles/{id}/logo [get]
+func (h *Handler) GetProfileLogo(c echo.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	return h.serveLogo(c, id)
+}
+
+// @Summary      Upload profile logo
+// @Description  Upload a logo for a profile of your account. The image can be sent as the raw body or as the `logo` field of a multipart form.
+// @Tags         profiles
+// @Accept       png,jpeg,gif,octet-stream,mpfd
+// @Security     Jwt
+// @Param        id    path    string  true   "The id of the profile" Format(uuid)
+// @Success      204
+// @Failure      400  {object}  problem.Problem "Invalid or unsupported image"
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "No profile with the given id"
+// @Failure      413  {object}  problem.Problem "Image too big"
+// @Router /users/me/profiles/{id}/logo [post]
+func (h *Handler) UploadProfileLogo(c echo.Context) error {
+	profile, err := h.getMyProfile(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	return h.uploadLogo(c, profile.Id)
+}
+
+// @Summary      Delete profile logo
+// @Description  Delete the logo of a profile of your account. The generated logo will be used instead.
+// @Tags         profiles
+// @Security     Jwt
+// @Param        id    path    string  true   "The id of the profile" Format(uuid)
+// @Success      204
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "No profile with the given id (or the profile does not have a logo)"
+// @Router /users/me/profiles/{id}/logo [delete]
+func (h *Handler) DeleteProfileLogo(c echo.Context) error {
+	profile, err := h.getMyProfile(context.Background(), c)
+	if err != nil {
+		return err
+	}
+	return h.deleteLogo(c, profile.Id)
+}
+
+// @Summary      Switch profile
+// @Description  Change the profile used by the current session. Call /jwt again to get a jwt with the new profile.
+// @Description  Switching from the account to a profile never requires its pin, switching back to the account requires its password.
+// @Tags         profiles
+// @Accept       json
+// @Security     Jwt
+// @Param        profile  body  SwitchProfileDto  false  "Profile to use"
+// @Success      204
+// @Failure      400  {object}  problem.Problem "Invalid body or missing session id in the jwt"
+// @Failure      403  {object}  problem.Problem "Invalid pin or password"
+// @Failure      404  {object}  problem.Problem "No profile with the given id"
+// @Failure      429  {object}  problem.Problem "Too many invalid pins, see the Retry-After header"
+// @Router /sessions/current/profile [put]
+func (h *Handler) SwitchProfile(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	sid, err := GetCurrentSessionId(c)
+	if err != nil {
+		return err
+	}
+	current, err := GetCurrentProfileId(c)
+	if err != nil {
+		return err
+	}
+
+	var req SwitchProfileDto
+	err = c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var profilePk *int32
+	if req.Profile != nil {
+		profile, err := h.db.GetProfile(ctx, dbc.GetProfileParams{
+			Id:     *req.Profile,
+			UserId: uid,
+		})
+		if err == pgx.ErrNoRows {
+			return echo.NewHTTPError(404, "No profile found with given id")
+		} else if err != nil {
+			return err
+		}
+		if profile.Pin != nil && current != nil && *current != profile.Id {
+			err = h.checkProfilePin(ctx, c, &profile, req.Pin)
+			if err != nil {
+				return err
+			}
+		}
+		profilePk = &profile.Pk
+	} else if current != nil {
+		err = h.checkAccountPassword(ctx, c, uid, req.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := h.db.SetSessionProfile(ctx, dbc.SetSessionProfileParams{
+		Id:        sid,
+		UserId:    uid,
+		ProfilePk: profilePk,
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return echo.NewHTTPError(403, "Invalid token, session already deleted.")
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditProfileSwitch,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"session": sid, "profile": req.Profile},
+	})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *Handler) checkProfilePin(ctx context.Context, c echo.Context, profile *dbc.Profile, pin *string) error {
+	if pin == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "This profile requires a pin.")
+	}
+	target := profile.Id.String()
+	err := h.reserveAttempt(ctx, c, ProfileAttempts, target, h.config.LoginMaxAttempts)
+	if err != nil {
+		return err
+	}
+	match, err := argon2id.ComparePasswordAndHash(*pin, *profile.Pin)
+	if err != nil {
+		return err
+	}
+	if !match {
+		uid, _ := GetCurrentUserId(c)
+		h.audit(c, AuditEvent{
+			Action:  AuditProfileSwitch,
+			Outcome: AuditFailure,
+			Target:  &uid,
+			Details: map[string]any{"profile": profile.Id, "reason": "invalid pin"},
+		})
+		err = h.failAttempt(ctx, ProfileAttempts, target, h.config.LoginMaxAttempts)
+		if err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid pin.")
+	}
+	return h.db.ClearLoginAttempts(ctx, dbc.ClearLoginAttemptsParams{
+		Kind:   ProfileAttempts,
+		Target: target,
+	})
+}
+
+func (h *Handler) checkAccountPassword(ctx context.Context, c echo.Context, uid uuid.UUID, password *string) error {
+	user, err := h.db.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if len(user) == 0 {
+		return echo.NewHTTPError(403, "Invalid token, user already deleted.")
+	}
+	if user[0].User.Password == nil {
+		return echo.NewHTTPError(
+			http.StatusForbidden,
+			"Your account does not have a password, login again to use your account.",
+		)
+	}
+	if password == nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Your password is required to switch back to your account.")
+	}
+	target := uid.String()
+	err = h.reserveAttempt(ctx, c, IpAttempts, c.RealIP(), h.config.LoginMaxIpAttempts)
+	if err != nil {
+		return err
+	}
+	err = h.reserveAttempt(ctx, c, AccountAttempts, target, h.config.LoginMaxAttempts)
+	if err != nil {
+		return err
+	}
+	match, err := argon2id.ComparePasswordAndHash(*password, *user[0].User.Password)
+	if err != nil {
+		return err
+	}
+	if !match {
+		h.audit(c, AuditEvent{
+			Action:  AuditProfileSwitch,
+			Outcome: AuditFailure,
+			Target:  &uid,
+			Details: map[string]any{"profile": nil, "reason": "invalid password"},
+		})
+		return h.failLogin(ctx, c, target, echo.NewHTTPError(http.StatusForbidden, "Invalid password."))
+	}
+	return h.clearLoginAttempts(ctx, c, target)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProfileClaims(t *testing.T) {
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_JWT_CLAIMS": `{"email": "email"}`,
+	})
+	s.Register("admin")
+	var owner User
+	s.Register("owner")
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &owner)
+	s.Login("admin")
+	s.Request(http.MethodPatch, "/users/"+owner.Id.String(), map[string]any{
+		"claims": map[string]any{"maxRating": "PG"},
+	}).Expect(t, http.StatusOK)
+
+	s.Auth = ""
+	var session struct{ Token string }
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "owner",
+		"password": "password-owner",
+	}).Expect(t, http.StatusCreated).Json(t, &session)
+	s.UseSession(session.Token)
+
+	// profiles can't override claims from KEIBI_JWT_CLAIMS or the ones set by admins.
+	for _, claims := range []map[string]any{
+		{"sub": "other"},
+		{"email": "admin@zoriya.dev"},
+		{"maxRating": "R"},
+	} {
+		s.Request(http.MethodPost, "/users/me/profiles", map[string]any{
+			"name":   "evil",
+			"claims": claims,
+		}).Expect(t, http.StatusUnprocessableEntity)
+	}
+	var profile Profile
+	s.Request(http.MethodPost, "/users/me/profiles", map[string]any{
+		"name":   "kids",
+		"claims": map[string]any{"theme": "dark"},
+	}).Expect(t, http.StatusCreated).Json(t, &profile)
+	s.Request(http.MethodPatch, "/users/me/profiles/"+profile.Id.String(), map[string]any{
+		"claims": map[string]any{"maxRating": "R"},
+	}).Expect(t, http.StatusUnprocessableEntity)
+
+	// claims set on the user after the profile was created still take precedence.
+	account := s.Auth
+	s.Login("admin")
+	s.Request(http.MethodPatch, "/users/"+owner.Id.String(), map[string]any{
+		"claims": map[string]any{"maxRating": "PG", "theme": "light"},
+	}).Expect(t, http.StatusOK)
+	s.Auth = account
+
+	s.Request(http.MethodPut, "/sessions/current/profile", map[string]any{
+		"profile": profile.Id,
+	}).Expect(t, http.StatusNoContent)
+	claims := DecodeJwt(t, s.UseSession(session.Token))
+	if claims["profile"] != profile.Id.String() ||
+		claims["email"] != "owner@zoriya.dev" ||
+		claims["maxRating"] != "PG" ||
+		claims["theme"] != "light" {
+		t.Fatalf("invalid profile claims: %v", claims)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	QuickConnectAttempts = "quickconnect"
+	QuickConnectTimeout  = 5 * time.Minute
+	// Minimum number of seconds between two polls of the same client.
+	QuickConnectPollInterval = 5
+	// Max number of pending codes a single client (ip) can have.
+	QuickConnectMaxPending = 3
+	QuickConnectCodeLength = 6
+)
+
+type QuickConnectCode struct {
+	// Secret used to retrieve the session once the code is approved, keep it secret.
+	Secret string `json:"secret"`
+	// Code to display, the user should enter it from an already logged in client.
+	Code string `json:"code" example:"482913"`
+	// Number of seconds before the code expires.
+	ExpiresIn int `json:"expiresIn" example:"300"`
+	// Minimum number of seconds to wait between two polls.
+	Interval int `json:"interval" example:"5"`
+}
+
+type QuickConnectSessionDto struct {
+	// The `secret` returned by POST /quick-connect.
+	Secret string `json:"secret" validate:"required"`
+}
+
+type QuickConnect struct {
+	// Code displayed on the new client.
+	Code string `json:"code" example:"482913"`
+	// Device that wants to login.
+	Device *string `json:"device" example:"Android TV"`
+	// When did the client ask for a code.
+	CreatedDate time.Time `json:"createdDate"`
+	// After this date, the code can't be approved anymore.
+	ExpireDate time.Time `json:"expireDate"`
+}
+
+func MapQuickConnect(req *dbc.QuickConnectRequest) QuickConnect {
+	return QuickConnect{
+		Code:        req.Code,
+		Device:      req.Device,
+		CreatedDate: req.CreatedDate,
+		ExpireDate:  req.ExpireAt,
+	}
+}
+
+func GenerateQuickConnectCode() (string, error) {
+	size := big.NewInt(int64(math.Pow10(QuickConnectCodeLength)))
+	i, err := rand.Int(rand.Reader, size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", QuickConnectCodeLength, i.Int64()), nil
+}
+
+// @Summary      Initiate quick connect
+// @Description  Start a quick connect request. Display the returned `code`, a user can enter it from another client
+// @Description  where they are already logged in (a phone for example). Then poll POST /quick-connect/session until it's approved.
+// @Tags         quick-connect
+// @Produce      json
+// @Param        device  query   string  false  "Name of the device, used as the name of the created session"
+// @Success      201  {object}  QuickConnectCode
+// @Failure      429  {object}  problem.Problem "Too many pending codes for this client"
+// @Router /quick-connect [post]
+func (h *Handler) InitiateQuickConnect(c echo.Context) error {
+	ctx := context.Background()
+	ip := c.RealIP()
+
+	pending, err := h.db.CountQuickConnects(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if pending >= QuickConnectMaxPending {
+		c.Response().Header().Set("Retry-After", fmt.Sprint(int(QuickConnectTimeout.Seconds())))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many pending quick connect codes, try again later.")
+	}
+
+	secret, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	// codes are short, retry a few times if one is already used.
+	for retry := 0; ; retry++ {
+		code, err := GenerateQuickConnectCode()
+		if err != nil {
+			return err
+		}
+		_, err = h.db.CreateQuickConnect(ctx, dbc.CreateQuickConnectParams{
+			Secret:   HashToken(secret),
+			Code:     code,
+			Device:   getDevice(c),
+			Ip:       ip,
+			ExpireAt: time.Now().UTC().Add(QuickConnectTimeout),
+		})
+		if ErrIs(err, pgerrcode.UniqueViolation) && retry < 3 {
+			// the code might belong to an expired request the janitor did not delete yet.
+			_ = h.db.CleanupQuickConnects(ctx, time.Now().UTC())
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, QuickConnectCode{
+			Secret:    secret,
+			Code:      code,
+			ExpiresIn: int(QuickConnectTimeout.Seconds()),
+			Interval:  QuickConnectPollInterval,
+		})
+	}
+}
+
+// @Summary      Poll quick connect
+// @Description  Check if a quick connect code was approved. Once it is, a session is created and returned.
+// @Description  While the code is pending, a 202 is returned and you should poll again after `interval` seconds.
+// @Tags         quick-connect
+// @Accept       json
+// @Produce      json
+// @Param        body  body  QuickConnectSessionDto  false  "Quick connect secret"
+// @Success      201  {object}  dbc.Session
+// @Success      202  {object}  QuickConnect "The code was not approved yet"
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      404  {object}  problem.Problem "Invalid or expired secret"
+// @Failure      429  {object}  problem.Problem "Polling too fast"
+// @Router /quick-connect/session [post]
+func (h *Handler) PollQuickConnect(c echo.Context) error {
+	var req QuickConnectSessionDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	row, err := h.db.GetQuickConnect(ctx, HashToken(req.Secret))
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired quick connect secret.")
+	} else if err != nil {
+		return err
+	}
+	request := row.QuickConnectRequest
+
+	if row.UserId == nil {
+		// allow a second of jitter between polls.
+		last := request.LastPoll
+		if last != nil && last.Add((QuickConnectPollInterval-1)*time.Second).After(time.Now().UTC()) {
+			c.Response().Header().Set("Retry-After", fmt.Sprint(QuickConnectPollInterval))
+			return echo.NewHTTPError(http.StatusTooManyRequests, "Polling too fast, wait for the interval between polls.")
+		}
+		err = h.db.PollQuickConnect(ctx, request.Pk)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusAccepted, MapQuickConnect(&request))
+	}
+
+	// the request is approved, it can only be exchanged once.
+	deleted, err := h.db.DeleteQuickConnect(ctx, request.Pk)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired quick connect secret.")
+	}
+	user, err := h.getUser(ctx, *row.UserId)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, "The user was deleted.")
+	} else if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &user.Id,
+		Target:  &user.Id,
+		Details: map[string]any{
+			"method":     "quickconnect",
+			"device":     request.Device,
+			"approvedBy": request.ApprovedBy,
+		},
+	})
+	return h.createDeviceSession(c, &user, request.Device)
+}
+
+// @Summary      Get quick connect request
+// @Description  Get informations about a pending quick connect code, to display them before approving it.
+// @Tags         quick-connect
+// @Produce      json
+// @Security     Jwt
+// @Param        code  path  string  true  "The code displayed on the new client" example(482913)
+// @Success      200  {object}  QuickConnect
+// @Failure      404  {object}  problem.Problem "Invalid or expired code"
+// @Failure      429  {object}  problem.Problem "Too many invalid codes"
+// @Router /quick-connect/{code} [get]
+func (h *Handler) GetQuickConnect(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err = h.reserveAttempt(ctx, c, QuickConnectAttempts, uid.String(), h.config.LoginMaxAttempts); err != nil {
+		return err
+	}
+
+	request, err := h.db.GetQuickConnectByCode(ctx, c.Param("code"))
+	if err == pgx.ErrNoRows {
+		return h.failQuickConnect(ctx, uid.String())
+	} else if err != nil {
+		return err
+	}
+	if err = h.releaseAttempt(ctx, QuickConnectAttempts, uid.String()); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, MapQuickConnect(&request))
+}
+
+// @Summary      Approve quick connect
+// @Description  Approve a quick connect code, the new client will receive a session for your account on its next poll.
+// @Description  This can't be done while a profile is active.
+// @Tags         quick-connect
+// @Produce      json
+// @Security     Jwt
+// @Param        code  path  string  true  "The code displayed on the new client" example(482913)
+// @Success      200  {object}  QuickConnect
+// @Failure      403  {object}  problem.Problem "A profile is active"
+// @Failure      404  {object}  problem.Problem "Invalid or expired code"
+// @Failure      429  {object}  problem.Problem "Too many invalid codes"
+// @Router /quick-connect/{code}/approve [post]
+func (h *Handler) ApproveQuickConnect(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	sid, err := GetCurrentSessionId(c)
+	if err != nil {
+		return err
+	}
+	// the new session would have access to the whole account.
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err = h.reserveAttempt(ctx, c, QuickConnectAttempts, uid.String(), h.config.LoginMaxAttempts); err != nil {
+		return err
+	}
+
+	request, err := h.db.ApproveQuickConnect(ctx, dbc.ApproveQuickConnectParams{
+		Code:      c.Param("code"),
+		UserId:    uid,
+		SessionId: &sid,
+	})
+	if err == pgx.ErrNoRows {
+		return h.failQuickConnect(ctx, uid.String())
+	} else if err != nil {
+		return err
+	}
+	if err = h.releaseAttempt(ctx, QuickConnectAttempts, uid.String()); err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditQuickConnectApprove,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"device": request.Device, "session": sid},
+	})
+	return c.JSON(http.StatusOK, MapQuickConnect(&request))
+}
+
+// Codes are short, count invalid ones to prevent users from guessing them.
+func (h *Handler) failQuickConnect(ctx context.Context, uid string) error {
+	err := h.failAttempt(ctx, QuickConnectAttempts, uid, h.config.LoginMaxAttempts)
+	if err != nil {
+		return err
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "Invalid or expired code.")
+}
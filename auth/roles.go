@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permissions of each role, can be overridden or extended via `KEIBI_ROLE_<name>` env vars.
+var DefaultRoles = map[string][]string{
+	"admin": {
+		"overall.read",
+		"overall.write",
+		"overall.create",
+		"overall.delete",
+		"overall.play",
+		"admin.read",
+		"admin.write",
+		"admin.create",
+		"admin.delete",
+		"users.read",
+		"users.write",
+		"users.delete",
+		"users.password",
+		"users.claims",
+		"users.roles",
+		"users.impersonate",
+		"users.export",
+		"invites.read",
+		"invites.create",
+		"apikey.read",
+		"apikey.create",
+		"keys.rotate",
+		"audit.read",
+	},
+	"user": {
+		"overall.read",
+		"overall.play",
+	},
+	"guest": {
+		"overall.read",
+	},
+}
+
+func LoadRoles() map[string][]string {
+	ret := maps.Clone(DefaultRoles)
+
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, "KEIBI_ROLE_") {
+			continue
+		}
+		role := strings.ToLower(key[len("KEIBI_ROLE_"):])
+		if role == "" {
+			fmt.Printf("Invalid role config value: %s\n", key)
+			continue
+		}
+		ret[role] = SplitList(value)
+	}
+	return ret
+}
+
+func (c *Configuration) ValidateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := c.Roles[role]; !ok {
+			return fmt.Errorf("unknown role: %s", role)
+		}
+	}
+	return nil
+}
+
+// Add permissions of the given roles to the `permissions` claim.
+func (c *Configuration) ExpandRoles(claims jwt.MapClaims, roles []string) {
+	permissions := make([]string, 0)
+	switch existing := claims["permissions"].(type) {
+	case []string:
+		permissions = append(permissions, existing...)
+	case []any:
+		for _, perm := range existing {
+			if p, ok := perm.(string); ok {
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	for _, role := range roles {
+		permissions = append(permissions, c.Roles[role]...)
+	}
+	slices.Sort(permissions)
+	claims["permissions"] = slices.Compact(permissions)
+	claims["roles"] = roles
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"cmp"
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/argon2id"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
@@ -25,17 +26,38 @@ type Session struct {
 	LastUsed time.Time `json:"lastUsed"`
 	// Device that created the session.
 	Device *string `json:"device"`
+	// True if this is the session used to make this request.
+	Current bool `json:"current"`
+	// Id of the admin impersonating the user with this session, null for normal sessions.
+	ImpersonatorId *uuid.UUID `json:"impersonatorId"`
+	// Date after which this session can't be used anymore, null if it only expires when unused.
+	ExpireDate *time.Time `json:"expireDate"`
 }
 
 func MapSession(ses *dbc.Session) Session {
 	return Session{
-		Id:          ses.Id,
-		CreatedDate: ses.CreatedDate,
-		LastUsed:    ses.LastUsed,
-		Device:      ses.Device,
+		Id:             ses.Id,
+		CreatedDate:    ses.CreatedDate,
+		LastUsed:       ses.LastUsed,
+		Device:         ses.Device,
+		ImpersonatorId: ses.ImpersonatorId,
+		ExpireDate:     ses.ExpireAt,
 	}
 }
 
+func MapSessions(c echo.Context, sessions []dbc.Session) []Session {
+	// api keys or jwt created before the sid claim don't have a current session.
+	sid, _ := GetCurrentSessionId(c)
+
+	ret := make([]Session, 0, len(sessions))
+	for _, ses := range sessions {
+		s := MapSession(&ses)
+		s.Current = ses.Id == sid
+		ret = append(ret, s)
+	}
+	return ret
+}
+
 type LoginDto struct {
 	// Either the email or the username.
 	Login string `json:"login" validate:"required"`
@@ -45,16 +67,20 @@ type LoginDto struct {
 
 // @Summary      Login
 // @Description  Login to your account and open a session
+// @Description  If ldap is configured, logins that don't match a local user with a password are checked against the ldap server.
 // @Tags         sessions
 // @Accept       json
 // @Produce      json
 // @Param        device  query   string    false  "The device the created session will be used on"
 // @Param        login   body    LoginDto  false  "Account informations"
 // @Success      201  {object}   dbc.Session
+// @Success      202  {object}   OtpChallenge "2fa is enabled, call POST /sessions/otp to finish logging in"
 // @Failure      400  {object}   problem.Problem "Invalid login body"
-// @Failure      403  {object}   problem.Problem "Invalid password"
+// @Failure      403  {object}   problem.Problem "Invalid password or unverified email (or any login failure if generic login errors are enabled)"
 // @Failure      404  {object}   problem.Problem "Account does not exists"
 // @Failure      422  {object}   problem.Problem "User does not have a password (registered via oidc, please login via oidc)"
+// @Failure      429  {object}   problem.Problem "Too many failed attempts for this account or ip, see the Retry-After header"
+// @Failure      502  {object}   problem.Problem "The ldap server could not be reached"
 // @Router /sessions [post]
 func (h *Handler) Login(c echo.Context) error {
 	var req LoginDto
@@ -66,12 +92,44 @@ func (h *Handler) Login(c echo.Context) error {
 		return err
 	}
 
-	dbuser, err := h.db.GetUserByLogin(context.Background(), req.Login)
+	ctx := context.Background()
+	err = h.reserveAttempt(ctx, c, IpAttempts, c.RealIP(), h.config.LoginMaxIpAttempts)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, "No account exists with the specified email or username.")
+		h.auditLoginFailure(c, nil, req.Login, "ip locked")
+		return err
+	}
+
+	dbuser, err := h.db.GetUserByLogin(ctx, req.Login)
+	if h.config.Ldap != nil {
+		if err == pgx.ErrNoRows {
+			return h.ldapLogin(ctx, c, &req, nil)
+		} else if err == nil && dbuser.Password == nil {
+			return h.ldapLogin(ctx, c, &req, &dbuser)
+		}
+	}
+	if err == pgx.ErrNoRows {
+		account := strings.ToLower(req.Login)
+		err = h.reserveAttempt(ctx, c, AccountAttempts, account, h.config.LoginMaxAttempts)
+		if err != nil {
+			h.auditLoginFailure(c, nil, req.Login, "account locked")
+			return err
+		}
+		h.auditLoginFailure(c, nil, req.Login, "unknown account")
+		// still hash the password so this takes as long as a wrong password.
+		_, _ = argon2id.ComparePasswordAndHash(req.Password, dummyHash())
+		return h.failLogin(ctx, c, account, echo.NewHTTPError(http.StatusNotFound, "No account exists with the specified email or username."))
+	} else if err != nil {
+		return err
+	}
+	account := dbuser.Id.String()
+	err = h.reserveAttempt(ctx, c, AccountAttempts, account, h.config.LoginMaxAttempts)
+	if err != nil {
+		h.auditLoginFailure(c, &dbuser.Id, req.Login, "account locked")
+		return err
 	}
 	if dbuser.Password == nil {
-		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Can't login with password, this account was created with OIDC.")
+		h.auditLoginFailure(c, &dbuser.Id, req.Login, "no password")
+		return h.failLogin(ctx, c, account, echo.NewHTTPError(http.StatusUnprocessableEntity, "Can't login with password, this account was created with OIDC."))
 	}
 
 	match, err := argon2id.ComparePasswordAndHash(req.Password, *dbuser.Password)
@@ -79,37 +137,98 @@ func (h *Handler) Login(c echo.Context) error {
 		return err
 	}
 	if !match {
-		return echo.NewHTTPError(http.StatusForbidden, "Invalid password")
+		h.auditLoginFailure(c, &dbuser.Id, req.Login, "invalid password")
+		return h.failLogin(ctx, c, account, echo.NewHTTPError(http.StatusForbidden, "Invalid password"))
+	}
+	err = h.passwordLoginAttempts(ctx, c, account, dbuser.OtpEnabled)
+	if err != nil {
+		return err
+	}
+	if h.config.RequireVerifiedEmail && !dbuser.EmailVerified {
+		h.auditLoginFailure(c, &dbuser.Id, req.Login, "email not verified")
+		return echo.NewHTTPError(http.StatusForbidden, "You need to verify your email before logging in.")
+	}
+	if dbuser.OtpEnabled || isOtpRequired(&dbuser) {
+		return h.createOtpChallenge(c, &dbuser)
 	}
 
+	h.audit(c, AuditEvent{
+		Action:  AuditLogin,
+		Outcome: AuditSuccess,
+		Actor:   &dbuser.Id,
+		Target:  &dbuser.Id,
+		Details: map[string]any{"method": "password"},
+	})
 	user := MapDbUser(&dbuser)
 	return h.createSession(c, &user)
 }
 
-func (h *Handler) createSession(c echo.Context, user *User) error {
-	ctx := context.Background()
+// Session tokens are stored as an hmac so a database leak does not expose valid tokens.
+func (h *Handler) hashSessionToken(token string) string {
+	mac := hmac.New(sha256.New, h.tokenSecret)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	id := make([]byte, 64)
-	_, err := rand.Read(id)
+// Hash tokens of sessions created before tokens were hashed.
+func (h *Handler) HashSessionTokens(ctx context.Context) error {
+	sessions, err := h.db.GetUnhashedSessions(ctx)
 	if err != nil {
 		return err
 	}
+	for _, session := range sessions {
+		err = h.db.HashSessionToken(ctx, dbc.HashSessionTokenParams{
+			Pk:    session.Pk,
+			Token: h.hashSessionToken(session.Token),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	dev := cmp.Or(c.Param("device"), c.Request().Header.Get("User-Agent"))
-	device := &dev
+// Name of the device making the request, from the `device` query param or the User-Agent.
+func getDevice(c echo.Context) *string {
+	dev := cmp.Or(c.QueryParam("device"), c.Request().Header.Get("User-Agent"))
 	if dev == "" {
-		device = nil
+		return nil
+	}
+	return &dev
+}
+
+func (h *Handler) createSession(c echo.Context, user *User) error {
+	return h.createDeviceSession(c, user, getDevice(c))
+}
+
+func (h *Handler) createDeviceSession(c echo.Context, user *User, device *string) error {
+	session, err := h.newSession(c, user, device)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, session)
+}
+
+func (h *Handler) newSession(c echo.Context, user *User, device *string) (*dbc.Session, error) {
+	ctx := context.Background()
+
+	token, err := GenerateToken()
+	if err != nil {
+		return nil, err
 	}
 
 	session, err := h.db.CreateSession(ctx, dbc.CreateSessionParams{
-		Token:  base64.StdEncoding.EncodeToString(id),
+		Token:  h.hashSessionToken(token),
 		UserPk: user.Pk,
 		Device: device,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return c.JSON(201, session)
+	h.emitSessions(c, WebhookSessionCreated, user.Id, []dbc.Session{session})
+	// only the hash is stored, this is the only time the token is available.
+	session.Token = token
+	return &session, nil
 }
 
 // @Summary      Logout
@@ -123,6 +242,7 @@ func (h *Handler) createSession(c echo.Context, user *User) error {
 // @Failure      401  {object}  problem.Problem "Missing jwt token"
 // @Failure      403  {object}  problem.Problem "Invalid jwt token (or expired)"
 // @Failure      404  {object}  problem.Problem "Session not found with specified id (if not using the /current route)"
+// @Router /sessions [delete]
 // @Router /sessions/{id} [delete]
 // @Router /sessions/current [delete]
 func (h *Handler) Logout(c echo.Context) error {
@@ -131,17 +251,18 @@ func (h *Handler) Logout(c echo.Context) error {
 		return err
 	}
 
+	var sid uuid.UUID
 	session := c.Param("id")
-	if session == "current" {
-		sid, ok := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)["sid"]
-		if !ok {
-			return echo.NewHTTPError(400, "Missing session id")
+	if session == "" || session == "current" {
+		sid, err = GetCurrentSessionId(c)
+		if err != nil {
+			return err
+		}
+	} else {
+		sid, err = uuid.Parse(session)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid session id")
 		}
-		session = sid.(string)
-	}
-	sid, err := uuid.Parse(session)
-	if err != nil {
-		return echo.NewHTTPError(400, "Invalid session id")
 	}
 
 	ret, err := h.db.DeleteSession(context.Background(), dbc.DeleteSessionParams{
@@ -153,5 +274,100 @@ func (h *Handler) Logout(c echo.Context) error {
 	} else if err != nil {
 		return err
 	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogout,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"session": ret.Id},
+	})
+	h.emitSessions(c, WebhookSessionDeleted, uid, []dbc.Session{ret})
 	return c.JSON(200, MapSession(&ret))
 }
+
+// @Summary      List my sessions
+// @Description  List all the sessions (and devices) currently logged in your account.
+// @Tags         sessions
+// @Produce      json
+// @Security     Jwt
+// @Success      200  {object}  []Session
+// @Failure      401  {object}  problem.Problem "Missing jwt token"
+// @Failure      403  {object}  problem.Problem "Invalid jwt token (or expired)"
+// @Router /sessions [get]
+func (h *Handler) ListMySessions(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := h.db.GetUserSessions(context.Background(), uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, MapSessions(c, sessions))
+}
+
+// @Summary      List user sessions
+// @Description  List all the sessions (and devices) of another user.
+// @Tags         sessions
+// @Produce      json
+// @Security     Jwt[users.read]
+// @Param        id   path      string    true  "The id of the user" Format(uuid)
+// @Success      200  {object}  []Session
+// @Failure      400  {object}  problem.Problem "Invalid user id"
+// @Failure      403  {object}  problem.Problem "Missing users.read permission"
+// @Router /users/{id}/sessions [get]
+func (h *Handler) ListUserSessions(c echo.Context) error {
+	err := CheckPermissions(c, []string{"users.read"})
+	if err != nil {
+		return err
+	}
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+
+	sessions, err := h.db.GetUserSessions(context.Background(), uid)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, MapSessions(c, sessions))
+}
+
+// @Summary      Logout other sessions
+// @Description  Delete all your sessions except the one used to make this request.
+// @Tags         sessions
+// @Produce      json
+// @Security     Jwt
+// @Success      200  {object}  []Session "The deleted sessions"
+// @Failure      400  {object}  problem.Problem "Missing session id in the jwt"
+// @Failure      401  {object}  problem.Problem "Missing jwt token"
+// @Router /sessions/others [delete]
+func (h *Handler) LogoutOthers(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	sid, err := GetCurrentSessionId(c)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := h.db.DeleteOtherSessions(context.Background(), dbc.DeleteOtherSessionsParams{
+		UserId:    uid,
+		SessionId: sid,
+	})
+	if err != nil {
+		return err
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditLogout,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"others": true, "count": len(sessions)},
+	})
+	h.emitSessions(c, WebhookSessionDeleted, uid, sessions)
+	return c.JSON(200, MapSessions(c, sessions))
+}
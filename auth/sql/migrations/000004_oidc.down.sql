@@ -0,0 +1,6 @@
+begin;
+
+drop table oidc_requests;
+alter table oidc_handle drop constraint oidc_handle_provider_id;
+
+commit;
@@ -0,0 +1,16 @@
+begin;
+
+alter table oidc_handle add constraint oidc_handle_provider_id unique (provider, id);
+
+create table oidc_requests(
+	id uuid not null primary key default gen_random_uuid(),
+	provider varchar(256) not null,
+	redirect_url text not null,
+
+	code text,
+	token varchar(128) unique,
+
+	created_date timestamptz not null default now()::timestamptz
+);
+
+commit;
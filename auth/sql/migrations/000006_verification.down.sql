@@ -0,0 +1,6 @@
+begin;
+
+drop table verification_codes;
+alter table users drop column email_verified;
+
+commit;
@@ -0,0 +1,18 @@
+begin;
+
+alter table users add column email_verified boolean not null default false;
+
+create table verification_codes(
+	pk serial primary key,
+	user_pk integer not null references users(pk) on delete cascade,
+	kind varchar(32) not null,
+	-- sha256 of the code sent by mail
+	code varchar(128) not null unique,
+	-- email the code was sent to, used to only verify the email that received the code
+	email varchar(320) not null,
+
+	created_date timestamptz not null default now()::timestamptz,
+	expire_at timestamptz not null
+);
+
+commit;
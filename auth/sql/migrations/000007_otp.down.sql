@@ -0,0 +1,9 @@
+begin;
+
+drop table otp_challenges;
+drop table otp_recovery_codes;
+alter table users drop column otp_last_counter;
+alter table users drop column otp_enabled;
+alter table users drop column otp_secret;
+
+commit;
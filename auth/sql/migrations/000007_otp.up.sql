@@ -0,0 +1,25 @@
+begin;
+
+alter table users add column otp_secret text;
+alter table users add column otp_enabled boolean not null default false;
+-- time step of the last code used, codes can't be used twice.
+alter table users add column otp_last_counter bigint;
+
+create table otp_recovery_codes(
+	user_pk integer not null references users(pk) on delete cascade,
+	-- sha256 of the recovery code
+	code varchar(128) not null,
+
+	constraint otp_recovery_codes_pk primary key (user_pk, code)
+);
+
+create table otp_challenges(
+	pk serial primary key,
+	-- sha256 of the challenge token
+	token varchar(128) not null unique,
+	user_pk integer not null references users(pk) on delete cascade,
+	attempts integer not null default 0,
+	created_date timestamptz not null default now()::timestamptz
+);
+
+commit;
@@ -0,0 +1,15 @@
+begin;
+
+create table login_attempts(
+	-- either `account` or `ip`
+	kind varchar(16) not null,
+	-- id of the user (or the login used if no account exists) or the ip address
+	target varchar(320) not null,
+	failures integer not null default 0,
+	last_failure timestamptz not null default now()::timestamptz,
+	locked_until timestamptz,
+
+	constraint login_attempts_pk primary key (kind, target)
+);
+
+commit;
@@ -0,0 +1,5 @@
+begin;
+
+alter table users drop column roles;
+
+commit;
@@ -0,0 +1,16 @@
+begin;
+
+-- roles are expanded into the `permissions` claim when creating jwts.
+alter table users add column roles varchar(64)[] not null default '{}';
+
+-- existing users get the default roles (`KEIBI_DEFAULT_ROLES` can't be read from here, use its default value).
+update users set roles = '{user}';
+-- admins used to be users with the permissions to manage other users (`user.read` is now `users.read`).
+update
+	users
+set
+	roles = '{admin}'
+where
+	claims -> 'permissions' ?| array['user.read', 'users.read', 'users.write', 'users.delete', 'admin.write'];
+
+commit;
@@ -0,0 +1,22 @@
+begin;
+
+create table audit_logs(
+	pk bigserial primary key,
+	id uuid not null default gen_random_uuid() unique,
+	date timestamptz not null default now()::timestamptz,
+	action varchar(64) not null,
+	-- either `success` or `failure`
+	outcome varchar(16) not null,
+	-- no foreign keys, logs must outlive the users they reference.
+	actor_id uuid,
+	target_id uuid,
+	ip varchar(64),
+	user_agent text,
+	details jsonb not null default '{}'::jsonb
+);
+
+create index audit_logs_date on audit_logs(date);
+create index audit_logs_actor on audit_logs(actor_id);
+create index audit_logs_target on audit_logs(target_id);
+
+commit;
@@ -0,0 +1,9 @@
+begin;
+
+-- hashed tokens can't be converted back, logout every sessions.
+delete from sessions
+where hashed;
+drop index sessions_last_used;
+alter table sessions drop column hashed;
+
+commit;
@@ -0,0 +1,9 @@
+begin;
+
+-- tokens are now stored as an hmac. existing plaintext tokens are hashed by keibi on startup
+-- since the hmac key is not available from sql.
+alter table sessions add column hashed boolean not null default false;
+
+create index sessions_last_used on sessions(last_used);
+
+commit;
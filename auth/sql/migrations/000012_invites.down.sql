@@ -0,0 +1,6 @@
+begin;
+
+drop table invites;
+alter table users drop column pending;
+
+commit;
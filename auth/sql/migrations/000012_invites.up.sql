@@ -0,0 +1,21 @@
+begin;
+
+-- accounts created while registrations require an approval can't create jwts until approved.
+alter table users add column pending boolean not null default false;
+
+create table invites(
+	pk serial primary key,
+	id uuid not null default gen_random_uuid(),
+	code varchar(128) not null unique,
+	-- claims & roles given to users registering with this invite.
+	claims jsonb not null,
+	roles varchar(64)[] not null,
+	max_uses integer not null,
+	uses integer not null default 0,
+
+	created_by integer references users(pk) on delete set null,
+	created_date timestamptz not null default now()::timestamptz,
+	expire_date timestamptz
+);
+
+commit;
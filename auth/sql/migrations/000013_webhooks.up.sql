@@ -0,0 +1,19 @@
+begin;
+
+-- pending webhook deliveries, rows are deleted once delivered (or after too many failures).
+create table webhook_deliveries(
+	pk bigserial primary key,
+	id uuid not null default gen_random_uuid() unique,
+	-- name of the webhook in the config (`KEIBI_WEBHOOK_<name>_URL`)
+	webhook varchar(256) not null,
+	event varchar(64) not null,
+	payload jsonb not null,
+	attempts integer not null default 0,
+	next_attempt timestamptz not null default now()::timestamptz,
+	last_error text,
+	created_date timestamptz not null default now()::timestamptz
+);
+
+create index webhook_deliveries_next_attempt on webhook_deliveries(next_attempt);
+
+commit;
@@ -0,0 +1,6 @@
+begin;
+
+alter table sessions drop column profile_pk;
+drop table profiles;
+
+commit;
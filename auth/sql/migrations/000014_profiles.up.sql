@@ -0,0 +1,20 @@
+begin;
+
+create table profiles(
+	pk serial primary key,
+	id uuid not null default gen_random_uuid() unique,
+	user_pk integer not null references users(pk) on delete cascade,
+	name varchar(256) not null,
+	-- argon2 hash of the pin, null if the profile is not protected.
+	pin varchar(256),
+	-- merged in the claims of jwts created while this profile is active.
+	claims jsonb not null default '{}'::jsonb,
+	created_date timestamptz not null default now()::timestamptz,
+
+	constraint profiles_name unique (user_pk, name)
+);
+
+-- sessions of a deleted profile are deleted too, they must not fallback to the account.
+alter table sessions add column profile_pk integer references profiles(pk) on delete cascade;
+
+commit;
@@ -0,0 +1,5 @@
+begin;
+
+drop table device_requests;
+
+commit;
@@ -0,0 +1,22 @@
+begin;
+
+create table device_requests(
+	pk serial primary key,
+	-- sha256 of the device code, only known by the device polling for a session.
+	device_code varchar(128) not null unique,
+	-- code typed by the user on another device, without the dash.
+	user_code varchar(16) not null unique,
+	device text,
+	-- either `pending`, `approved` or `denied`
+	status varchar(16) not null default 'pending',
+	-- user that approved (or denied) the request.
+	user_pk integer references users(pk) on delete cascade,
+	-- minimum delay between two polls, in seconds.
+	poll_interval integer not null,
+	last_poll timestamptz,
+
+	created_date timestamptz not null default now()::timestamptz,
+	expire_at timestamptz not null
+);
+
+commit;
@@ -0,0 +1,5 @@
+begin;
+
+drop table quick_connect_requests;
+
+commit;
@@ -0,0 +1,23 @@
+begin;
+
+create table quick_connect_requests(
+	pk serial primary key,
+	-- sha256 of the secret used by the new client to retrieve its session.
+	secret varchar(128) not null unique,
+	-- 6 digits code displayed by the new client.
+	code varchar(8) not null unique,
+	device text,
+	-- ip of the new client, used to limit the number of codes per client.
+	ip varchar(64) not null,
+	-- user (and session) that approved the request, null while pending.
+	user_pk integer references users(pk) on delete cascade,
+	approved_by uuid,
+	last_poll timestamptz,
+
+	created_date timestamptz not null default now()::timestamptz,
+	expire_at timestamptz not null
+);
+
+create index quick_connect_requests_ip on quick_connect_requests(ip);
+
+commit;
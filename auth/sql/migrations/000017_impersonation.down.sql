@@ -0,0 +1,7 @@
+begin;
+
+delete from sessions where impersonator_id is not null;
+alter table sessions drop column impersonator_id;
+alter table sessions drop column expire_at;
+
+commit;
@@ -0,0 +1,8 @@
+begin;
+
+-- id of the admin impersonating the user of this session, null for normal sessions.
+alter table sessions add column impersonator_id uuid;
+-- hard limit after which the session can't be used (for impersonations).
+alter table sessions add column expire_at timestamptz;
+
+commit;
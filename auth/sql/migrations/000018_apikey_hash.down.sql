@@ -0,0 +1,6 @@
+begin;
+
+-- hashed keys can't be recovered, revoke them.
+delete from apikeys;
+
+commit;
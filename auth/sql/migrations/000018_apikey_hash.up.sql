@@ -0,0 +1,6 @@
+begin;
+
+-- api keys are now stored as a sha256 hash, like session tokens.
+update apikeys set token = encode(sha256(token::bytea), 'hex');
+
+commit;
@@ -0,0 +1,5 @@
+begin;
+
+alter table oidc_requests drop column if exists tenant;
+
+commit;
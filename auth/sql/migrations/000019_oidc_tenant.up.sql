@@ -0,0 +1,5 @@
+begin;
+
+alter table oidc_requests add column if not exists tenant text;
+
+commit;
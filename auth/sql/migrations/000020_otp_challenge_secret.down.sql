@@ -0,0 +1,5 @@
+begin;
+
+alter table otp_challenges drop column otp_secret;
+
+commit;
@@ -0,0 +1,6 @@
+begin;
+
+-- secret generated when 2fa is enrolled during login, only copied to the user once a code is validated.
+alter table otp_challenges add column otp_secret text;
+
+commit;
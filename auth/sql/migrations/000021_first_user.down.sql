@@ -0,0 +1,6 @@
+begin;
+
+drop index users_first_user;
+alter table users drop column first_user;
+
+commit;
@@ -0,0 +1,8 @@
+begin;
+
+-- only one user can be created as the first user of the instance (and receive its roles),
+-- even if multiple users register at the same time.
+alter table users add column first_user boolean not null default false;
+create unique index users_first_user on users(first_user) where first_user;
+
+commit;
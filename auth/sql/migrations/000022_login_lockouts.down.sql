@@ -0,0 +1,5 @@
+begin;
+
+alter table login_attempts drop column lockouts;
+
+commit;
@@ -0,0 +1,6 @@
+begin;
+
+-- number of lockouts since failures were last forgotten, used to double the delay of each new lockout.
+alter table login_attempts add column lockouts integer not null default 0;
+
+commit;
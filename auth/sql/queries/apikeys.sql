@@ -0,0 +1,53 @@
+-- name: GetApiKey :one
+select
+	*
+from
+	apikeys
+where
+	token = $1
+limit 1;
+
+-- name: TouchApiKey :exec
+update
+	apikeys
+set
+	last_used = now()::timestamptz
+where
+	pk = $1;
+
+-- name: ListApiKeys :many
+select
+	*
+from
+	apikeys
+order by
+	last_used;
+
+-- name: ListUserApiKeys :many
+select
+	k.*
+from
+	apikeys as k
+	inner join users as u on u.pk = k.created_by
+where
+	u.id = $1
+order by
+	k.created_date;
+
+-- name: CreateApiKey :one
+insert into apikeys(name, token, claims, created_by)
+	values ($1, $2, $3, (
+			select
+				u.pk
+			from
+				users as u
+			where
+				u.id = sqlc.narg(user_id)))
+returning
+	*;
+
+-- name: DeleteApiKey :one
+delete from apikeys
+where id = $1
+returning
+	*;
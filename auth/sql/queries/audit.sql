@@ -0,0 +1,59 @@
+-- name: CreateAuditLog :exec
+insert into audit_logs(action, outcome, actor_id, target_id, ip, user_agent, details)
+	values ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: ListAuditLogs :many
+select
+	*
+from
+	audit_logs as a
+where
+	(sqlc.narg(action)::varchar is null
+		or a.action = sqlc.narg(action))
+	and (sqlc.narg(outcome)::varchar is null
+		or a.outcome = sqlc.narg(outcome))
+	and (sqlc.narg(actor_id)::uuid is null
+		or a.actor_id = sqlc.narg(actor_id))
+	and (sqlc.narg(target_id)::uuid is null
+		or a.target_id = sqlc.narg(target_id))
+	and (sqlc.narg(ip)::varchar is null
+		or a.ip = sqlc.narg(ip))
+	and (sqlc.narg(since)::timestamptz is null
+		or a.date >= sqlc.narg(since))
+	and (sqlc.narg(until)::timestamptz is null
+		or a.date < sqlc.narg(until))
+	-- keyset pagination, newest logs first
+	and (sqlc.narg(after_date)::timestamptz is null
+		or (a.date, a.pk) < (sqlc.narg(after_date), sqlc.narg(after_pk)::bigint))
+order by
+	a.date desc,
+	a.pk desc
+limit sqlc.arg(lim);
+
+-- name: ListUserAuditLogs :many
+-- the ip, user agent & id of other actors (admins acting on this user) are personal data of those actors.
+select
+	a.pk,
+	a.id,
+	a.date,
+	a.action,
+	a.outcome,
+	own.actor_id,
+	a.target_id,
+	own.ip,
+	own.user_agent,
+	a.details
+from
+	audit_logs as a
+	left join audit_logs as own on own.pk = a.pk
+		and own.actor_id = $1
+where
+	a.actor_id = $1
+	or a.target_id = $1
+order by
+	a.date desc,
+	a.pk desc;
+
+-- name: CleanupAuditLogs :execrows
+delete from audit_logs
+where date < sqlc.arg(before);
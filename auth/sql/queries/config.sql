@@ -13,6 +13,12 @@ on conflict (key)
 	returning
 		*;
 
+-- name: CreateConfig :exec
+insert into config(key, value)
+	values ($1, $2)
+on conflict (key)
+	do nothing;
+
 -- name: DeleteConfig :one
 delete from config
 where key = $1
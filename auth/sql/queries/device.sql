@@ -0,0 +1,63 @@
+-- name: CreateDeviceRequest :one
+insert into device_requests(device_code, user_code, device, poll_interval, expire_at)
+	values ($1, $2, $3, $4, $5)
+returning
+	*;
+
+-- name: GetDeviceRequest :one
+select
+	sqlc.embed(d),
+	u.id as user_id
+from
+	device_requests as d
+	left join users as u on u.pk = d.user_pk
+where
+	d.device_code = $1
+limit 1;
+
+-- name: GetDeviceRequestByUserCode :one
+select
+	*
+from
+	device_requests
+where
+	user_code = $1
+	and status = 'pending'
+	and expire_at > now()::timestamptz
+limit 1;
+
+-- name: PollDeviceRequest :exec
+update
+	device_requests
+set
+	last_poll = now()::timestamptz,
+	poll_interval = $2
+where
+	pk = $1;
+
+-- name: ResolveDeviceRequest :one
+update
+	device_requests
+set
+	status = $2,
+	user_pk = (
+		select
+			u.pk
+		from
+			users as u
+		where
+			u.id = sqlc.arg(user_id))
+where
+	user_code = $1
+	and status = 'pending'
+	and expire_at > now()::timestamptz
+returning
+	*;
+
+-- name: DeleteDeviceRequest :execrows
+delete from device_requests
+where pk = $1;
+
+-- name: CleanupDeviceRequests :exec
+delete from device_requests
+where expire_at < sqlc.arg(before);
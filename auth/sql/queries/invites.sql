@@ -0,0 +1,47 @@
+-- name: ListInvites :many
+select
+	*
+from
+	invites
+order by
+	created_date desc;
+
+-- name: CreateInvite :one
+insert into invites(code, claims, roles, max_uses, expire_date, created_by)
+	values ($1, $2, $3, $4, $5, (
+			select
+				u.pk
+			from
+				users as u
+			where
+				u.id = sqlc.narg(user_id)))
+returning
+	*;
+
+-- name: UseInvite :one
+update
+	invites
+set
+	uses = uses + 1
+where
+	code = $1
+	and uses < max_uses
+	and (expire_date is null
+		or expire_date > now()::timestamptz)
+returning
+	*;
+
+-- name: ReleaseInvite :exec
+update
+	invites
+set
+	uses = uses - 1
+where
+	pk = $1
+	and uses > 0;
+
+-- name: DeleteInvite :one
+delete from invites
+where id = $1
+returning
+	*;
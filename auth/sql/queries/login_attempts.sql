@@ -0,0 +1,61 @@
+-- name: GetLoginAttempt :one
+select
+	*
+from
+	login_attempts
+where
+	kind = $1
+	and target = $2
+limit 1;
+
+-- name: ReserveLoginAttempt :one
+insert into login_attempts(kind, target, failures)
+	values ($1, $2, 1)
+on conflict (kind, target)
+	do update set
+		-- forget old failures
+		failures = case when login_attempts.last_failure < sqlc.arg(reset_before) then
+			1
+		when login_attempts.locked_until is not null then
+			-- the lockout expired, allow a single attempt before locking again
+			sqlc.arg(max_attempts)::integer
+		else
+			login_attempts.failures + 1
+		end,
+		lockouts = case when login_attempts.last_failure < sqlc.arg(reset_before) then
+			0
+		else
+			login_attempts.lockouts
+		end,
+		locked_until = null,
+		last_failure = now()::timestamptz
+	where
+		login_attempts.locked_until is null
+		or login_attempts.locked_until < now()::timestamptz
+	returning
+		*;
+
+-- name: ReleaseLoginAttempt :exec
+update
+	login_attempts
+set
+	failures = failures - 1
+where
+	kind = $1
+	and target = $2
+	and failures > 0;
+
+-- name: LockLogin :exec
+update
+	login_attempts
+set
+	locked_until = $3,
+	lockouts = lockouts + 1
+where
+	kind = $1
+	and target = $2;
+
+-- name: ClearLoginAttempts :exec
+delete from login_attempts
+where kind = $1
+	and target = $2;
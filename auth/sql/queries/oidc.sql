@@ -0,0 +1,69 @@
+-- name: CreateOidcRequest :one
+insert into oidc_requests(provider, redirect_url, tenant)
+	values ($1, $2, $3)
+returning
+	*;
+
+-- name: SetOidcRequestCode :one
+update
+	oidc_requests
+set
+	code = $3,
+	token = $4
+where
+	id = $1
+	and provider = $2
+	and code is null
+returning
+	*;
+
+-- name: ConsumeOidcRequest :one
+delete from oidc_requests
+where token = $1
+	and provider = $2
+returning
+	*;
+
+-- name: DeleteOidcRequest :one
+delete from oidc_requests
+where id = $1
+	and provider = $2
+returning
+	*;
+
+-- name: CleanupOidcRequests :exec
+delete from oidc_requests
+where created_date < sqlc.arg(before);
+
+-- name: GetUserByOidc :one
+select
+	u.*
+from
+	users as u
+	inner join oidc_handle as h on u.pk = h.user_pk
+where
+	h.provider = $1
+	and h.id = $2
+limit 1;
+
+-- name: SaveOidcHandle :one
+insert into oidc_handle(user_pk, provider, id, username, profile_url, access_token, refresh_token, expire_at)
+	values ($1, $2, $3, $4, $5, $6, $7, $8)
+on conflict (user_pk, provider)
+	do update set
+		id = excluded.id,
+		username = excluded.username,
+		profile_url = excluded.profile_url,
+		access_token = excluded.access_token,
+		refresh_token = excluded.refresh_token,
+		expire_at = excluded.expire_at
+	returning
+		*;
+
+-- name: DeleteOidcHandle :one
+delete from oidc_handle as h using users as u
+where h.user_pk = u.pk
+	and u.id = sqlc.arg(user_id)
+	and h.provider = $1
+returning
+	h.*;
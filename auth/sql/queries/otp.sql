@@ -0,0 +1,104 @@
+-- name: SetOtpSecret :one
+update
+	users
+set
+	otp_secret = $2,
+	otp_enabled = false,
+	otp_last_counter = null
+where
+	pk = $1
+returning
+	*;
+
+-- name: EnrollOtp :exec
+update
+	users
+set
+	otp_secret = $2,
+	otp_enabled = true,
+	otp_last_counter = sqlc.arg(counter)
+where
+	pk = $1;
+
+-- name: EnableOtp :exec
+update
+	users
+set
+	otp_enabled = true
+where
+	pk = $1;
+
+-- name: DisableOtp :exec
+update
+	users
+set
+	otp_secret = null,
+	otp_enabled = false,
+	otp_last_counter = null
+where
+	pk = $1;
+
+-- name: UseOtpCounter :execrows
+update
+	users
+set
+	otp_last_counter = sqlc.arg(counter)
+where
+	pk = $1
+	and (otp_last_counter is null
+		or otp_last_counter < sqlc.arg(counter));
+
+-- name: CreateOtpRecoveryCode :exec
+insert into otp_recovery_codes(user_pk, code)
+	values ($1, $2);
+
+-- name: UseOtpRecoveryCode :execrows
+delete from otp_recovery_codes
+where user_pk = $1
+	and code = $2;
+
+-- name: CountOtpRecoveryCodes :one
+select
+	count(*)
+from
+	otp_recovery_codes
+where
+	user_pk = $1;
+
+-- name: DeleteOtpRecoveryCodes :exec
+delete from otp_recovery_codes
+where user_pk = $1;
+
+-- name: CreateOtpChallenge :one
+insert into otp_challenges(token, user_pk, otp_secret)
+	values ($1, $2, $3)
+returning
+	*;
+
+-- name: GetOtpChallenge :one
+select
+	sqlc.embed(c),
+	sqlc.embed(u)
+from
+	otp_challenges as c
+	inner join users as u on u.pk = c.user_pk
+where
+	c.token = $1
+limit 1;
+
+-- name: UseOtpChallengeAttempt :execrows
+update
+	otp_challenges
+set
+	attempts = attempts + 1
+where
+	pk = $1
+	and attempts < sqlc.arg(max_attempts);
+
+-- name: DeleteOtpChallenge :execrows
+delete from otp_challenges
+where pk = $1;
+
+-- name: CleanupOtpChallenges :exec
+delete from otp_challenges
+where created_date < sqlc.arg(before);
@@ -0,0 +1,74 @@
+-- name: ListProfiles :many
+select
+	p.*
+from
+	profiles as p
+	inner join users as u on u.pk = p.user_pk
+where
+	u.id = $1
+order by
+	p.created_date;
+
+-- name: GetProfile :one
+select
+	p.*
+from
+	profiles as p
+	inner join users as u on u.pk = p.user_pk
+where
+	p.id = $1
+	and u.id = sqlc.arg(user_id)
+limit 1;
+
+-- name: CreateProfile :one
+insert into profiles(user_pk, name, pin, claims)
+	values ((
+			select
+				u.pk
+			from
+				users as u
+			where
+				u.id = sqlc.arg(user_id)), $1, $2, $3)
+returning
+	*;
+
+-- name: UpdateProfile :one
+update
+	profiles
+set
+	name = $2,
+	pin = $3,
+	claims = $4
+where
+	pk = $1
+returning
+	*;
+
+-- name: DeleteProfileSessions :many
+delete from sessions as s using profiles as p, users as u
+where s.profile_pk = p.pk
+	and p.user_pk = u.pk
+	and p.id = $1
+	and u.id = sqlc.arg(user_id)
+returning
+	s.*;
+
+-- name: DeleteProfile :one
+delete from profiles as p using users as u
+where p.user_pk = u.pk
+	and p.id = $1
+	and u.id = sqlc.arg(user_id)
+returning
+	p.*;
+
+-- name: SetSessionProfile :execrows
+update
+	sessions as s
+set
+	profile_pk = sqlc.narg(profile_pk)
+from
+	users as u
+where
+	s.user_pk = u.pk
+	and s.id = $1
+	and u.id = sqlc.arg(user_id);
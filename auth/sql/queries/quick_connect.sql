@@ -0,0 +1,72 @@
+-- name: CreateQuickConnect :one
+insert into quick_connect_requests(secret, code, device, ip, expire_at)
+	values ($1, $2, $3, $4, $5)
+returning
+	*;
+
+-- name: CountQuickConnects :one
+select
+	count(*)
+from
+	quick_connect_requests
+where
+	ip = $1
+	and expire_at > now()::timestamptz;
+
+-- name: GetQuickConnect :one
+select
+	sqlc.embed(q),
+	u.id as user_id
+from
+	quick_connect_requests as q
+	left join users as u on u.pk = q.user_pk
+where
+	q.secret = $1
+	and q.expire_at > now()::timestamptz
+limit 1;
+
+-- name: GetQuickConnectByCode :one
+select
+	*
+from
+	quick_connect_requests
+where
+	code = $1
+	and user_pk is null
+	and expire_at > now()::timestamptz
+limit 1;
+
+-- name: PollQuickConnect :exec
+update
+	quick_connect_requests
+set
+	last_poll = now()::timestamptz
+where
+	pk = $1;
+
+-- name: ApproveQuickConnect :one
+update
+	quick_connect_requests
+set
+	user_pk = (
+		select
+			u.pk
+		from
+			users as u
+		where
+			u.id = sqlc.arg(user_id)),
+	approved_by = sqlc.arg(session_id)
+where
+	code = $1
+	and user_pk is null
+	and expire_at > now()::timestamptz
+returning
+	*;
+
+-- name: DeleteQuickConnect :execrows
+delete from quick_connect_requests
+where pk = $1;
+
+-- name: CleanupQuickConnects :exec
+delete from quick_connect_requests
+where expire_at < sqlc.arg(before);
@@ -2,12 +2,18 @@
 select
 	s.id,
 	s.last_used,
-	sqlc.embed(u)
+	s.impersonator_id,
+	s.expire_at,
+	sqlc.embed(u),
+	p.id as profile_id,
+	p.claims as profile_claims
 from
 	users as u
 	inner join sessions as s on u.pk = s.user_pk
+	left join profiles as p on p.pk = s.profile_pk
 where
 	s.token = $1
+	and s.hashed
 limit 1;
 
 -- name: TouchSession :exec
@@ -25,16 +31,58 @@ from
 	sessions as s
 	inner join users as u on u.pk = s.user_pk
 where
-	u.pk = $1
+	u.id = $1
+	and (s.expire_at is null
+		or s.expire_at > now()::timestamptz)
 order by
-	last_used;
+	last_used desc;
 
 -- name: CreateSession :one
-insert into sessions(token, user_pk, device)
-	values ($1, $2, $3)
+insert into sessions(token, user_pk, device, hashed)
+	values ($1, $2, $3, true)
 returning
 	*;
 
+-- name: CreateImpersonationSession :one
+insert into sessions(token, user_pk, device, hashed, impersonator_id, expire_at)
+	values ($1, $2, $3, true, $4, $5)
+returning
+	*;
+
+-- name: GetUnhashedSessions :many
+select
+	pk,
+	token
+from
+	sessions
+where
+	not hashed;
+
+-- name: HashSessionToken :exec
+update
+	sessions
+set
+	token = $2,
+	hashed = true
+where
+	pk = $1
+	and not hashed;
+
+-- name: CleanupSessions :many
+with deleted as (
+	delete from sessions
+	where last_used < sqlc.arg(before)
+		or expire_at < now()::timestamptz
+	returning
+		*
+)
+select
+	d.*,
+	u.id as user_id
+from
+	deleted as d
+	inner join users as u on u.pk = d.user_pk;
+
 -- name: DeleteSession :one
 delete from sessions as s using users as u
 where s.user_pk = u.pk
@@ -43,3 +91,23 @@ where s.user_pk = u.pk
 returning
 	s.*;
 
+-- name: DeleteOtherSessions :many
+delete from sessions as s using users as u
+where s.user_pk = u.pk
+	and u.id = sqlc.arg(user_id)
+	and s.id != sqlc.arg(session_id)
+returning
+	s.*;
+
+-- name: DeleteAllUserSessions :many
+delete from sessions
+where user_pk = $1
+returning
+	*;
+
+-- name: DeleteUserSessions :many
+delete from sessions as s using users as u
+where s.user_pk = u.pk
+	and u.id = sqlc.arg(user_id)
+returning
+	s.*;
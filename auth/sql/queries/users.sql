@@ -1,22 +1,75 @@
--- name: GetAllUsers :many
+-- name: ListUsers :many
 select
 	*
 from
-	users
-order by
-	id
-limit $1;
-
--- name: GetAllUsersAfter :many
-select
-	*
-from
-	users
+	users as u
 where
-	id >= sqlc.arg(after_id)
+	(sqlc.narg(username)::varchar is null
+		or u.username ilike sqlc.narg(username) || '%')
+	and (sqlc.narg(email)::varchar is null
+		or u.email ilike sqlc.narg(email) || '%')
+	and (sqlc.narg(claims)::jsonb is null
+		or u.claims @> sqlc.narg(claims))
+	and (sqlc.narg(seen_after)::timestamptz is null
+		or u.last_seen >= sqlc.narg(seen_after))
+	and (sqlc.narg(seen_before)::timestamptz is null
+		or u.last_seen < sqlc.narg(seen_before))
+	and (sqlc.narg(pending)::boolean is null
+		or u.pending = sqlc.narg(pending))
+	-- keyset pagination, the cursor contains the sort value & the id of the last item
+	and (sqlc.narg(after_id)::uuid is null
+		or case sqlc.arg(sort)::varchar
+		when 'username' then
+			case when sqlc.arg(descending)::boolean then
+				(u.username, u.id) < (sqlc.narg(after_username)::varchar, sqlc.narg(after_id))
+			else
+				(u.username, u.id) > (sqlc.narg(after_username)::varchar, sqlc.narg(after_id))
+			end
+		when 'createdDate' then
+			case when sqlc.arg(descending)::boolean then
+				(u.created_date, u.id) < (sqlc.narg(after_date)::timestamptz, sqlc.narg(after_id))
+			else
+				(u.created_date, u.id) > (sqlc.narg(after_date)::timestamptz, sqlc.narg(after_id))
+			end
+		when 'lastSeen' then
+			case when sqlc.arg(descending)::boolean then
+				(u.last_seen, u.id) < (sqlc.narg(after_date)::timestamptz, sqlc.narg(after_id))
+			else
+				(u.last_seen, u.id) > (sqlc.narg(after_date)::timestamptz, sqlc.narg(after_id))
+			end
+		else
+			case when sqlc.arg(descending)::boolean then
+				u.id < sqlc.narg(after_id)
+			else
+				u.id > sqlc.narg(after_id)
+			end
+		end)
 order by
-	id
-limit $1;
+	case when sqlc.arg(sort) = 'username' and not sqlc.arg(descending) then
+		u.username
+	end,
+	case when sqlc.arg(sort) = 'username' and sqlc.arg(descending) then
+		u.username
+	end desc,
+	case when sqlc.arg(sort) = 'createdDate' and not sqlc.arg(descending) then
+		u.created_date
+	end,
+	case when sqlc.arg(sort) = 'createdDate' and sqlc.arg(descending) then
+		u.created_date
+	end desc,
+	case when sqlc.arg(sort) = 'lastSeen' and not sqlc.arg(descending) then
+		u.last_seen
+	end,
+	case when sqlc.arg(sort) = 'lastSeen' and sqlc.arg(descending) then
+		u.last_seen
+	end desc,
+	case when not sqlc.arg(descending) then
+		u.id
+	end,
+	case when sqlc.arg(descending) then
+		u.id
+	end desc
+limit sqlc.arg(lim);
 
 -- name: GetUser :many
 select
@@ -45,13 +98,48 @@ limit 1;
 update
 	users
 set
-	last_used = now()::timestamptz
+	last_seen = now()::timestamptz
 where
 	id = $1;
 
+-- name: HasUsers :one
+select
+	exists (
+		select
+			1
+		from
+			users);
+
 -- name: CreateUser :one
-insert into users(username, email, password, claims)
-	values ($1, $2, $3, $4)
+with first as (
+	select
+		not exists (
+			select
+				1
+			from
+				users) as value
+)
+insert into users(username, email, password, claims, email_verified, roles, pending, first_user)
+select
+	$1,
+	$2,
+	$3,
+	$4,
+	$5,
+	case when first.value then
+		sqlc.arg(first_user_roles)::varchar[]
+	else
+		sqlc.arg(roles)::varchar[]
+	end,
+	sqlc.arg(pending)::boolean
+	and not first.value,
+	-- the users_first_user index refuses a second first user if another one was created concurrently
+	first.value
+from
+	first
+where
+	first.value
+	or not sqlc.arg(only_first)::boolean
 returning
 	*;
 
@@ -62,7 +150,21 @@ set
 	username = $2,
 	email = $3,
 	password = $4,
-	claims = $5
+	claims = $5,
+	roles = $6,
+	-- changing the email requires a new verification
+	email_verified = (email = $3
+		and email_verified)
+where
+	id = $1
+returning
+	*;
+
+-- name: ApproveUser :one
+update
+	users
+set
+	pending = false
 where
 	id = $1
 returning
@@ -0,0 +1,42 @@
+-- name: CreateVerificationCode :one
+insert into verification_codes(user_pk, kind, code, email, expire_at)
+	values ($1, $2, $3, $4, $5)
+returning
+	*;
+
+-- name: DeleteUserVerificationCodes :exec
+delete from verification_codes
+where user_pk = $1
+	and kind = $2;
+
+-- name: ConsumeVerificationCode :one
+delete from verification_codes
+where code = $1
+	and kind = $2
+returning
+	*;
+
+-- name: VerifyUserEmail :one
+update
+	users
+set
+	email_verified = true
+where
+	pk = $1
+	and email = $2
+returning
+	*;
+
+-- name: SetUserPassword :one
+update
+	users
+set
+	password = $2
+where
+	pk = $1
+returning
+	*;
+
+-- name: CleanupVerificationCodes :execrows
+delete from verification_codes
+where expire_at < sqlc.arg(before);
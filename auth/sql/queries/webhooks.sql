@@ -0,0 +1,39 @@
+-- name: CreateWebhookDelivery :exec
+insert into webhook_deliveries(webhook, event, payload)
+	values ($1, $2, $3);
+
+-- name: ClaimWebhookDeliveries :many
+-- deliveries are leased until `lease_until` so other instances don't send them at the same time.
+update
+	webhook_deliveries
+set
+	attempts = attempts + 1,
+	next_attempt = sqlc.arg(lease_until)
+where
+	pk in (
+		select
+			d.pk
+		from
+			webhook_deliveries as d
+		where
+			d.next_attempt <= now()::timestamptz
+		order by
+			d.next_attempt
+		limit sqlc.arg(lim)
+		for update
+			skip locked)
+returning
+	*;
+
+-- name: RetryWebhookDelivery :exec
+update
+	webhook_deliveries
+set
+	next_attempt = $2,
+	last_error = $3
+where
+	pk = $1;
+
+-- name: DeleteWebhookDelivery :exec
+delete from webhook_deliveries
+where pk = $1;
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/argon2id"
@@ -23,12 +31,20 @@ type User struct {
 	Username string `json:"username"`
 	// Email of the user. Can be used as a login.
 	Email string `json:"email" format:"email"`
+	// Was the email of this user verified?
+	EmailVerified bool `json:"emailVerified"`
+	// Is two factor authentication enabled for this account?
+	OtpEnabled bool `json:"otpEnabled"`
+	// Is this account waiting for an admin approval? Pending accounts can't create jwts.
+	Pending bool `json:"pending"`
 	// When was this account created?
 	CreatedDate time.Time `json:"createdDate"`
 	// When was the last time this account made any authorized request?
 	LastSeen time.Time `json:"lastSeen"`
 	// List of custom claims JWT created via get /jwt will have
 	Claims jwt.MapClaims `json:"claims"`
+	// Roles of the user, their permissions are added to the `permissions` claim of jwts.
+	Roles []string `json:"roles" example:"user"`
 	// List of other login method available for this user. Access tokens wont be returned here.
 	Oidc map[string]OidcHandle `json:"oidc,omitempty"`
 }
@@ -49,18 +65,39 @@ type RegisterDto struct {
 	Email string `json:"email" validate:"required,email" format:"email"`
 	// Password to use.
 	Password string `json:"password" validate:"required"`
+	// Invite code, required if registrations are invite only. Skips the admin approval.
+	Invite *string `json:"invite,omitempty" example:"KDBW2LMNR3XYAZFT4Q7E6PHJCVGSU5OI"`
+}
+
+type EditUserDto struct {
+	// New username, can't contain @ signs.
+	Username *string `json:"username,omitempty" validate:"omitnil,excludes=@"`
+	// New email.
+	Email *string `json:"email,omitempty" validate:"omitnil,email" format:"email"`
+	// New password. Requires `oldPassword` unless you have the `users.password` permission.
+	Password *string `json:"password,omitempty" validate:"omitnil,min=1"`
+	// Current password of the account, required to change the password.
+	OldPassword *string `json:"oldPassword,omitempty"`
+	// New custom claims. Requires the `users.claims` permission.
+	Claims jwt.MapClaims `json:"claims,omitempty"`
+	// New roles. Requires the `users.roles` permission.
+	Roles []string `json:"roles,omitempty"`
 }
 
 func MapDbUser(user *dbc.User) User {
 	return User{
-		Pk:          user.Pk,
-		Id:          user.Id,
-		Username:    user.Username,
-		Email:       user.Email,
-		CreatedDate: user.CreatedDate,
-		LastSeen:    user.LastSeen,
-		Claims:      user.Claims,
-		Oidc:        nil,
+		Pk:            user.Pk,
+		Id:            user.Id,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		OtpEnabled:    user.OtpEnabled,
+		Pending:       user.Pending,
+		CreatedDate:   user.CreatedDate,
+		LastSeen:      user.LastSeen,
+		Claims:        user.Claims,
+		Roles:         user.Roles,
+		Oidc:          make(map[string]OidcHandle),
 	}
 }
 
@@ -72,50 +109,145 @@ func MapOidc(oidc *dbc.GetUserRow) OidcHandle {
 	}
 }
 
+// Create a user, the first user of the instance receives `FirstUserRoles` instead of `Roles`.
+func CreateUser(ctx context.Context, db *dbc.Queries, params dbc.CreateUserParams) (dbc.User, error) {
+	ret, err := db.CreateUser(ctx, params)
+	if ErrIsConstraint(err, "users_first_user") {
+		// another user was created as the first user at the same time, this one is a normal user.
+		return db.CreateUser(ctx, params)
+	}
+	return ret, err
+}
+
+type userCursor struct {
+	Sort       string     `json:"sort"`
+	Descending bool       `json:"descending"`
+	Id         uuid.UUID  `json:"id"`
+	Username   *string    `json:"username,omitempty"`
+	Date       *time.Time `json:"date,omitempty"`
+}
+
+// Escape `%` and `_` so they are not used as wildcards in like queries.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 // @Summary      List all users
 // @Description  List all users existing in this instance.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Security     Jwt[users.read]
-// @Param        afterId   query      string  false  "used for pagination." Format(uuid)
-// @Success      200  {object}  User[]
-// @Failure      400  {object}  problem.Problem "Invalid after id"
+// @Param        limit          query  int     false  "Number of items per page (max 250)" default(20)
+// @Param        after          query  string  false  "Cursor of the page, use the `next` link of the previous page"
+// @Param        sort           query  string  false  "Sort by username, createdDate or lastSeen. Prefix with `-` to sort descending" default(createdDate)
+// @Param        username       query  string  false  "Only list users whose username starts with this value"
+// @Param        email          query  string  false  "Only list users whose email starts with this value"
+// @Param        claims         query  string  false  "Only list users whose claims contain this json object" example({"permissions": ["users.read"]})
+// @Param        lastSeenAfter  query  string  false  "Only list users seen after this date" Format(date-time)
+// @Param        lastSeenBefore query  string  false  "Only list users seen before this date" Format(date-time)
+// @Param        pending        query  bool    false  "Only list users waiting for an approval (or only approved users if false)"
+// @Success      200  {object}  Page[User]
+// @Failure      400  {object}  problem.Problem "Invalid parameter"
+// @Failure      403  {object}  problem.Problem "Missing users.read permission"
 // @Router       /users [get]
 func (h *Handler) ListUsers(c echo.Context) error {
-	err := CheckPermissions(c, []string{"user.read"})
+	err := CheckPermissions(c, []string{"users.read"})
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-	limit := int32(20)
-	id := c.Param("afterId")
-
-	var users []dbc.User
-	if id == "" {
-		users, err = h.db.GetAllUsers(ctx, limit)
-	} else {
-		uid, uerr := uuid.Parse(id)
-		if uerr != nil {
-			return echo.NewHTTPError(400, "Invalid `afterId` parameter, uuid was expected")
+	limit, err := GetPageLimit(c)
+	if err != nil {
+		return err
+	}
+	params := dbc.ListUsersParams{
+		Sort:       strings.TrimPrefix(cmp.Or(c.QueryParam("sort"), "createdDate"), "-"),
+		Descending: strings.HasPrefix(c.QueryParam("sort"), "-"),
+		Lim:        limit,
+	}
+	if !slices.Contains([]string{"username", "createdDate", "lastSeen"}, params.Sort) {
+		return echo.NewHTTPError(400, "Invalid `sort` parameter, expected username, createdDate or lastSeen")
+	}
+
+	if username := c.QueryParam("username"); username != "" {
+		username = escapeLike(username)
+		params.Username = &username
+	}
+	if email := c.QueryParam("email"); email != "" {
+		email = escapeLike(email)
+		params.Email = &email
+	}
+	if claims := c.QueryParam("claims"); claims != "" {
+		var parsed map[string]any
+		if json.Unmarshal([]byte(claims), &parsed) != nil {
+			return echo.NewHTTPError(400, "Invalid `claims` parameter, expected a json object")
 		}
-		users, err = h.db.GetAllUsersAfter(ctx, dbc.GetAllUsersAfterParams{
-			Limit:   limit,
-			AfterId: uid,
-		})
+		params.Claims = []byte(claims)
+	}
+	if after := c.QueryParam("lastSeenAfter"); after != "" {
+		date, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `lastSeenAfter` parameter, expected a RFC3339 date")
+		}
+		params.SeenAfter = &date
+	}
+	if before := c.QueryParam("lastSeenBefore"); before != "" {
+		date, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `lastSeenBefore` parameter, expected a RFC3339 date")
+		}
+		params.SeenBefore = &date
+	}
+	if pending := c.QueryParam("pending"); pending != "" {
+		value, err := strconv.ParseBool(pending)
+		if err != nil {
+			return echo.NewHTTPError(400, "Invalid `pending` parameter, expected a boolean")
+		}
+		params.Pending = &value
+	}
+	if after := c.QueryParam("after"); after != "" {
+		var cursor userCursor
+		err = DecodeCursor(after, &cursor)
+		if err != nil {
+			return err
+		}
+		if cursor.Sort != params.Sort || cursor.Descending != params.Descending {
+			return echo.NewHTTPError(400, "Invalid `after` parameter, it was created for another sort")
+		}
+		if (params.Sort == "username" && cursor.Username == nil) || (params.Sort != "username" && cursor.Date == nil) {
+			return echo.NewHTTPError(400, "Invalid `after` parameter")
+		}
+		params.AfterId = &cursor.Id
+		params.AfterUsername = cursor.Username
+		params.AfterDate = cursor.Date
 	}
 
+	users, err := h.db.ListUsers(context.Background(), params)
 	if err != nil {
 		return err
 	}
 
-	var ret []User
+	ret := make([]User, 0, len(users))
 	for _, user := range users {
 		ret = append(ret, MapDbUser(&user))
 	}
-	// TODO: switch to a Page
-	return c.JSON(200, ret)
+	page, err := NewPage(c, ret, limit, func(user *User) (string, error) {
+		cursor := userCursor{Sort: params.Sort, Descending: params.Descending, Id: user.Id}
+		switch params.Sort {
+		case "username":
+			cursor.Username = &user.Username
+		case "createdDate":
+			cursor.Date = &user.CreatedDate
+		case "lastSeen":
+			cursor.Date = &user.LastSeen
+		}
+		return EncodeCursor(cursor)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, page)
 }
 
 // @Summary      Get user
@@ -128,7 +260,7 @@ func (h *Handler) ListUsers(c echo.Context) error {
 // @Failure      404  {object}  problem.Problem "No user with the given id found"
 // @Router /users/{id} [get]
 func (h *Handler) GetUser(c echo.Context) error {
-	err := CheckPermissions(c, []string{"user.read"})
+	err := CheckPermissions(c, []string{"users.read"})
 	if err != nil {
 		return err
 	}
@@ -137,18 +269,13 @@ func (h *Handler) GetUser(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(400, "Invalid id")
 	}
-	dbuser, err := h.db.GetUser(context.Background(), id)
-	if err != nil {
+	user, err := h.getUser(context.Background(), id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(404, "No user found with given id")
+	} else if err != nil {
 		return err
 	}
 
-	user := MapDbUser(&dbuser[0].User)
-	for _, oidc := range dbuser {
-		if oidc.Provider != nil {
-			user.Oidc[*oidc.Provider] = MapOidc(&oidc)
-		}
-	}
-
 	return c.JSON(200, user)
 }
 
@@ -166,23 +293,37 @@ func (h *Handler) GetMe(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	dbuser, err := h.db.GetUser(context.Background(), id)
-	if err != nil {
+	user, err := h.getUser(context.Background(), id)
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(403, "Invalid token, user already deleted.")
+	} else if err != nil {
 		return err
 	}
 
+	return c.JSON(200, user)
+}
+
+func (h *Handler) getUser(ctx context.Context, id uuid.UUID) (User, error) {
+	dbuser, err := h.db.GetUser(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if len(dbuser) == 0 {
+		return User{}, pgx.ErrNoRows
+	}
+
 	user := MapDbUser(&dbuser[0].User)
 	for _, oidc := range dbuser {
 		if oidc.Provider != nil {
 			user.Oidc[*oidc.Provider] = MapOidc(&oidc)
 		}
 	}
-
-	return c.JSON(200, user)
+	return user, nil
 }
 
 // @Summary      Register
-// @Description  Register as a new user and open a session for it
+// @Description  Register as a new user and open a session for it.
+// @Description  Depending on the instance's registration mode, an invite code may be required or the account may need an admin approval before it can create jwts.
 // @Tags         users
 // @Accept       json
 // @Produce      json
@@ -190,6 +331,7 @@ func (h *Handler) GetMe(c echo.Context) error {
 // @Param        user     body    RegisterDto  false  "Registration informations"
 // @Success      201  {object}  dbc.Session
 // @Failure      400  {object}  problem.Problem "Invalid register body"
+// @Failure      403  {object}  problem.Problem "Registrations are closed or the invite code is invalid"
 // @Success      409  {object}  problem.Problem "Duplicated email or username"
 // @Router /users [post]
 func (h *Handler) Register(c echo.Context) error {
@@ -207,18 +349,37 @@ func (h *Handler) Register(c echo.Context) error {
 		return err
 	}
 
-	duser, err := h.db.CreateUser(context.Background(), dbc.CreateUserParams{
-		Username: req.Username,
-		Email:    req.Email,
-		Password: &pass,
-		Claims:   h.config.DefaultClaims,
+	ctx := context.Background()
+	duser, reg, err := h.register(ctx, req.Invite, dbc.CreateUserParams{
+		Username:      req.Username,
+		Email:         req.Email,
+		Password:      &pass,
+		EmailVerified: false,
 	})
 	if ErrIs(err, pgerrcode.UniqueViolation) {
 		return echo.NewHTTPError(409, "Email or username already taken")
 	} else if err != nil {
 		return err
 	}
+	details := map[string]any{"method": "password", "pending": duser.Pending}
+	if reg.Invite != nil {
+		details["invite"] = reg.Invite.Id
+	}
+	h.audit(c, AuditEvent{
+		Action:  AuditRegister,
+		Outcome: AuditSuccess,
+		Actor:   &duser.Id,
+		Target:  &duser.Id,
+		Details: details,
+	})
 	user := MapDbUser(&duser)
+	h.emit(c, WebhookUserCreated, user)
+	if h.mailer != nil {
+		err = h.sendCode(ctx, &duser, EmailVerificationCode)
+		if err != nil {
+			c.Logger().Error(err)
+		}
+	}
 	return h.createSession(c, &user)
 }
 
@@ -230,7 +391,8 @@ func (h *Handler) Register(c echo.Context) error {
 // @Security     Jwt[users.delete]
 // @Param        id   path      string  false  "User id of the user to delete" Format(uuid)
 // @Success      200  {object}  User
-// @Failure      404  {object}  problem.Problem "Invalid id format"
+// @Failure      400  {object}  problem.Problem "Invalid id format"
+// @Failure      403  {object}  problem.Problem "Missing users.delete permission"
 // @Failure      404  {object}  problem.Problem "Invalid user id"
 // @Router /users/{id} [delete]
 func (h *Handler) DeleteUser(c echo.Context) error {
@@ -238,13 +400,43 @@ func (h *Handler) DeleteUser(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(400, "Invalid id given: not an uuid")
 	}
+	self, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if uid != self {
+		err = CheckPermissions(c, []string{"users.delete"})
+		if err != nil {
+			return err
+		}
+	} else if err = RequireAccountSession(c); err != nil {
+		return err
+	}
 
-	ret, err := h.db.DeleteUser(context.Background(), uid)
+	ctx := context.Background()
+	// sessions are deleted before the user (instead of by the cascade) to send their webhooks.
+	sessions, err := h.db.DeleteUserSessions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	ret, err := h.db.DeleteUser(ctx, uid)
 	if err == pgx.ErrNoRows {
 		return echo.NewHTTPError(404, "No user found with given id")
 	} else if err != nil {
 		return err
 	}
+	h.audit(c, AuditEvent{
+		Action:  AuditUserDelete,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"username": ret.Username},
+	})
+	h.emitSessions(c, WebhookSessionDeleted, uid, sessions)
+	h.emit(c, WebhookUserDeleted, MapDbUser(&ret))
+	err = h.logos.Delete(ctx, uid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 	return c.JSON(200, MapDbUser(&ret))
 }
 
@@ -255,18 +447,268 @@ func (h *Handler) DeleteUser(c echo.Context) error {
 // @Produce      json
 // @Security     Jwt
 // @Success      200  {object}  User
+// @Failure      403  {object}  problem.Problem "A profile is active"
 // @Router /users/me [delete]
 func (h *Handler) DeleteSelf(c echo.Context) error {
 	uid, err := GetCurrentUserId(c)
 	if err != nil {
 		return err
 	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
 
-	ret, err := h.db.DeleteUser(context.Background(), uid)
+	ctx := context.Background()
+	// sessions are deleted before the user (instead of by the cascade) to send their webhooks.
+	sessions, err := h.db.DeleteUserSessions(ctx, uid)
+	if err != nil {
+		return err
+	}
+	ret, err := h.db.DeleteUser(ctx, uid)
 	if err == pgx.ErrNoRows {
 		return echo.NewHTTPError(403, "Invalid token, user already deleted.")
 	} else if err != nil {
 		return err
 	}
+	h.audit(c, AuditEvent{
+		Action:  AuditUserDelete,
+		Outcome: AuditSuccess,
+		Target:  &uid,
+		Details: map[string]any{"username": ret.Username},
+	})
+	h.emitSessions(c, WebhookSessionDeleted, uid, sessions)
+	h.emit(c, WebhookUserDeleted, MapDbUser(&ret))
+	err = h.logos.Delete(ctx, uid)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 	return c.JSON(200, MapDbUser(&ret))
 }
+
+// @Summary      Edit user
+// @Description  Edit an account. PUT requires both a username and an email while PATCH only updates the given fields.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Security     Jwt[users.write]
+// @Param        id    path    string       true   "The id of the user to edit" Format(uuid)
+// @Param        user  body    EditUserDto  false  "Edited user info"
+// @Success      200  {object}  User
+// @Failure      400  {object}  problem.Problem "Invalid body or id"
+// @Failure      403  {object}  problem.Problem "Missing permissions or invalid old password"
+// @Failure      404  {object}  problem.Problem "No user with the given id found"
+// @Failure      409  {object}  problem.Problem "Duplicated email or username"
+// @Failure      422  {object}  problem.Problem "Can't set a password on an ldap account"
+// @Router /users/{id} [put]
+// @Router /users/{id} [patch]
+func (h *Handler) EditUser(c echo.Context) error {
+	uid, err := h.getEditableUserId(c)
+	if err != nil {
+		return err
+	}
+	if self, _ := GetCurrentUserId(c); uid == self {
+		// same restrictions as PATCH /users/me.
+		if err = RequireAccountSession(c); err != nil {
+			return err
+		}
+	}
+	return h.editUser(c, uid)
+}
+
+// Parse the id path param, editing another user requires the `users.write` permission.
+func (h *Handler) getEditableUserId(c echo.Context) (uuid.UUID, error) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(400, "Invalid id given: not an uuid")
+	}
+	self, err := GetCurrentUserId(c)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	if uid != self {
+		err = CheckPermissions(c, []string{"users.write"})
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+	}
+	return uid, nil
+}
+
+// @Summary      Edit self
+// @Description  Edit your account. PUT requires both a username and an email while PATCH only updates the given fields.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Security     Jwt
+// @Param        user  body    EditUserDto  false  "Edited user info"
+// @Success      200  {object}  User
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      403  {object}  problem.Problem "Missing permissions, invalid old password or a profile is active"
+// @Failure      409  {object}  problem.Problem "Duplicated email or username"
+// @Failure      422  {object}  problem.Problem "Can't set a password on an ldap account"
+// @Router /users/me [put]
+// @Router /users/me [patch]
+func (h *Handler) EditSelf(c echo.Context) error {
+	uid, err := GetCurrentUserId(c)
+	if err != nil {
+		return err
+	}
+	if err = RequireAccountSession(c); err != nil {
+		return err
+	}
+	return h.editUser(c, uid)
+}
+
+func (h *Handler) editUser(c echo.Context, id uuid.UUID) error {
+	var req EditUserDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+	if c.Request().Method == http.MethodPut && (req.Username == nil || req.Email == nil) {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			"Both username and email are required, use PATCH to only edit some fields.",
+		)
+	}
+
+	ctx := context.Background()
+	dbuser, err := h.db.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(dbuser) == 0 {
+		return echo.NewHTTPError(404, "No user found with given id")
+	}
+	user := dbuser[0].User
+
+	params := dbc.UpdateUserParams{
+		Id:       id,
+		Username: user.Username,
+		Email:    user.Email,
+		Password: user.Password,
+		Claims:   user.Claims,
+		Roles:    user.Roles,
+	}
+	if req.Username != nil {
+		params.Username = *req.Username
+	}
+	if req.Email != nil {
+		params.Email = *req.Email
+	}
+	if req.Password != nil {
+		if h.isLdapUser(dbuser) {
+			return echo.NewHTTPError(
+				http.StatusUnprocessableEntity,
+				"Can't set a password on an ldap account, change it in the directory instead.",
+			)
+		}
+		// Accounts created via oidc don't have a password to check against.
+		if user.Password != nil && CheckPermissions(c, []string{"users.password"}) != nil {
+			if req.OldPassword == nil {
+				return echo.NewHTTPError(http.StatusForbidden, "The `oldPassword` field is required to change your password.")
+			}
+			match, err := argon2id.ComparePasswordAndHash(*req.OldPassword, *user.Password)
+			if err != nil {
+				return err
+			}
+			if !match {
+				h.audit(c, AuditEvent{
+					Action:  AuditPasswordChange,
+					Outcome: AuditFailure,
+					Target:  &id,
+					Details: map[string]any{"reason": "invalid old password"},
+				})
+				return echo.NewHTTPError(http.StatusForbidden, "Invalid old password")
+			}
+		}
+		pass, err := argon2id.CreateHash(*req.Password, argon2id.DefaultParams)
+		if err != nil {
+			return err
+		}
+		params.Password = &pass
+	}
+	if req.Claims != nil {
+		err = CheckPermissions(c, []string{"users.claims"})
+		if err != nil {
+			return err
+		}
+		params.Claims = req.Claims
+	}
+	if req.Roles != nil {
+		err = CheckPermissions(c, []string{"users.roles"})
+		if err != nil {
+			return err
+		}
+		if err = h.config.ValidateRoles(req.Roles); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+		params.Roles = req.Roles
+	}
+
+	updated, err := h.db.UpdateUser(ctx, params)
+	if ErrIs(err, pgerrcode.UniqueViolation) {
+		return echo.NewHTTPError(409, "Email or username already taken")
+	} else if err != nil {
+		return err
+	}
+	h.auditUserEdit(c, &user, &updated, req.Password != nil)
+	if updated.Email != user.Email {
+		// reset codes sent to the old email must not be usable anymore.
+		err = h.db.DeleteUserVerificationCodes(ctx, dbc.DeleteUserVerificationCodesParams{
+			UserPk: updated.Pk,
+			Kind:   PasswordResetCode,
+		})
+		if err != nil {
+			return err
+		}
+		if h.mailer != nil {
+			err = h.sendCode(ctx, &updated, EmailVerificationCode)
+			if err != nil {
+				c.Logger().Error(err)
+			}
+		}
+	}
+
+	ret, err := h.getUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	h.emit(c, WebhookUserUpdated, ret)
+	return c.JSON(200, ret)
+}
+
+func (h *Handler) auditUserEdit(c echo.Context, old *dbc.User, updated *dbc.User, password bool) {
+	changes := make(map[string]any)
+	if old.Username != updated.Username {
+		changes["username"] = updated.Username
+	}
+	if old.Email != updated.Email {
+		changes["email"] = updated.Email
+	}
+	if len(changes) > 0 {
+		h.audit(c, AuditEvent{Action: AuditUserEdit, Outcome: AuditSuccess, Target: &updated.Id, Details: changes})
+	}
+	if password {
+		h.audit(c, AuditEvent{Action: AuditPasswordChange, Outcome: AuditSuccess, Target: &updated.Id})
+	}
+	if !reflect.DeepEqual(old.Claims, updated.Claims) {
+		h.audit(c, AuditEvent{
+			Action:  AuditClaimsEdit,
+			Outcome: AuditSuccess,
+			Target:  &updated.Id,
+			Details: map[string]any{"old": old.Claims, "new": updated.Claims},
+		})
+	}
+	if !slices.Equal(old.Roles, updated.Roles) {
+		h.audit(c, AuditEvent{
+			Action:  AuditRolesEdit,
+			Outcome: AuditSuccess,
+			Target:  &updated.Id,
+			Details: map[string]any{"old": old.Roles, "new": updated.Roles},
+		})
+	}
+}
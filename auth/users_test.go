@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Follow the `next` links of a page and return the usernames of every users.
+func listUsernames(t *testing.T, s *TestServer, query string) []string {
+	t.Helper()
+	var ret []string
+	next := "/users?" + query
+	for next != "" {
+		var page Page[User]
+		s.Request(http.MethodGet, next, nil).Expect(t, http.StatusOK).Json(t, &page)
+		for _, user := range page.Items {
+			ret = append(ret, user.Username)
+		}
+		next = ""
+		if page.Next != nil {
+			next = *page.Next
+		}
+	}
+	return ret
+}
+
+func TestListUsersPagination(t *testing.T) {
+	s := NewTestServer(t, nil)
+	expected := []string{"admin"}
+	for i := range 6 {
+		expected = append(expected, fmt.Sprintf("user-%d", i))
+	}
+	for _, username := range expected {
+		s.Register(username)
+	}
+	s.Login("admin")
+
+	asc := listUsernames(t, s, "limit=2&sort=username")
+	if !slices.Equal(asc, expected) {
+		t.Fatalf("invalid ascending pages: %v", asc)
+	}
+	desc := listUsernames(t, s, "limit=2&sort=-username")
+	slices.Reverse(expected)
+	if !slices.Equal(desc, expected) {
+		t.Fatalf("invalid descending pages: %v", desc)
+	}
+	created := listUsernames(t, s, "limit=3&sort=-createdDate")
+	if !slices.Equal(created, expected) {
+		t.Fatalf("invalid descending pages by creation date: %v", created)
+	}
+
+	// a cursor can't be used with another sort or direction.
+	var page Page[User]
+	s.Request(http.MethodGet, "/users?limit=2&sort=username", nil).Expect(t, http.StatusOK).Json(t, &page)
+	next, err := url.Parse(*page.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := url.QueryEscape(next.Query().Get("after"))
+	s.Request(http.MethodGet, "/users?limit=2&sort=-username&after="+after, nil).Expect(t, http.StatusBadRequest)
+	s.Request(http.MethodGet, "/users?limit=2&sort=createdDate&after="+after, nil).Expect(t, http.StatusBadRequest)
+}
+
+func TestFirstUserConcurrentRegistrations(t *testing.T) {
+	for _, mode := range []string{"open", "invite"} {
+		t.Run(mode, func(t *testing.T) {
+			s := NewTestServer(t, map[string]string{"KEIBI_REGISTRATION": mode})
+
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			tokens := []string{}
+			for i := range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					username := fmt.Sprintf("user-%d", i)
+					resp := s.Request(http.MethodPost, "/users", map[string]string{
+						"username": username,
+						"password": "password-" + username,
+						"email":    username + "@zoriya.dev",
+					})
+					if resp.Status != http.StatusCreated {
+						return
+					}
+					var session struct{ Token string }
+					resp.Json(t, &session)
+					lock.Lock()
+					defer lock.Unlock()
+					tokens = append(tokens, session.Token)
+				}()
+			}
+			wg.Wait()
+
+			if mode == "invite" && len(tokens) != 1 {
+				t.Fatalf("only the first user can register without an invite, %d registered", len(tokens))
+			}
+			admins := 0
+			for _, token := range tokens {
+				s.UseSession(token)
+				var me User
+				s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &me)
+				if slices.Contains(me.Roles, "admin") {
+					admins++
+				}
+			}
+			if len(tokens) == 0 || admins != 1 {
+				t.Fatalf("expected one admin, got %d (for %d users)", admins, len(tokens))
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := NewTestServer(t, nil)
+	s.Register("admin")
+	var victim, other User
+	s.Register("victim")
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &victim)
+	s.Register("other")
+	s.Request(http.MethodGet, "/users/me", nil).Expect(t, http.StatusOK).Json(t, &other)
+
+	// users without the users.delete permission can only delete themselves.
+	s.Request(http.MethodDelete, "/users/"+victim.Id.String(), nil).Expect(t, http.StatusForbidden)
+	s.Request(http.MethodDelete, "/users/"+other.Id.String(), nil).Expect(t, http.StatusOK)
+
+	s.Login("admin")
+	s.Request(http.MethodGet, "/users/"+victim.Id.String(), nil).Expect(t, http.StatusOK)
+	s.Request(http.MethodDelete, "/users/"+victim.Id.String(), nil).Expect(t, http.StatusOK)
+	s.Request(http.MethodGet, "/users/"+victim.Id.String(), nil).Expect(t, http.StatusNotFound)
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"slices"
@@ -28,23 +33,57 @@ func GetCurrentUserId(c echo.Context) (uuid.UUID, error) {
 	return ret, nil
 }
 
-func CheckPermissions(c echo.Context, perms []string) error {
+func GetCurrentSessionId(c echo.Context) (uuid.UUID, error) {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return uuid.UUID{}, echo.NewHTTPError(401, "Unauthorized")
+	}
+	sid, ok := token.Claims.(jwt.MapClaims)["sid"].(string)
+	if !ok {
+		return uuid.UUID{}, echo.NewHTTPError(400, "Missing session id")
+	}
+	ret, err := uuid.Parse(sid)
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(400, "Invalid session id")
+	}
+	return ret, nil
+}
+
+// Permissions of the current jwt (from its `permissions` claim).
+func GetPermissions(c echo.Context) ([]string, error) {
 	token, ok := c.Get("user").(*jwt.Token)
 	if !ok {
-		return echo.NewHTTPError(401, "Not logged in")
+		return nil, echo.NewHTTPError(401, "Not logged in")
 	}
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return echo.NewHTTPError(403, "Could not retrieve claims")
+		return nil, echo.NewHTTPError(403, "Could not retrieve claims")
 	}
 
 	permissions_claims, ok := claims["permissions"]
 	if !ok {
-		return echo.NewHTTPError(403, fmt.Sprintf("Missing permissions: %s.", ", "))
+		return []string{}, nil
 	}
-	permissions, ok := permissions_claims.([]string)
+	// parsed jwts have their arrays as []any, not []string.
+	raw, ok := permissions_claims.([]any)
 	if !ok {
-		return echo.NewHTTPError(403, "Invalid permission claim.")
+		return nil, echo.NewHTTPError(403, "Invalid permission claim.")
+	}
+	permissions := make([]string, 0, len(raw))
+	for _, perm := range raw {
+		p, ok := perm.(string)
+		if !ok {
+			return nil, echo.NewHTTPError(403, "Invalid permission claim.")
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, nil
+}
+
+func CheckPermissions(c echo.Context, perms []string) error {
+	permissions, err := GetPermissions(c)
+	if err != nil {
+		return err
 	}
 
 	missing := make([]string, 0)
@@ -71,3 +110,48 @@ func ErrIs(err error, code string) bool {
 	}
 	return pgerr.Code == code
 }
+
+func ErrIsConstraint(err error, constraint string) bool {
+	var pgerr *pgconn.PgError
+
+	if !errors.As(err, &pgerr) {
+		return false
+	}
+	return pgerr.ConstraintName == constraint
+}
+
+func GenerateToken() (string, error) {
+	id := make([]byte, 64)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id), nil
+}
+
+// Generate a random code that can be easily typed or copy/pasted (for mails for example).
+func GenerateCode() (string, error) {
+	id := make([]byte, 20)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id), nil
+}
+
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Split a comma separated list, ignoring empty values.
+func SplitList(value string) []string {
+	ret := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
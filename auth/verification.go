@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	CodeAttempts           = "code"
+	PasswordResetCode      = "password_reset"
+	EmailVerificationCode  = "email_verification"
+	PasswordResetDelay     = 15 * time.Minute
+	EmailVerificationDelay = 24 * time.Hour
+)
+
+type RequestCodeDto struct {
+	// Either the email or the username of the account.
+	Login string `json:"login" validate:"required"`
+}
+
+type ResetPasswordDto struct {
+	// Code received by mail.
+	Code string `json:"code" validate:"required"`
+	// New password of the account.
+	Password string `json:"password" validate:"required"`
+}
+
+type VerifyEmailDto struct {
+	// Code received by mail.
+	Code string `json:"code" validate:"required"`
+}
+
+func (h *Handler) sendCode(ctx context.Context, user *dbc.User, kind string) error {
+	code, err := GenerateCode()
+	if err != nil {
+		return err
+	}
+
+	var subject, body string
+	var delay time.Duration
+	switch kind {
+	case PasswordResetCode:
+		delay = PasswordResetDelay
+		subject = "Reset your password"
+		body = fmt.Sprintf(
+			"Hello %s,\n\nUse the following code to reset your password: %s\n\nThis code expires in %s. If you did not request a password reset, you can ignore this email.\n",
+			user.Username,
+			code,
+			delay,
+		)
+	case EmailVerificationCode:
+		delay = EmailVerificationDelay
+		subject = "Verify your email"
+		body = fmt.Sprintf(
+			"Hello %s,\n\nUse the following code to verify your email: %s\n\nThis code expires in %s.\n",
+			user.Username,
+			code,
+			delay,
+		)
+	default:
+		return fmt.Errorf("invalid code kind: %s", kind)
+	}
+
+	// only the last code sent is valid.
+	err = h.db.DeleteUserVerificationCodes(ctx, dbc.DeleteUserVerificationCodesParams{
+		UserPk: user.Pk,
+		Kind:   kind,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = h.db.CreateVerificationCode(ctx, dbc.CreateVerificationCodeParams{
+		UserPk:   user.Pk,
+		Kind:     kind,
+		Code:     HashToken(code),
+		Email:    user.Email,
+		ExpireAt: time.Now().UTC().Add(delay),
+	})
+	if err != nil {
+		return err
+	}
+	return h.mailer.Send(ctx, user.Email, subject, body)
+}
+
+func (h *Handler) consumeCode(ctx context.Context, code string, kind string) (*dbc.VerificationCode, error) {
+	ret, err := h.db.ConsumeVerificationCode(ctx, dbc.ConsumeVerificationCodeParams{
+		Code: HashToken(code),
+		Kind: kind,
+	})
+	if err == pgx.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Invalid code.")
+	} else if err != nil {
+		return nil, err
+	}
+	if ret.ExpireAt.Compare(time.Now().UTC()) < 0 {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Code has expired.")
+	}
+	return &ret, nil
+}
+
+func (h *Handler) requestCode(c echo.Context, kind string) error {
+	if h.mailer == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "Mails are not configured on this instance.")
+	}
+	var req RequestCodeDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	// every request counts as an attempt (they are never released) to prevent flooding mailboxes.
+	err = h.reserveAttempt(ctx, c, CodeAttempts, c.RealIP(), h.config.LoginMaxIpAttempts)
+	if err != nil {
+		return err
+	}
+	// always return the same response to prevent leaking which accounts exist.
+	dbuser, err := h.db.GetUserByLogin(ctx, req.Login)
+	if err == pgx.ErrNoRows {
+		return c.NoContent(http.StatusAccepted)
+	} else if err != nil {
+		return err
+	}
+	if kind == EmailVerificationCode && dbuser.EmailVerified {
+		return c.NoContent(http.StatusAccepted)
+	}
+	if kind == PasswordResetCode {
+		rows, err := h.db.GetUser(ctx, dbuser.Id)
+		if err != nil {
+			return err
+		}
+		// passwords of ldap users are managed by the directory.
+		if h.isLdapUser(rows) {
+			return c.NoContent(http.StatusAccepted)
+		}
+	}
+
+	// sending the mail takes time, do it in the background so the response time does not tell if the account exists.
+	logger := c.Logger()
+	go func() {
+		err := h.sendCode(context.Background(), &dbuser, kind)
+		if err != nil {
+			logger.Error(err)
+		}
+	}()
+	return c.NoContent(http.StatusAccepted)
+}
+
+// @Summary      Request password reset
+// @Description  Send a code to reset the password of an account by mail.
+// @Description  This always succeeds, even if no account matches the given login.
+// @Tags         users
+// @Accept       json
+// @Param        login  body  RequestCodeDto  false  "Account to reset"
+// @Success      202
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      429  {object}  problem.Problem "Too many codes requested from this ip"
+// @Failure      501  {object}  problem.Problem "Mails are not configured on this instance"
+// @Router /password-reset [post]
+func (h *Handler) RequestPasswordReset(c echo.Context) error {
+	return h.requestCode(c, PasswordResetCode)
+}
+
+// @Summary      Reset password
+// @Description  Change the password of an account with a code received by mail. Every sessions of the account are closed.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        reset  body  ResetPasswordDto  false  "Code and new password"
+// @Success      200  {object}  User
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      403  {object}  problem.Problem "Invalid or expired code"
+// @Router /password-reset/confirm [post]
+func (h *Handler) ResetPassword(c echo.Context) error {
+	var req ResetPasswordDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	code, err := h.consumeCode(ctx, req.Code, PasswordResetCode)
+	if err != nil {
+		return err
+	}
+
+	pass, err := argon2id.CreateHash(req.Password, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+	user, err := h.db.SetUserPassword(ctx, dbc.SetUserPasswordParams{
+		Pk:       code.UserPk,
+		Password: &pass,
+	})
+	if err != nil {
+		return err
+	}
+	sessions, err := h.db.DeleteAllUserSessions(ctx, user.Pk)
+	if err != nil {
+		return err
+	}
+	h.emitSessions(c, WebhookSessionDeleted, user.Id, sessions)
+	h.audit(c, AuditEvent{
+		Action:  AuditPasswordReset,
+		Outcome: AuditSuccess,
+		Actor:   &user.Id,
+		Target:  &user.Id,
+	})
+	// receiving the code proves the user owns this email.
+	verified, err := h.db.VerifyUserEmail(ctx, dbc.VerifyUserEmailParams{
+		Pk:    user.Pk,
+		Email: code.Email,
+	})
+	if err == nil {
+		user = verified
+		h.emit(c, WebhookUserUpdated, MapDbUser(&user))
+	} else if err != pgx.ErrNoRows {
+		return err
+	}
+	return c.JSON(200, MapDbUser(&user))
+}
+
+// @Summary      Request email verification
+// @Description  Send a code to verify the email of an account by mail.
+// @Description  This always succeeds, even if no account matches the given login.
+// @Tags         users
+// @Accept       json
+// @Param        login  body  RequestCodeDto  false  "Account to verify"
+// @Success      202
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      429  {object}  problem.Problem "Too many codes requested from this ip"
+// @Failure      501  {object}  problem.Problem "Mails are not configured on this instance"
+// @Router /verify-email [post]
+func (h *Handler) RequestEmailVerification(c echo.Context) error {
+	return h.requestCode(c, EmailVerificationCode)
+}
+
+// @Summary      Verify email
+// @Description  Mark the email of an account as verified with a code received by mail.
+// @Tags         users
+// @Accept       json
+// @Produce      json
+// @Param        code  body  VerifyEmailDto  false  "Code received by mail"
+// @Success      200  {object}  User
+// @Failure      400  {object}  problem.Problem "Invalid body"
+// @Failure      403  {object}  problem.Problem "Invalid or expired code (or the email changed since the code was sent)"
+// @Router /verify-email/confirm [post]
+func (h *Handler) VerifyEmail(c echo.Context) error {
+	var req VerifyEmailDto
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err = c.Validate(&req); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	code, err := h.consumeCode(ctx, req.Code, EmailVerificationCode)
+	if err != nil {
+		return err
+	}
+	user, err := h.db.VerifyUserEmail(ctx, dbc.VerifyUserEmailParams{
+		Pk:    code.UserPk,
+		Email: code.Email,
+	})
+	if err == pgx.ErrNoRows {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid code, the email changed since it was sent.")
+	} else if err != nil {
+		return err
+	}
+	ret := MapDbUser(&user)
+	h.emit(c, WebhookUserUpdated, ret)
+	return c.JSON(200, ret)
+}
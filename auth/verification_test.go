@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type SmtpSink struct {
+	net.Listener
+	Mails chan string
+
+	lock sync.Mutex
+	// New connections wait for this to be closed before answering, used to simulate a slow mail server.
+	ready chan struct{}
+}
+
+// Minimal smtp server that accepts every mail (without tls or auth).
+func NewSmtpSink(t *testing.T) *SmtpSink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ready := make(chan struct{})
+	close(ready)
+	ret := &SmtpSink{Listener: l, Mails: make(chan string, 10), ready: ready}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ret.serve(conn)
+		}
+	}()
+	return ret
+}
+
+// Make new connections hang until the returned function is called.
+func (s *SmtpSink) Hold() func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ready := make(chan struct{})
+	s.ready = ready
+	return func() { close(ready) }
+}
+
+func (s *SmtpSink) Receive(t *testing.T) string {
+	t.Helper()
+	select {
+	case mail := <-s.Mails:
+		return mail
+	case <-time.After(10 * time.Second):
+		t.Fatal("no mail received")
+		return ""
+	}
+}
+
+func (s *SmtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	s.lock.Lock()
+	ready := s.ready
+	s.lock.Unlock()
+	<-ready
+	r := bufio.NewReader(conn)
+	reply := func(msg string) { conn.Write([]byte(msg + "\r\n")) }
+	reply("220 sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 sink")
+		case "DATA":
+			reply("354 go ahead")
+			var mail strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				mail.WriteString(line)
+			}
+			s.Mails <- mail.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *SmtpSink) Env() map[string]string {
+	host, port, _ := net.SplitHostPort(s.Addr().String())
+	return map[string]string{
+		"KEIBI_MAILER": "smtp",
+		"SMTP_HOST":    host,
+		"SMTP_PORT":    port,
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	sink := NewSmtpSink(t)
+	s := NewTestServer(t, sink.Env())
+	s.Register("reset-user")
+	s.Auth = ""
+	// email verification code
+	sink.Receive(t)
+
+	// the response does not wait for the mail server, unknown accounts can't be guessed via timings.
+	release := sink.Hold()
+	start := time.Now()
+	s.Request(http.MethodPost, "/password-reset", map[string]string{"login": "reset-user"}).
+		Expect(t, http.StatusAccepted)
+	s.Request(http.MethodPost, "/password-reset", map[string]string{"login": "unknown-user"}).
+		Expect(t, http.StatusAccepted)
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("password reset requests waited for the mail server")
+	}
+	release()
+
+	mail := sink.Receive(t)
+	if !strings.Contains(mail, "To: reset-user@zoriya.dev") {
+		t.Fatalf("mail sent to the wrong user: %s", mail)
+	}
+	code := regexp.MustCompile(`reset your password: (\S+)`).FindStringSubmatch(mail)
+	if code == nil {
+		t.Fatalf("no code in the mail: %s", mail)
+	}
+	select {
+	case mail = <-sink.Mails:
+		t.Fatalf("a mail was sent for an unknown account: %s", mail)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	s.Request(http.MethodPost, "/password-reset/confirm", map[string]string{
+		"code":     code[1],
+		"password": "new-password",
+	}).Expect(t, http.StatusOK)
+	// codes can only be used once.
+	s.Request(http.MethodPost, "/password-reset/confirm", map[string]string{
+		"code":     code[1],
+		"password": "other-password",
+	}).Expect(t, http.StatusForbidden)
+
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "reset-user",
+		"password": "password-reset-user",
+	}).Expect(t, http.StatusForbidden)
+	s.Request(http.MethodPost, "/sessions", map[string]string{
+		"login":    "reset-user",
+		"password": "new-password",
+	}).Expect(t, http.StatusCreated)
+}
+
+func TestPasswordResetEmailChange(t *testing.T) {
+	sink := NewSmtpSink(t)
+	s := NewTestServer(t, sink.Env())
+	s.Register("moving-user")
+	sink.Receive(t)
+	jwt := s.Auth
+
+	s.Auth = ""
+	s.Request(http.MethodPost, "/password-reset", map[string]string{"login": "moving-user"}).
+		Expect(t, http.StatusAccepted)
+	code := regexp.MustCompile(`reset your password: (\S+)`).FindStringSubmatch(sink.Receive(t))
+	if code == nil {
+		t.Fatal("no code in the reset mail")
+	}
+
+	s.Auth = jwt
+	s.Request(http.MethodPatch, "/users/me", map[string]string{"email": "moved-user@zoriya.dev"}).
+		Expect(t, http.StatusOK)
+	// the old mailbox can't be used to take over the account.
+	s.Request(http.MethodPost, "/password-reset/confirm", map[string]string{
+		"code":     code[1],
+		"password": "new-password",
+	}).Expect(t, http.StatusForbidden)
+}
+
+func TestRequestCodeRateLimit(t *testing.T) {
+	sink := NewSmtpSink(t)
+	env := sink.Env()
+	env["KEIBI_LOGIN_MAX_IP_ATTEMPTS"] = "3"
+	s := NewTestServer(t, env)
+
+	for range 3 {
+		s.Request(http.MethodPost, "/password-reset", map[string]string{"login": "unknown-user"}).
+			Expect(t, http.StatusAccepted)
+	}
+	s.Request(http.MethodPost, "/verify-email", map[string]string{"login": "unknown-user"}).
+		Expect(t, http.StatusTooManyRequests)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/zoriya/kyoo/keibi/dbc"
+)
+
+const (
+	WebhookUserCreated    = "user.created"
+	WebhookUserUpdated    = "user.updated"
+	WebhookUserDeleted    = "user.deleted"
+	WebhookSessionCreated = "session.created"
+	WebhookSessionDeleted = "session.deleted"
+
+	// Deliveries are dropped after this many failed attempts.
+	WebhookMaxAttempts = 10
+	// Delay before the first retry, doubled after each failure.
+	WebhookRetryDelay    = 10 * time.Second
+	WebhookMaxRetryDelay = 6 * time.Hour
+	// How long a delivery is reserved by an instance while it's being sent.
+	WebhookLease       = time.Minute
+	WebhookBatchSize   = 20
+	WebhookPollTimeout = 5 * time.Second
+)
+
+var WebhookEvents = []string{
+	WebhookUserCreated,
+	WebhookUserUpdated,
+	WebhookUserDeleted,
+	WebhookSessionCreated,
+	WebhookSessionDeleted,
+}
+
+type WebhookConfig struct {
+	Name string
+	Url  string
+	// Key used to sign payloads (in the `X-Keibi-Signature` header).
+	Secret string
+	// Events sent to this webhook, every events if empty.
+	Events []string
+}
+
+type WebhookPayload struct {
+	// Kind of event, for example `user.created`.
+	Event string `json:"event"`
+	// When did the event happen.
+	Date time.Time `json:"date"`
+	// The user or the session affected by the event.
+	Data any `json:"data"`
+}
+
+type WebhookSession struct {
+	Session
+	// Id of the user owning this session.
+	UserId uuid.UUID `json:"userId"`
+}
+
+func LoadWebhooks() (map[string]WebhookConfig, error) {
+	ret := make(map[string]WebhookConfig)
+
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, "KEIBI_WEBHOOK_") || value == "" {
+			continue
+		}
+		sep := strings.LastIndex(key, "_")
+		if sep <= len("KEIBI_WEBHOOK_") {
+			fmt.Printf("Invalid webhook config value: %s\n", key)
+			continue
+		}
+		name := strings.ToLower(key[len("KEIBI_WEBHOOK_"):sep])
+		prop := strings.ToLower(key[sep+1:])
+
+		hook := ret[name]
+		hook.Name = name
+		switch prop {
+		case "url":
+			hook.Url = value
+		case "secret":
+			hook.Secret = value
+		case "events":
+			hook.Events = SplitList(value)
+		default:
+			fmt.Printf("Invalid webhook config value: %s\n", key)
+			continue
+		}
+		ret[name] = hook
+	}
+
+	for name, hook := range ret {
+		upper := strings.ToUpper(name)
+		if hook.Url == "" {
+			return nil, fmt.Errorf("missing KEIBI_WEBHOOK_%s_URL", upper)
+		}
+		if hook.Secret == "" {
+			return nil, fmt.Errorf("missing KEIBI_WEBHOOK_%s_SECRET", upper)
+		}
+		for _, event := range hook.Events {
+			if !slices.Contains(WebhookEvents, event) {
+				return nil, fmt.Errorf("invalid KEIBI_WEBHOOK_%s_EVENTS, unknown event: %s", upper, event)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Sign a payload, receivers should compute the same hmac to check that the request comes from keibi.
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Durable queue of webhook deliveries, stored in the database so they survive restarts.
+type Webhooks struct {
+	db     *dbc.Queries
+	hooks  map[string]WebhookConfig
+	client *http.Client
+	// Wakes up the delivery loop when a new event is queued.
+	wake chan struct{}
+}
+
+func NewWebhooks(db *dbc.Queries, hooks map[string]WebhookConfig) *Webhooks {
+	return &Webhooks{
+		db:     db,
+		hooks:  hooks,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Queue an event for every webhook listening to it.
+func (w *Webhooks) Emit(ctx context.Context, event string, data any) error {
+	if len(w.hooks) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(WebhookPayload{
+		Event: event,
+		Date:  time.Now().UTC(),
+		Data:  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range w.hooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, event) {
+			continue
+		}
+		err = w.db.CreateWebhookDelivery(ctx, dbc.CreateWebhookDeliveryParams{
+			Webhook: hook.Name,
+			Event:   event,
+			Payload: payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *Webhooks) send(ctx context.Context, hook *WebhookConfig, delivery *dbc.WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "keibi")
+	req.Header.Set("X-Keibi-Event", delivery.Event)
+	req.Header.Set("X-Keibi-Delivery", delivery.Id.String())
+	req.Header.Set("X-Keibi-Timestamp", timestamp)
+	req.Header.Set("X-Keibi-Signature", SignWebhook(hook.Secret, timestamp, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with status %d", hook.Name, resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *Webhooks) deliver(ctx context.Context, delivery *dbc.WebhookDelivery, logger echo.Logger) {
+	hook, ok := w.hooks[delivery.Webhook]
+	if !ok {
+		logger.Warnf("Dropping %s delivery for the unconfigured webhook %s", delivery.Event, delivery.Webhook)
+		_ = w.db.DeleteWebhookDelivery(ctx, delivery.Pk)
+		return
+	}
+
+	err := w.send(ctx, &hook, delivery)
+	if err == nil {
+		err = w.db.DeleteWebhookDelivery(ctx, delivery.Pk)
+		if err != nil {
+			logger.Error("Could not delete webhook delivery: ", err)
+		}
+		return
+	}
+
+	if delivery.Attempts >= WebhookMaxAttempts {
+		logger.Errorf("Dropping %s delivery %s after %d attempts: %s", delivery.Event, delivery.Id, delivery.Attempts, err)
+		_ = w.db.DeleteWebhookDelivery(ctx, delivery.Pk)
+		return
+	}
+	delay := min(WebhookRetryDelay<<(delivery.Attempts-1), WebhookMaxRetryDelay)
+	msg := err.Error()
+	err = w.db.RetryWebhookDelivery(ctx, dbc.RetryWebhookDeliveryParams{
+		Pk:          delivery.Pk,
+		NextAttempt: time.Now().UTC().Add(delay),
+		LastError:   &msg,
+	})
+	if err != nil {
+		logger.Error("Could not reschedule webhook delivery: ", err)
+	}
+}
+
+// Send queued deliveries until the context is canceled.
+func (w *Webhooks) Run(ctx context.Context, logger echo.Logger) {
+	if len(w.hooks) == 0 {
+		return
+	}
+	ticker := time.NewTicker(WebhookPollTimeout)
+	defer ticker.Stop()
+
+	for {
+		deliveries, err := w.db.ClaimWebhookDeliveries(ctx, dbc.ClaimWebhookDeliveriesParams{
+			LeaseUntil: time.Now().UTC().Add(WebhookLease),
+			Lim:        WebhookBatchSize,
+		})
+		if err != nil {
+			logger.Error("Could not retrieve webhook deliveries: ", err)
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.deliver(ctx, &delivery, logger)
+			}()
+		}
+		wg.Wait()
+
+		// a full batch means more deliveries are probably waiting.
+		if len(deliveries) == WebhookBatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Queue a webhook event. Errors are only logged, they should not fail the request.
+func (h *Handler) emit(c echo.Context, event string, data any) {
+	err := h.webhooks.Emit(context.Background(), event, data)
+	if err != nil {
+		c.Logger().Error("could not queue webhook: ", err)
+	}
+}
+
+func (h *Handler) emitSessions(c echo.Context, event string, userId uuid.UUID, sessions []dbc.Session) {
+	for _, session := range sessions {
+		h.emit(c, event, WebhookSession{
+			Session: MapSession(&session),
+			UserId:  userId,
+		})
+	}
+}
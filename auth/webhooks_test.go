@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type webhookRequest struct {
+	Header  http.Header
+	Payload WebhookPayload
+}
+
+// Receive webhooks, checking their signature. The first `failures` requests are answered with a 500.
+func NewWebhookReceiver(t *testing.T, secret string, failures int32) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 20)
+	var received atomic.Int32
+	ret := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expected := SignWebhook(secret, r.Header.Get("X-Keibi-Timestamp"), body)
+		if !hmac.Equal([]byte(r.Header.Get("X-Keibi-Signature")), []byte(expected)) {
+			t.Errorf("invalid webhook signature: %s", r.Header.Get("X-Keibi-Signature"))
+		}
+		var payload WebhookPayload
+		if err = json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid webhook payload: %s", body)
+		}
+		requests <- webhookRequest{Header: r.Header, Payload: payload}
+		if received.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(ret.Close)
+	return ret, requests
+}
+
+func receiveWebhook(t *testing.T, requests chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case ret := <-requests:
+		return ret
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook received")
+		return webhookRequest{}
+	}
+}
+
+// Wait until `query` (returning a single bool) is true.
+func (s *TestServer) waitFor(query string, msg string) {
+	s.t.Helper()
+	for range 50 {
+		var ok bool
+		err := s.db.QueryRow(context.Background(), query).Scan(&ok)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		if ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.t.Fatal(msg)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver, requests := NewWebhookReceiver(t, "webhook-secret", 1)
+	s := NewTestServer(t, map[string]string{
+		"KEIBI_WEBHOOK_TEST_URL":    receiver.URL,
+		"KEIBI_WEBHOOK_TEST_SECRET": "webhook-secret",
+		"KEIBI_WEBHOOK_TEST_EVENTS": "user.created,user.deleted,session.deleted",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.h.webhooks.Run(ctx, echo.New().Logger)
+
+	s.Register("webhook-user")
+	first := receiveWebhook(t, requests)
+	if first.Payload.Event != WebhookUserCreated || first.Header.Get("X-Keibi-Event") != WebhookUserCreated {
+		t.Fatalf("unexpected event: %+v", first)
+	}
+
+	// the delivery failed, it's kept until its next attempt (forced now instead of waiting for the backoff).
+	s.waitFor(
+		"select count(*) = 1 and bool_and(attempts = 1 and last_error is not null) from webhook_deliveries",
+		"the failed delivery was not rescheduled",
+	)
+	_, err := s.db.Exec(context.Background(), "update webhook_deliveries set next_attempt = now()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s.h.webhooks.wake <- struct{}{}:
+	default:
+	}
+
+	retry := receiveWebhook(t, requests)
+	if retry.Header.Get("X-Keibi-Delivery") != first.Header.Get("X-Keibi-Delivery") {
+		t.Fatalf("the retry should be the same delivery: %+v", retry)
+	}
+	s.waitFor("select count(*) = 0 from webhook_deliveries", "the delivery was not removed after it succeeded")
+
+	// sessions removed with their user are also notified (deliveries can be sent in any order).
+	s.Request(http.MethodDelete, "/users/me", nil).Expect(t, http.StatusOK)
+	events := []string{
+		receiveWebhook(t, requests).Payload.Event,
+		receiveWebhook(t, requests).Payload.Event,
+	}
+	if !slices.Contains(events, WebhookSessionDeleted) || !slices.Contains(events, WebhookUserDeleted) {
+		t.Fatalf("expected session.deleted & user.deleted events, got %v", events)
+	}
+}